@@ -0,0 +1,72 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// gandalf-admin runs administrative tasks against gandalf's database and
+// files. Currently, it rebuilds the lines gandalf manages in the
+// authorized_keys file from the keys stored in the database, keeping the
+// other lines untouched:
+//
+//	gandalf-admin [-config <file>] keys sync [--dry-run]
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/user"
+)
+
+var errUsage = errors.New("Usage: gandalf-admin [-config <file>] keys sync [--dry-run]")
+
+// run executes the command given in args, writing its output to w.
+func run(args []string, w io.Writer) error {
+	if len(args) < 2 || args[0] != "keys" || args[1] != "sync" {
+		return errUsage
+	}
+	flags := flag.NewFlagSet("keys sync", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	dryRun := flags.Bool("dry-run", false, "report the differences without changing the authorized_keys file")
+	if err := flags.Parse(args[2:]); err != nil || flags.NArg() > 0 {
+		return errUsage
+	}
+	report, err := user.SyncAuthorizedKeys(*dryRun)
+	if err != nil {
+		return err
+	}
+	for _, line := range report.Orphaned {
+		fmt.Fprint(w, "- "+line)
+	}
+	for _, line := range report.Missing {
+		fmt.Fprint(w, "+ "+line)
+	}
+	switch {
+	case report.InSync():
+		fmt.Fprintln(w, "The authorized_keys file is in sync.")
+	case *dryRun:
+		fmt.Fprintf(w, "%d missing and %d orphaned entries, the authorized_keys file was not changed.\n", len(report.Missing), len(report.Orphaned))
+	default:
+		fmt.Fprintf(w, "%d missing and %d orphaned entries, the authorized_keys file was rebuilt.\n", len(report.Missing), len(report.Orphaned))
+	}
+	return nil
+}
+
+func main() {
+	configFile := flag.String("config", "/etc/gandalf.conf", "Gandalf configuration file")
+	flag.Parse()
+	err := config.ReadConfigFile(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	err = run(flag.Args(), os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/gandalf/user"
+	"github.com/tsuru/tsuru/fs/fstest"
+	"gopkg.in/check.v1"
+)
+
+const rawKey = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCaNZSIEyP6FSdCX0WHDcUFTvebNbvqKiiLEiC7NTGvKrT15r2MtCDi4EPi4Ul+UyxWqb2D7FBnK1UmIcEFHd/ZCnBod2/FSplGOIbIb2UVVbqPX5Alv7IBCMyZJD14ex5cFh16zoqOsPOkOD803LMIlNvXPDDwKjY4TVOQV1JtA2tbZXvYUchqhTcKPxt5BDBZbeQkMMgUgHIEz6IueglFB3+dIZfrzlmM8CVSElKZOpucnJ5JOpGh3paSO/px2ZEcvY8WvjFdipvAWsis75GG/04F641I6XmYlo9fib/YytBXS23szqmvOqEqAopFnnGkDEo+LWI0+FXgPE8lc5BD me@host"
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Assert(err, check.IsNil)
+	config.Set("database:name", "gandalf_admin_tests")
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	fs.Fsystem = &fstest.RecordingFs{}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	fs.Fsystem = nil
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.User().Database.DropDatabase()
+}
+
+func (s *S) TestKeysSyncDryRun(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	_, err := user.New("bilbo", map[string]string{"mykey": rawKey})
+	config.Unset("authorized-keys-disabled")
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	keys, err := user.ListKeys("bilbo")
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	err = run([]string{"keys", "sync", "--dry-run"}, &buf)
+	c.Assert(err, check.IsNil)
+	expected := "+ " + keys[0].AuthorizedKey() + "1 missing and 0 orphaned entries, the authorized_keys file was not changed.\n"
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestKeysSync(c *check.C) {
+	var buf bytes.Buffer
+	err := run([]string{"keys", "sync"}, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "The authorized_keys file is in sync.\n")
+}
+
+func (s *S) TestKeysSyncAuthorizedKeysDisabled(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	var buf bytes.Buffer
+	err := run([]string{"keys", "sync"}, &buf)
+	c.Assert(err, check.Equals, user.ErrAuthorizedKeysDisabled)
+}
+
+func (s *S) TestInvalidArguments(c *check.C) {
+	for _, args := range [][]string{nil, {"keys"}, {"users", "sync"}, {"keys", "sync", "--force"}, {"keys", "sync", "now"}} {
+		var buf bytes.Buffer
+		err := run(args, &buf)
+		c.Check(err, check.Equals, errUsage)
+		c.Check(buf.String(), check.Equals, "")
+	}
+}
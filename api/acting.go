@@ -0,0 +1,128 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/auth"
+	"github.com/tsuru/gandalf/repository"
+)
+
+// ActingUserHeader is the header API clients use to act for a user, so
+// content endpoints only serve the repositories the user can read.
+const ActingUserHeader = "X-Gandalf-Acting-User"
+
+// actingUser returns the name of the user the request acts for: the user of
+// the personal access token that authenticated the request or, for other
+// requests, the user in the ActingUserHeader. It returns an empty name when
+// the request doesn't act for any user.
+func actingUser(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil && id.User != "" {
+		return id.User
+	}
+	return r.Header.Get(ActingUserHeader)
+}
+
+// authorizeRead checks whether the user the request acts for, if any, is
+// allowed to read the repository, like gandalf-ssh does for fetches. It
+// writes the proper error to the client and returns false when the request
+// should not go on.
+func authorizeRead(w http.ResponseWriter, r *http.Request, repoName string) bool {
+	userName := actingUser(r)
+	if userName == "" {
+		return true
+	}
+	repo, ok := actingUserRepository(w, repoName, userName)
+	if !ok {
+		return false
+	}
+	if !repo.HasReadPermission(userName) {
+		http.Error(w, "You don't have access to read this repository.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeCommit checks whether the user the request acts for is allowed to
+// commit to the branch of the repository, like gandalf-ssh and the update
+// hook do for pushes. Requests that don't act for any user are refused when
+// api:commit:require-acting-user or api:commit:force-committer is set. It
+// writes the proper error to the client and returns false when the request
+// should not go on.
+func authorizeCommit(w http.ResponseWriter, r *http.Request, repoName, branch string) bool {
+	userName := actingUser(r)
+	if userName == "" {
+		required, _ := config.GetBool("api:commit:require-acting-user")
+		if required || forceCommitter() {
+			http.Error(w, "An acting user is required to commit to repositories.", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	repo, ok := actingUserRepository(w, repoName, userName)
+	if !ok {
+		return false
+	}
+	if !repo.HasWritePermission(userName) {
+		http.Error(w, "You don't have access to write in this repository.", http.StatusForbidden)
+		return false
+	}
+	if err := repo.CheckCommit(userName, branch); err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*repository.RefUpdateDeniedError); ok {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return false
+	}
+	return true
+}
+
+// actingUserRepository gets the repository for a request acting for the
+// given user, checking that the user exists and is not suspended. It writes
+// the proper error to the client and returns false when the request should
+// not go on.
+func actingUserRepository(w http.ResponseWriter, repoName, userName string) (*repository.Repository, bool) {
+	repo, err := repository.Get(repoName)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return nil, false
+	}
+	u, err := getUserOr404(userName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	if u.Suspended {
+		http.Error(w, fmt.Sprintf("User %s is suspended", userName), http.StatusForbidden)
+		return nil, false
+	}
+	return &repo, true
+}
+
+// forceCommitter returns whether commits through the API are committed by
+// the user the request acts for, ignoring the committer sent by the client.
+func forceCommitter() bool {
+	force, _ := config.GetBool("api:commit:force-committer")
+	return force
+}
+
+// actingCommitter returns the committer of commits made through the API for
+// the given user: the name of the user, and an email address in the domain
+// set by api:commit:committer-email-domain, which defaults to host.
+func actingCommitter(userName string) repository.GitUser {
+	domain, err := config.GetString("api:commit:committer-email-domain")
+	if err != nil || domain == "" {
+		domain, _ = config.GetString("host")
+	}
+	return repository.GitUser{Name: userName, Email: userName + "@" + domain}
+}
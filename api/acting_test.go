@@ -0,0 +1,237 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/auth"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/multipartzip"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestActingUser(c *check.C) {
+	request, err := http.NewRequest("GET", "/repository/myrepo/tree", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(actingUser(request), check.Equals, "")
+	request.Header.Set(ActingUserHeader, "frodo")
+	c.Assert(actingUser(request), check.Equals, "frodo")
+	request = request.WithContext(auth.NewContext(request.Context(), &auth.Identity{Name: "portal", Scope: auth.ScopeReadOnly}))
+	c.Assert(actingUser(request), check.Equals, "frodo")
+	request = request.WithContext(auth.NewContext(request.Context(), &auth.Identity{Name: "bilbo", User: "bilbo", Scope: auth.ScopeReadOnly}))
+	c.Assert(actingUser(request), check.Equals, "bilbo")
+}
+
+func (s *S) TestContentEndpointsActingUser(c *check.C) {
+	repository.Retriever = &repository.MockContentRetriever{ResultContents: []byte("result")}
+	defer func() {
+		repository.Retriever = nil
+	}()
+	for _, name := range []string{"bilbo", "frodo"} {
+		_, err := user.New(name, map[string]string{})
+		c.Assert(err, check.IsNil)
+		defer user.Remove(name)
+	}
+	r := repository.Repository{Name: "privaterepo", Users: []string{"bilbo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	urls := []string{
+		"/repository/privaterepo/contents?path=README.txt",
+		"/repository/privaterepo/tree",
+		"/repository/privaterepo/archive?ref=master&format=zip",
+		"/repository/privaterepo/logs?ref=master&total=1",
+		"/repository/privaterepo/diff/commits?previous_commit=1b970b076bbb30d708e262b402d4e31910e1dc10&last_commit=545b1904af34458704e2aa06ff1aaffad5289f8f",
+		"/repository/privaterepo/branches",
+		"/repository/privaterepo/tags",
+	}
+	for _, url := range urls {
+		request, err := http.NewRequest("GET", url, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set(ActingUserHeader, "frodo")
+		recorder := httptest.NewRecorder()
+		s.router.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusForbidden, check.Commentf(url))
+		c.Check(recorder.Body.String(), check.Equals, "You don't have access to read this repository.\n", check.Commentf(url))
+		request, err = http.NewRequest("GET", url, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set(ActingUserHeader, "bilbo")
+		recorder = httptest.NewRecorder()
+		s.router.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusOK, check.Commentf(url))
+	}
+}
+
+func (s *S) TestAuthorizeRead(c *check.C) {
+	for _, name := range []string{"bilbo", "frodo"} {
+		_, err := user.New(name, map[string]string{})
+		c.Assert(err, check.IsNil)
+		defer user.Remove(name)
+	}
+	err := user.Suspend("frodo")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, r := range []repository.Repository{
+		{Name: "privaterepo", Users: []string{"frodo"}},
+		{Name: "publicrepo", IsPublic: true},
+	} {
+		err = conn.Repository().Insert(&r)
+		c.Assert(err, check.IsNil)
+		defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	}
+	tests := []struct {
+		user   string
+		repo   string
+		status int
+		body   string
+	}{
+		{"", "privaterepo", http.StatusOK, ""},
+		{"bilbo", "publicrepo", http.StatusOK, ""},
+		{"bilbo", "privaterepo", http.StatusForbidden, "You don't have access to read this repository.\n"},
+		{"frodo", "privaterepo", http.StatusForbidden, "User frodo is suspended\n"},
+		{"sam", "publicrepo", http.StatusForbidden, "User sam not found\n"},
+		{"bilbo", "ghostrepo", http.StatusNotFound, "repository not found\n"},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("GET", "/repository/"+t.repo+"/tree", nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set(ActingUserHeader, t.user)
+		recorder := httptest.NewRecorder()
+		allowed := authorizeRead(recorder, request, t.repo)
+		c.Check(allowed, check.Equals, t.status == http.StatusOK, check.Commentf("%s in %s", t.user, t.repo))
+		c.Check(recorder.Code, check.Equals, t.status, check.Commentf("%s in %s", t.user, t.repo))
+		c.Check(recorder.Body.String(), check.Equals, t.body, check.Commentf("%s in %s", t.user, t.repo))
+	}
+}
+
+func newCommitRequest(c *check.C, repo string, params map[string]string, actingUser string) *http.Request {
+	buf, err := multipartzip.CreateZipBuffer([]multipartzip.File{{Name: "doge.txt", Body: "Much doge"}})
+	c.Assert(err, check.IsNil)
+	reader, writer := io.Pipe()
+	go multipartzip.StreamWriteMultipartForm(params, "zipfile", "scaffold.zip", "muchBOUNDARY", writer, buf)
+	request, err := http.NewRequest("POST", "/repository/"+repo+"/commit", reader)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Content-Type", "multipart/form-data;boundary=muchBOUNDARY")
+	if actingUser != "" {
+		request.Header.Set(ActingUserHeader, actingUser)
+	}
+	return request
+}
+
+var commitParams = map[string]string{
+	"message":         "Repository scaffold",
+	"author-name":     "Doge Dog",
+	"author-email":    "doge@much.com",
+	"committer-name":  "Doge Dog",
+	"committer-email": "doge@much.com",
+	"branch":          "master",
+}
+
+func (s *S) TestPostNewCommitRequiresActingUser(c *check.C) {
+	config.Set("api:commit:require-acting-user", true)
+	defer config.Unset("api:commit:require-acting-user")
+	repository.Retriever = &repository.MockContentRetriever{}
+	defer func() {
+		repository.Retriever = nil
+	}()
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, newCommitRequest(c, "repo", commitParams, ""))
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "An acting user is required to commit to repositories.\n")
+}
+
+func (s *S) TestPostNewCommitActingUser(c *check.C) {
+	mock := &repository.MockContentRetriever{Refs: []repository.Ref{{Name: "master"}}}
+	repository.Retriever = mock
+	defer func() {
+		repository.Retriever = nil
+	}()
+	for _, name := range []string{"bilbo", "frodo", "sam"} {
+		_, err := user.New(name, map[string]string{})
+		c.Assert(err, check.IsNil)
+		defer user.Remove(name)
+	}
+	r := repository.Repository{
+		Name:          "myrepo",
+		Users:         []string{"bilbo", "frodo"},
+		ReadOnlyUsers: []string{"sam"},
+		Rules: []repository.RefRule{
+			{Ref: "refs/heads/master", Users: []string{"bilbo"}},
+		},
+	}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	tests := []struct {
+		user   string
+		status int
+		body   string
+	}{
+		{"sam", http.StatusForbidden, "You don't have access to write in this repository.\n"},
+		{"frodo", http.StatusForbidden, "You are not allowed to update refs/heads/master.\n"},
+		{"gollum", http.StatusForbidden, "User gollum not found\n"},
+		{"bilbo", http.StatusOK, ""},
+	}
+	for _, t := range tests {
+		recorder := httptest.NewRecorder()
+		s.router.ServeHTTP(recorder, newCommitRequest(c, r.Name, commitParams, t.user))
+		c.Check(recorder.Code, check.Equals, t.status, check.Commentf(t.user))
+		if t.body != "" {
+			c.Check(recorder.Body.String(), check.Equals, t.body, check.Commentf(t.user))
+		}
+	}
+	c.Assert(mock.LastCommit.Committer, check.Equals, repository.GitUser{Name: "Doge Dog", Email: "doge@much.com"})
+}
+
+func (s *S) TestPostNewCommitForceCommitter(c *check.C) {
+	config.Set("api:commit:force-committer", true)
+	defer config.Unset("api:commit:force-committer")
+	config.Set("api:commit:committer-email-domain", "gandalf.example.com")
+	defer config.Unset("api:commit:committer-email-domain")
+	mock := &repository.MockContentRetriever{}
+	repository.Retriever = mock
+	defer func() {
+		repository.Retriever = nil
+	}()
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	r := repository.Repository{Name: "myrepo", Users: []string{"bilbo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	params := map[string]string{
+		"message":      "Repository scaffold",
+		"author-name":  "Doge Dog",
+		"author-email": "doge@much.com",
+		"branch":       "master",
+	}
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, newCommitRequest(c, r.Name, params, ""))
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	recorder = httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, newCommitRequest(c, r.Name, params, "bilbo"))
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(mock.LastCommit.Author, check.Equals, repository.GitUser{Name: "Doge Dog", Email: "doge@much.com"})
+	c.Assert(mock.LastCommit.Committer, check.Equals, repository.GitUser{Name: "bilbo", Email: "bilbo@gandalf.example.com"})
+}
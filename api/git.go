@@ -0,0 +1,258 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/audit"
+	"github.com/tsuru/gandalf/hook"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
+	"github.com/tsuru/tsuru/log"
+)
+
+// gitServices lists the git services that can be used through the smart HTTP
+// transport.
+var gitServices = map[string]bool{
+	"git-upload-pack":  true,
+	"git-receive-pack": true,
+}
+
+// pktLine formats the given string as a git pkt-line.
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// gitHTTPUser returns the name of the user performing a git request over
+// HTTP, and the personal access token used to authenticate it, if any.
+//
+// Users may authenticate with HTTP basic authentication, using a personal
+// access token as the password. Otherwise, gandalf trusts the reverse proxy
+// in front of it to authenticate users and to forward the authenticated user
+// name in the header defined by git:http:user-header. Basic credentials whose
+// password is not a personal access token are left to the reverse proxy,
+// which usually forwards them. Requests without credentials are anonymous,
+// and the returned name is empty.
+func gitHTTPUser(r *http.Request) (string, *user.Token, error) {
+	if _, password, ok := r.BasicAuth(); ok && strings.HasPrefix(password, user.TokenPrefix) {
+		t, err := user.AuthenticateToken(password)
+		if err != nil {
+			return "", nil, err
+		}
+		return t.UserName, t, nil
+	}
+	header, _ := config.GetString("git:http:user-header")
+	if header == "" {
+		return "", nil, nil
+	}
+	name := r.Header.Get(header)
+	if name == "" {
+		return "", nil, nil
+	}
+	u, err := getUserOr404(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Suspended {
+		return "", nil, fmt.Errorf("User %s is suspended", name)
+	}
+	return name, nil, nil
+}
+
+// gitAuthorize loads the repository requested in the URL and checks whether
+// the user performing the request is allowed to use the given service in it.
+// It writes the proper error to the client and returns false when the request
+// should not go on.
+func gitAuthorize(w http.ResponseWriter, r *http.Request, service string) (*repository.Repository, string, bool) {
+	repo, err := repository.Get(r.URL.Query().Get(":name"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return nil, "", false
+	}
+	userName, token, err := gitHTTPUser(r)
+	if err == user.ErrInvalidToken {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gandalf"`)
+		http.Error(w, "Invalid token.", http.StatusUnauthorized)
+		return nil, "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, "", false
+	}
+	allowed := repo.HasReadPermission(userName)
+	errMsg := "You don't have access to read this repository."
+	if service == "git-receive-pack" {
+		allowed = userName != "" && repo.HasWritePermission(userName)
+		errMsg = "You don't have access to write in this repository."
+		if allowed && token != nil && !token.CanWrite() {
+			allowed = false
+			errMsg = "The token doesn't allow pushes, it has the read scope."
+		}
+	}
+	if !allowed {
+		if userName == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gandalf"`)
+			http.Error(w, "Authentication required.", http.StatusUnauthorized)
+			return nil, "", false
+		}
+		gitDeny(r, repo.Name, userName, service, errMsg)
+		http.Error(w, errMsg, http.StatusForbidden)
+		return nil, "", false
+	}
+	if err = repo.CheckSource(gitClientAddress(r)); err != nil {
+		log.Errorf("git: access of %q denied: %s", userName, err)
+		gitDeny(r, repo.Name, userName, service, err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, "", false
+	}
+	return &repo, userName, true
+}
+
+// gitDeny records the denial of a git request in the audit trail, with the
+// given reason, like the denials of git over SSH. Anonymous requests that are
+// asked to authenticate are not denials, and are not recorded.
+func gitDeny(r *http.Request, repoName, userName, service, reason string) {
+	addr := gitClientAddress(r)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	session := repository.Session{User: userName, Repository: repoName, Action: service, ClientAddress: addr}
+	if err := audit.Start(session).Deny(reason); err != nil {
+		log.Errorf("git: could not record the denial of %q in the audit trail: %s", userName, err)
+	}
+}
+
+// gitClientAddress returns the address of the git client, which is checked
+// against the allowed sources of the repository. Behind a reverse proxy, the
+// address of the connection is the proxy's, so gandalf takes the client address
+// from the header defined by git:http:client-address-header, which must be set
+// by the proxy. When the header holds a list, like X-Forwarded-For, the last
+// address is used, as it's the one added by the proxy. Requests without the
+// header use the address of the connection.
+func gitClientAddress(r *http.Request) string {
+	header, _ := config.GetString("git:http:client-address-header")
+	if header == "" {
+		return r.RemoteAddr
+	}
+	value := r.Header.Get(header)
+	if i := strings.LastIndex(value, ","); i >= 0 {
+		value = value[i+1:]
+	}
+	if value = strings.TrimSpace(value); value == "" {
+		return r.RemoteAddr
+	}
+	return value
+}
+
+// gitServiceCommand returns the command that runs the git service in the
+// repository. git-receive-pack runs the gandalf hooks, which check the rules
+// of the repository.
+func gitServiceCommand(service string, repo *repository.Repository, userName string, args ...string) (*exec.Cmd, error) {
+	args = append([]string{strings.TrimPrefix(service, "git-"), "--stateless-rpc"}, args...)
+	args = append(args, repository.BarePath(repo.Name))
+	cmd := exec.Command("git", args...)
+	session := repository.Session{User: userName, Repository: repo.Name, Action: service}
+	cmd.Env = append(os.Environ(), session.Env()...)
+	if service == "git-receive-pack" {
+		hookEnv, err := hook.ReceivePackEnv()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, hookEnv...)
+	}
+	return cmd, nil
+}
+
+func gitInfoRefs(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	if !gitServices[service] {
+		http.Error(w, "Only the smart HTTP protocol is supported.", http.StatusForbidden)
+		return
+	}
+	repo, userName, ok := gitAuthorize(w, r, service)
+	if !ok {
+		return
+	}
+	cmd, err := gitServiceCommand(service, repo, userName, "--advertise-refs")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		log.Errorf("git %s --advertise-refs failed for %q: %s. %s", service, repo.Name, err, stderr)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, pktLine("# service="+service+"\n"))
+	fmt.Fprint(w, "0000")
+	w.Write(out)
+}
+
+func gitUploadPack(w http.ResponseWriter, r *http.Request) {
+	gitServiceRPC(w, r, "git-upload-pack")
+}
+
+func gitReceivePack(w http.ResponseWriter, r *http.Request) {
+	gitServiceRPC(w, r, "git-receive-pack")
+}
+
+func gitServiceRPC(w http.ResponseWriter, r *http.Request, service string) {
+	defer r.Body.Close()
+	if r.Header.Get("Content-Type") != fmt.Sprintf("application/x-%s-request", service) {
+		http.Error(w, "Invalid content type.", http.StatusBadRequest)
+		return
+	}
+	repo, userName, ok := gitAuthorize(w, r, service)
+	if !ok {
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipBody, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gzipBody.Close()
+		body = gzipBody
+	}
+	cmd, err := gitServiceCommand(service, repo, userName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stdin = body
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := cmd.Start(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := cmd.Wait(); err != nil {
+		log.Errorf("git %s failed for %q: %s. %s", service, repo.Name, err, stderr)
+	}
+}
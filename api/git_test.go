@@ -0,0 +1,396 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/commandmocker"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/audit"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestPktLine(c *check.C) {
+	c.Assert(pktLine("# service=git-upload-pack\n"), check.Equals, "001e# service=git-upload-pack\n")
+	c.Assert(pktLine(""), check.Equals, "0004")
+}
+
+func (s *S) TestGitInfoRefsDumbProtocol(c *check.C) {
+	recorder, request := get("/myrepo.git/info/refs", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestGitInfoRefsUnknownService(c *check.C) {
+	recorder, request := get("/myrepo.git/info/refs?service=git-archive", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestGitInfoRefsRepositoryNotFound(c *check.C) {
+	recorder, request := get("/ghost.git/info/refs?service=git-upload-pack", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestGitInfoRefsPublicRepository(c *check.C) {
+	r := repository.Repository{Name: "publicrepo", Users: []string{"bilbo"}, IsPublic: true}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/publicrepo.git/info/refs?service=git-upload-pack", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/x-git-upload-pack-advertisement")
+	c.Assert(recorder.Body.String(), check.Equals, "001e# service=git-upload-pack\n0000")
+}
+
+func (s *S) TestGitInfoRefsWithNamespace(c *check.C) {
+	r := repository.Repository{Name: "team/publicrepo", Users: []string{"bilbo"}, IsPublic: true}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/team/publicrepo.git/info/refs?service=git-upload-pack", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/x-git-upload-pack-advertisement")
+}
+
+func (s *S) TestGitInfoRefsPrivateRepositoryAnonymous(c *check.C) {
+	r := repository.Repository{Name: "privaterepo", Users: []string{"bilbo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/privaterepo.git/info/refs?service=git-upload-pack", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+	c.Assert(recorder.Header().Get("WWW-Authenticate"), check.Equals, `Basic realm="gandalf"`)
+}
+
+func (s *S) TestGitInfoRefsPublicRepositoryAnonymousPush(c *check.C) {
+	r := repository.Repository{Name: "publicrepo", Users: []string{"bilbo"}, IsPublic: true}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/publicrepo.git/info/refs?service=git-receive-pack", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *S) TestGitInfoRefsUserFromHeader(c *check.C) {
+	config.Set("git:http:user-header", "X-Remote-User")
+	defer config.Unset("git:http:user-header")
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	r := repository.Repository{Name: "privaterepo", Users: []string{"bilbo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/privaterepo.git/info/refs?service=git-receive-pack", nil, c)
+	request.Header.Set("X-Remote-User", "bilbo")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/x-git-receive-pack-advertisement")
+	c.Assert(commandmocker.Envs(s.tmpdir), check.Matches, `(?s).*TSURU_USER=bilbo.*`)
+	c.Assert(commandmocker.Envs(s.tmpdir), check.Matches, `(?s).*GANDALF_REPOSITORY=privaterepo.*`)
+	c.Assert(commandmocker.Envs(s.tmpdir), check.Matches, `(?s).*GANDALF_ACTION=git-receive-pack.*`)
+	c.Assert(commandmocker.Envs(s.tmpdir), check.Matches, `(?s).*GIT_CONFIG_KEY_0=core.hooksPath.*`)
+}
+
+func (s *S) TestGitInfoRefsUserWithoutPermission(c *check.C) {
+	config.Set("git:http:user-header", "X-Remote-User")
+	defer config.Unset("git:http:user-header")
+	_, err := user.New("frodo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("frodo")
+	r := repository.Repository{Name: "privaterepo", Users: []string{"bilbo"}, ReadOnlyUsers: []string{"frodo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/privaterepo.git/info/refs?service=git-receive-pack", nil, c)
+	request.Header.Set("X-Remote-User", "frodo")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "You don't have access to write in this repository.\n")
+}
+
+func (s *S) TestGitInfoRefsSuspendedUser(c *check.C) {
+	config.Set("git:http:user-header", "X-Remote-User")
+	defer config.Unset("git:http:user-header")
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	err = user.Suspend("bilbo")
+	c.Assert(err, check.IsNil)
+	r := repository.Repository{Name: "publicrepo", Users: []string{"bilbo"}, IsPublic: true}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/publicrepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.Header.Set("X-Remote-User", "bilbo")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "User bilbo is suspended\n")
+}
+
+func (s *S) TestGitInfoRefsUserFromToken(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	_, token, err := user.NewToken("bilbo", "laptop", user.TokenScopeWrite, time.Time{})
+	c.Assert(err, check.IsNil)
+	r := repository.Repository{Name: "privaterepo", Users: []string{"bilbo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/privaterepo.git/info/refs?service=git-receive-pack", nil, c)
+	request.SetBasicAuth("bilbo", token)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(commandmocker.Envs(s.tmpdir), check.Matches, `(?s).*TSURU_USER=bilbo.*`)
+}
+
+func (s *S) TestGitInfoRefsReadOnlyTokenPush(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	_, token, err := user.NewToken("bilbo", "laptop", user.TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	r := repository.Repository{Name: "privaterepo", Users: []string{"bilbo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/privaterepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.SetBasicAuth("bilbo", token)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	recorder, request = get("/privaterepo.git/info/refs?service=git-receive-pack", nil, c)
+	request.SetBasicAuth("bilbo", token)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "The token doesn't allow pushes, it has the read scope.\n")
+}
+
+func (s *S) TestGitInfoRefsInvalidToken(c *check.C) {
+	r := repository.Repository{Name: "publicrepo", IsPublic: true}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/publicrepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.SetBasicAuth("bilbo", "gandalf_0123")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+	c.Assert(recorder.Header().Get("WWW-Authenticate"), check.Equals, `Basic realm="gandalf"`)
+	c.Assert(recorder.Body.String(), check.Equals, "Invalid token.\n")
+}
+
+func (s *S) TestGitInfoRefsBasicAuthWithoutToken(c *check.C) {
+	config.Set("git:http:user-header", "X-Remote-User")
+	defer config.Unset("git:http:user-header")
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	r := repository.Repository{Name: "privaterepo", Users: []string{"bilbo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/privaterepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.SetBasicAuth("bilbo", "my-ldap-password")
+	request.Header.Set("X-Remote-User", "bilbo")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(commandmocker.Envs(s.tmpdir), check.Matches, `(?s).*TSURU_USER=bilbo.*`)
+}
+
+func (s *S) TestGitInfoRefsInternalRepository(c *check.C) {
+	_, err := user.New("frodo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("frodo")
+	_, token, err := user.NewToken("frodo", "laptop", user.TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	r := repository.Repository{Name: "internalrepo", Users: []string{"bilbo"}, Visibility: repository.VisibilityInternal}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/internalrepo.git/info/refs?service=git-upload-pack", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+	recorder, request = get("/internalrepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.SetBasicAuth("frodo", token)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestGitInfoRefsSourceNotAllowed(c *check.C) {
+	r := repository.Repository{Name: "publicrepo", IsPublic: true, AllowedSources: []string{"10.0.0.0/8"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/publicrepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.RemoteAddr = "192.168.1.11:5312"
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "Access to repository publicrepo is not allowed from 192.168.1.11 (repository allowlist).\n")
+	recorder, request = get("/publicrepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.RemoteAddr = "10.0.0.1:5312"
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestGitInfoRefsDenialsAreAudited(c *check.C) {
+	config.Set("git:http:user-header", "X-Remote-User")
+	defer config.Unset("git:http:user-header")
+	_, err := user.New("frodo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("frodo")
+	r := repository.Repository{Name: "auditedrepo", Users: []string{"bilbo"}, ReadOnlyUsers: []string{"frodo"}, AllowedSources: []string{"10.0.0.0/8"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	defer conn.Audit().RemoveAll(bson.M{"repository": r.Name})
+	recorder, request := get("/auditedrepo.git/info/refs?service=git-receive-pack", nil, c)
+	request.RemoteAddr = "10.0.0.1:5312"
+	request.Header.Set("X-Remote-User", "frodo")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	recorder, request = get("/auditedrepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.RemoteAddr = "192.168.1.11:5312"
+	request.Header.Set("X-Remote-User", "frodo")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	ops, err := audit.List(audit.Filter{Repository: r.Name})
+	c.Assert(err, check.IsNil)
+	c.Assert(ops, check.HasLen, 2)
+	c.Assert(ops[0].User, check.Equals, "frodo")
+	c.Assert(ops[0].Action, check.Equals, "git-upload-pack")
+	c.Assert(ops[0].ClientAddress, check.Equals, "192.168.1.11")
+	c.Assert(ops[0].Denied, check.Equals, "Access to repository auditedrepo is not allowed from 192.168.1.11 (repository allowlist).")
+	c.Assert(ops[1].Action, check.Equals, "git-receive-pack")
+	c.Assert(ops[1].Denied, check.Equals, "You don't have access to write in this repository.")
+	c.Assert(ops[1].ExitStatus, check.Equals, 1)
+}
+
+func (s *S) TestGitInfoRefsSourceFromHeader(c *check.C) {
+	config.Set("git:http:client-address-header", "X-Forwarded-For")
+	defer config.Unset("git:http:client-address-header")
+	r := repository.Repository{Name: "publicrepo", IsPublic: true, AllowedSources: []string{"10.0.0.0/8"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := get("/publicrepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.RemoteAddr = "10.0.0.1:5312"
+	request.Header.Set("X-Forwarded-For", "10.0.0.2, 192.168.1.11")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(recorder.Body.String(), check.Equals, "Access to repository publicrepo is not allowed from 192.168.1.11 (repository allowlist).\n")
+	recorder, request = get("/publicrepo.git/info/refs?service=git-upload-pack", nil, c)
+	request.RemoteAddr = "192.168.1.11:5312"
+	request.Header.Set("X-Forwarded-For", "10.0.0.2")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestGitClientAddress(c *check.C) {
+	request, err := http.NewRequest("GET", "/publicrepo.git/info/refs", nil)
+	c.Assert(err, check.IsNil)
+	request.RemoteAddr = "10.0.0.1:5312"
+	request.Header.Set("X-Real-IP", "192.168.1.11")
+	c.Assert(gitClientAddress(request), check.Equals, "10.0.0.1:5312")
+	config.Set("git:http:client-address-header", "X-Real-IP")
+	defer config.Unset("git:http:client-address-header")
+	c.Assert(gitClientAddress(request), check.Equals, "192.168.1.11")
+	request.Header.Set("X-Real-IP", "172.16.0.1, 192.168.1.12")
+	c.Assert(gitClientAddress(request), check.Equals, "192.168.1.12")
+	request.Header.Del("X-Real-IP")
+	c.Assert(gitClientAddress(request), check.Equals, "10.0.0.1:5312")
+}
+
+func (s *S) TestGitUploadPack(c *check.C) {
+	r := repository.Repository{Name: "publicrepo", Users: []string{"bilbo"}, IsPublic: true}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := post("/publicrepo.git/git-upload-pack", strings.NewReader("0000"), c)
+	request.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/x-git-upload-pack-result")
+}
+
+func (s *S) TestGitUploadPackInvalidContentType(c *check.C) {
+	recorder, request := post("/publicrepo.git/git-upload-pack", strings.NewReader("0000"), c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestGitReceivePackAnonymous(c *check.C) {
+	r := repository.Repository{Name: "publicrepo", Users: []string{"bilbo"}, IsPublic: true}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	recorder, request := post("/publicrepo.git/git-receive-pack", strings.NewReader("0000"), c)
+	request.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+}
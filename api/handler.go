@@ -5,6 +5,7 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,10 +16,14 @@ import (
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/pat"
 	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/audit"
 	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/group"
 	"github.com/tsuru/gandalf/hook"
 	"github.com/tsuru/gandalf/multipartzip"
 	"github.com/tsuru/gandalf/repository"
@@ -39,29 +44,64 @@ func maxMemoryValue() uint {
 	return maxMemory
 }
 
-func accessParameters(body io.ReadCloser) (repositories, users []string, err error) {
+func accessParameters(body io.ReadCloser) (repositories, users, groups []string, err error) {
 	var params map[string][]string
 	if err := parseBody(body, &params); err != nil {
-		return []string{}, []string{}, err
+		return []string{}, []string{}, []string{}, err
 	}
-	users, ok := params["users"]
-	if !ok {
-		return []string{}, []string{}, errors.New("It is need a user list")
+	users, hasUsers := params["users"]
+	groups, hasGroups := params["groups"]
+	if !hasUsers && !hasGroups {
+		return []string{}, []string{}, []string{}, errors.New("It is need a user or group list")
 	}
-	repositories, ok = params["repositories"]
+	repositories, ok := params["repositories"]
 	if !ok {
-		return []string{}, []string{}, errors.New("It is need a repository list")
+		return []string{}, []string{}, []string{}, errors.New("It is need a repository list")
 	}
-	return repositories, users, nil
+	return repositories, users, groups, nil
 }
 
 func SetupRouter() *pat.Router {
 	router := pat.New()
+	router.Get("/{name:[^/]*/?[^/]+}.git/info/refs", http.HandlerFunc(gitInfoRefs))
+	router.Post("/{name:[^/]*/?[^/]+}.git/git-upload-pack", http.HandlerFunc(gitUploadPack))
+	router.Post("/{name:[^/]*/?[^/]+}.git/git-receive-pack", http.HandlerFunc(gitReceivePack))
 	router.Post("/user/{name}/key", http.HandlerFunc(addKey))
 	router.Delete("/user/{name}/key/{keyname}", http.HandlerFunc(removeKey))
 	router.Put("/user/{name}/key/{keyname}", http.HandlerFunc(updateKey))
 	router.Get("/user/{name}/keys", http.HandlerFunc(listKeys))
+	router.Get("/user/{name}/repositories", http.HandlerFunc(listUserRepositories))
+	router.Get("/user/{name}/audit", http.HandlerFunc(getUserAudit))
+	router.Get("/keys/unused", http.HandlerFunc(listUnusedKeys))
+	router.Get("/keys/policy-violations", http.HandlerFunc(listKeyPolicyViolations))
+	router.Post("/keys/sync", http.HandlerFunc(syncKeys))
+	router.Get("/key/{fingerprint:.+}", http.HandlerFunc(getKey))
+	router.Post("/user/{name}/principal/{principal}", http.HandlerFunc(addPrincipal))
+	router.Delete("/user/{name}/principal/{principal}", http.HandlerFunc(removePrincipal))
+	router.Post("/user/{name}/tokens", http.HandlerFunc(newToken))
+	router.Get("/user/{name}/tokens", http.HandlerFunc(listTokens))
+	router.Delete("/user/{name}/tokens/{id}", http.HandlerFunc(revokeToken))
+	router.Post("/user/{name}/suspend", http.HandlerFunc(suspendUser))
+	router.Post("/user/{name}/unsuspend", http.HandlerFunc(unsuspendUser))
+	router.Post("/authority", http.HandlerFunc(addAuthority))
+	router.Get("/authority", http.HandlerFunc(listAuthorities))
+	router.Delete("/authority/{name}", http.HandlerFunc(removeAuthority))
 	router.Post("/user", http.HandlerFunc(newUser))
+	router.Post("/group/{name}/member/{user}", http.HandlerFunc(addGroupMember))
+	router.Delete("/group/{name}/member/{user}", http.HandlerFunc(removeGroupMember))
+	router.Get("/group/{name}", http.HandlerFunc(getGroup))
+	router.Delete("/group/{name}", http.HandlerFunc(removeGroup))
+	router.Post("/group", http.HandlerFunc(newGroup))
+	router.Get("/group", http.HandlerFunc(listGroups))
+	router.Post("/namespace/{name}/owner/{user}", http.HandlerFunc(addNamespaceOwner))
+	router.Delete("/namespace/{name}/owner/{user}", http.HandlerFunc(removeNamespaceOwner))
+	router.Post("/namespace/{name}/grant", http.HandlerFunc(grantNamespaceAccess))
+	router.Delete("/namespace/{name}/revoke", http.HandlerFunc(revokeNamespaceAccess))
+	router.Put("/namespace/{name}/allowed-sources", http.HandlerFunc(setNamespaceAllowedSources))
+	router.Get("/namespace/{name}", http.HandlerFunc(getNamespace))
+	router.Delete("/namespace/{name}", http.HandlerFunc(removeNamespace))
+	router.Post("/namespace", http.HandlerFunc(newNamespace))
+	router.Get("/namespace", http.HandlerFunc(listNamespaces))
 	router.Delete("/user/{name}", http.HandlerFunc(removeUser))
 	router.Delete("/repository/revoke", http.HandlerFunc(revokeAccess))
 	router.Get("/repository/{name:[^/]*/?[^/]+}/archive", http.HandlerFunc(getArchive))
@@ -72,41 +112,796 @@ func SetupRouter() *pat.Router {
 	router.Get("/repository/{name:[^/]*/?[^/]+}/diff/commits", http.HandlerFunc(getDiff))
 	router.Post("/repository/{name:[^/]*/?[^/]+}/commit", http.HandlerFunc(commit))
 	router.Get("/repository/{name:[^/]*/?[^/]+}/logs", http.HandlerFunc(getLogs))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/permissions/{user}", http.HandlerFunc(getPermission))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/rules", http.HandlerFunc(getRules))
+	router.Put("/repository/{name:[^/]*/?[^/]+}/rules", http.HandlerFunc(setRules))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/protected-branches", http.HandlerFunc(getProtectedBranches))
+	router.Put("/repository/{name:[^/]*/?[^/]+}/protected-branches", http.HandlerFunc(setProtectedBranches))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/allowed-sources", http.HandlerFunc(getAllowedSources))
+	router.Put("/repository/{name:[^/]*/?[^/]+}/allowed-sources", http.HandlerFunc(setAllowedSources))
+	router.Get("/repository/{name:[^/]*/?[^/]+}/audit", http.HandlerFunc(getRepositoryAudit))
 	router.Post("/repository/grant", http.HandlerFunc(grantAccess))
 	router.Post("/repository", http.HandlerFunc(newRepository))
 	router.Get("/repository/{name:[^/]*/?[^/]+}", http.HandlerFunc(getRepository))
 	router.Delete("/repository/{name:[^/]*/?[^/]+}", http.HandlerFunc(removeRepository))
 	router.Put("/repository/{name:[^/]*/?[^/]+}", http.HandlerFunc(updateRepository))
+	router.Get("/audit/changes", http.HandlerFunc(getChanges))
 	router.Get("/healthcheck", http.HandlerFunc(healthCheck))
 	router.Post("/hook/{name}", http.HandlerFunc(addHook))
 	return router
 }
 
-func grantAccess(w http.ResponseWriter, r *http.Request) {
-	repositories, users, err := accessParameters(r.Body)
+func grantAccess(w http.ResponseWriter, r *http.Request) {
+	repositories, users, groups, err := accessParameters(r.Body)
+	readOnly := r.URL.Query().Get("readonly") == "yes"
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseExpiration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !expiresAt.IsZero() && len(groups) > 0 {
+		http.Error(w, "Only the access of users may expire.", http.StatusBadRequest)
+		return
+	}
+	// groups are granted first, as the grant fails when any of them
+	// doesn't exist.
+	if len(groups) > 0 {
+		if err := repository.GrantGroupAccess(repositories, groups, readOnly); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	if len(users) > 0 {
+		if err := repository.GrantExpiringAccess(repositories, users, readOnly, expiresAt); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	access := "full"
+	if readOnly {
+		access = "read-only"
+	}
+	if !expiresAt.IsZero() {
+		access = "temporary " + access
+	}
+	var messages []string
+	if len(users) > 0 {
+		messages = append(messages, fmt.Sprintf("Successfully granted %s access to users \"%s\" into repository \"%s\"", access, users, repositories))
+	}
+	if len(groups) > 0 {
+		messages = append(messages, fmt.Sprintf("Successfully granted %s access to groups \"%s\" into repository \"%s\"", access, groups, repositories))
+	}
+	fmt.Fprint(w, strings.Join(messages, "\n"))
+}
+
+func revokeAccess(w http.ResponseWriter, r *http.Request) {
+	repositories, users, groups, err := accessParameters(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = revokeFullAccess(repository.RevokeAccess, repositories, users)
+	if err == nil {
+		err = revokeFullAccess(repository.RevokeGroupAccess, repositories, groups)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	var messages []string
+	if len(users) > 0 {
+		messages = append(messages, fmt.Sprintf("Successfully revoked access to users \"%s\" into repositories \"%s\"", users, repositories))
+	}
+	if len(groups) > 0 {
+		messages = append(messages, fmt.Sprintf("Successfully revoked access to groups \"%s\" into repositories \"%s\"", groups, repositories))
+	}
+	fmt.Fprint(w, strings.Join(messages, "\n"))
+}
+
+// revokeFullAccess revokes both read-only and full access of the given users
+// or groups, using revoke.
+func revokeFullAccess(revoke func(rNames, names []string, readOnly bool) error, repositories, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if err := revoke(repositories, names, true); err != nil {
+		return err
+	}
+	return revoke(repositories, names, false)
+}
+
+// parseExpiration parses the expiration time of keys and grants, given in RFC
+// 3339 format in the "expires" parameter. Keys and grants without it never
+// expire.
+func parseExpiration(r *http.Request) (time.Time, error) {
+	value := r.URL.Query().Get("expires")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid expiration time, it must be in RFC 3339 format.")
+	}
+	if !expiresAt.After(time.Now()) {
+		return time.Time{}, errors.New("The expiration time must be in the future.")
+	}
+	return expiresAt, nil
+}
+
+func addKey(w http.ResponseWriter, r *http.Request) {
+	keys := map[string]string{}
+	if err := parseBody(r.Body, &keys); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		http.Error(w, "A key is needed", http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseExpiration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	uName := r.URL.Query().Get(":name")
+	if err := user.AddExpiringKey(uName, keys, expiresAt); err != nil {
+		if _, ok := err.(*user.InvalidKeyError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err {
+		case user.ErrInvalidKey:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case user.ErrDuplicateKey:
+			http.Error(w, "Key already exists.", http.StatusConflict)
+		case user.ErrUserNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	fmt.Fprint(w, "Key(s) successfully created")
+}
+
+func updateKey(w http.ResponseWriter, r *http.Request) {
+	uName := r.URL.Query().Get(":name")
+	kName := r.URL.Query().Get(":keyname")
+	defer r.Body.Close()
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	expiresAt, err := parseExpiration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := user.Key{Name: kName, Body: string(content), ExpiresAt: expiresAt}
+	if err := user.UpdateKey(uName, key); err != nil {
+		if _, ok := err.(*user.InvalidKeyError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err {
+		case user.ErrInvalidKey:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case user.ErrUserNotFound, user.ErrKeyNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	fmt.Fprintf(w, "Key %q successfully updated!", kName)
+}
+
+func removeKey(w http.ResponseWriter, r *http.Request) {
+	uName := r.URL.Query().Get(":name")
+	kName := r.URL.Query().Get(":keyname")
+	if err := user.RemoveKey(uName, kName); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "Key \"%s\" successfully removed", kName)
+}
+
+func listKeys(w http.ResponseWriter, r *http.Request) {
+	uName := r.URL.Query().Get(":name")
+	keys, err := user.ListKeys(uName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var out []byte
+	if r.URL.Query().Get("detailed") == "true" {
+		out, err = json.Marshal(detailedKeys(keys))
+	} else {
+		out, err = json.Marshal(&keys)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+// detailedKeys returns the keys in a form that is marshaled with all their
+// fields, instead of the name→key map from user.KeyList.
+func detailedKeys(keys user.KeyList) []user.Key {
+	if keys == nil {
+		return []user.Key{}
+	}
+	return []user.Key(keys)
+}
+
+func listKeyPolicyViolations(w http.ResponseWriter, r *http.Request) {
+	violations, err := user.ListKeyPolicyViolations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(violations)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func syncKeys(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry-run") == "true"
+	report, err := user.SyncAuthorizedKeys(dryRun)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == user.ErrAuthorizedKeysDisabled {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	out, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func getKey(w http.ResponseWriter, r *http.Request) {
+	key, err := user.GetKeyByFingerprint(r.URL.Query().Get(":fingerprint"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == user.ErrKeyNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	out, err := json.Marshal(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func listUnusedKeys(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days < 1 {
+		http.Error(w, "The number of days must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+	keys, err := user.ListUnusedKeys(time.Duration(days) * 24 * time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(detailedKeys(keys))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func addPrincipal(w http.ResponseWriter, r *http.Request) {
+	uName := r.URL.Query().Get(":name")
+	principal := r.URL.Query().Get(":principal")
+	if err := user.AddPrincipal(uName, principal); err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case user.ErrInvalidPrincipal:
+			status = http.StatusBadRequest
+		case user.ErrDuplicatePrincipal:
+			status = http.StatusConflict
+		case user.ErrUserNotFound:
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "Principal %q successfully added to user %q", principal, uName)
+}
+
+func removePrincipal(w http.ResponseWriter, r *http.Request) {
+	uName := r.URL.Query().Get(":name")
+	principal := r.URL.Query().Get(":principal")
+	if err := user.RemovePrincipal(uName, principal); err != nil {
+		status := http.StatusInternalServerError
+		if err == user.ErrUserNotFound || err == user.ErrPrincipalNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "Principal %q successfully removed from user %q", principal, uName)
+}
+
+func suspensionErrorStatus(err error) int {
+	switch err {
+	case user.ErrUserNotFound:
+		return http.StatusNotFound
+	case user.ErrUserSuspended, user.ErrUserNotSuspended:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func suspendUser(w http.ResponseWriter, r *http.Request) {
+	uName := r.URL.Query().Get(":name")
+	if err := user.Suspend(uName); err != nil {
+		http.Error(w, err.Error(), suspensionErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "User %q successfully suspended\n", uName)
+}
+
+func unsuspendUser(w http.ResponseWriter, r *http.Request) {
+	uName := r.URL.Query().Get(":name")
+	if err := user.Unsuspend(uName); err != nil {
+		http.Error(w, err.Error(), suspensionErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "User %q successfully unsuspended\n", uName)
+}
+
+func tokenErrorStatus(err error) int {
+	if _, ok := err.(*user.InvalidTokenError); ok {
+		return http.StatusBadRequest
+	}
+	switch err {
+	case user.ErrUserNotFound, user.ErrTokenNotFound:
+		return http.StatusNotFound
+	case user.ErrDuplicateToken:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func newToken(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Name  string
+		Scope string
+	}
+	if err := parseBody(r.Body, &params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := parseExpiration(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	uName := r.URL.Query().Get(":name")
+	t, plain, err := user.NewToken(uName, params.Name, user.TokenScope(params.Scope), expiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	out, err := json.Marshal(struct {
+		*user.Token
+		Secret string `json:"token"`
+	}{t, plain})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func listTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := user.ListTokens(r.URL.Query().Get(":name"))
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	out, err := json.Marshal(tokens)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request) {
+	uName := r.URL.Query().Get(":name")
+	if err := user.RevokeToken(uName, r.URL.Query().Get(":id")); err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Token successfully revoked from user %q\n", uName)
+}
+
+func addAuthority(w http.ResponseWriter, r *http.Request) {
+	authorities := map[string]string{}
+	if err := parseBody(r.Body, &authorities); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(authorities) == 0 {
+		http.Error(w, "An authority is needed", http.StatusBadRequest)
+		return
+	}
+	for name, body := range authorities {
+		if err := user.AddAuthority(name, body); err != nil {
+			status := http.StatusInternalServerError
+			switch err {
+			case user.ErrInvalidKey:
+				status = http.StatusBadRequest
+			case user.ErrDuplicateAuthority:
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	fmt.Fprint(w, "Authority(ies) successfully created")
+}
+
+func listAuthorities(w http.ResponseWriter, r *http.Request) {
+	authorities, err := user.ListAuthorities()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(authorities)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func removeAuthority(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	if err := user.RemoveAuthority(name); err != nil {
+		status := http.StatusInternalServerError
+		if err == user.ErrAuthorityNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "Authority %q successfully removed", name)
+}
+
+type jsonUser struct {
+	Name string
+	Keys map[string]string
+}
+
+func newUser(w http.ResponseWriter, r *http.Request) {
+	var usr jsonUser
+	if err := parseBody(r.Body, &usr); err != nil {
+		http.Error(w, "Got error while parsing body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := user.New(usr.Name, usr.Keys)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == user.ErrUserAlreadyExists {
+			status = http.StatusConflict
+		}
+		if _, ok := err.(*user.InvalidUserError); ok {
+			status = http.StatusBadRequest
+		}
+		if _, ok := err.(*user.InvalidKeyError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "User \"%s\" successfully created\n", u.Name)
+}
+
+func removeUser(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	if err := user.Remove(name); err != nil {
+		status := http.StatusInternalServerError
+		if err == user.ErrUserNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "User \"%s\" successfully removed\n", name)
+}
+
+func newGroup(w http.ResponseWriter, r *http.Request) {
+	var g group.Group
+	if err := parseBody(r.Body, &g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := group.New(g.Name, g.Members); err != nil {
+		status := http.StatusInternalServerError
+		if err == group.ErrGroupAlreadyExists {
+			status = http.StatusConflict
+		}
+		if _, ok := err.(*group.InvalidGroupError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "Group \"%s\" successfully created\n", g.Name)
+}
+
+func getGroup(w http.ResponseWriter, r *http.Request) {
+	g, err := group.Get(r.URL.Query().Get(":name"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == group.ErrGroupNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	out, err := json.Marshal(&g)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func listGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := group.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(groups)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func removeGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	if err := group.Remove(name); err != nil {
+		status := http.StatusInternalServerError
+		if err == group.ErrGroupNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "Group \"%s\" successfully removed\n", name)
+}
+
+func addGroupMember(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	uName := r.URL.Query().Get(":user")
+	if err := group.AddMembers(name, []string{uName}); err != nil {
+		status := http.StatusInternalServerError
+		if err == group.ErrGroupNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "User \"%s\" successfully added to group \"%s\"\n", uName, name)
+}
+
+func removeGroupMember(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	uName := r.URL.Query().Get(":user")
+	if err := group.RemoveMembers(name, []string{uName}); err != nil {
+		status := http.StatusInternalServerError
+		if err == group.ErrGroupNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "User \"%s\" successfully removed from group \"%s\"\n", uName, name)
+}
+
+// namespaceErrorStatus returns the HTTP status for errors returned by the
+// namespace functions of the repository package.
+func namespaceErrorStatus(err error) int {
+	switch err {
+	case repository.ErrNamespaceNotFound, group.ErrGroupNotFound:
+		return http.StatusNotFound
+	case repository.ErrNamespaceAlreadyExists, repository.ErrNamespaceNotEmpty:
+		return http.StatusConflict
+	}
+	switch err.(type) {
+	case *repository.InvalidNamespaceError, *repository.InvalidSourceError:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func newNamespace(w http.ResponseWriter, r *http.Request) {
+	var n repository.Namespace
+	if err := parseBody(r.Body, &n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := repository.NewNamespace(n.Name, n.Owners); err != nil {
+		http.Error(w, err.Error(), namespaceErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Namespace \"%s\" successfully created\n", n.Name)
+}
+
+func getNamespace(w http.ResponseWriter, r *http.Request) {
+	n, err := repository.GetNamespace(r.URL.Query().Get(":name"))
+	if err != nil {
+		http.Error(w, err.Error(), namespaceErrorStatus(err))
+		return
+	}
+	out, err := json.Marshal(&n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func setNamespaceAllowedSources(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	var sources []string
+	if err := parseBody(r.Body, &sources); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := repository.SetNamespaceAllowedSources(name, sources); err != nil {
+		http.Error(w, err.Error(), namespaceErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Allowed sources of namespace \"%s\" successfully updated\n", name)
+}
+
+func listNamespaces(w http.ResponseWriter, r *http.Request) {
+	namespaces, err := repository.ListNamespaces()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(namespaces)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func removeNamespace(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	if err := repository.RemoveNamespace(name); err != nil {
+		http.Error(w, err.Error(), namespaceErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Namespace \"%s\" successfully removed\n", name)
+}
+
+func addNamespaceOwner(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	uName := r.URL.Query().Get(":user")
+	if err := repository.AddNamespaceOwners(name, []string{uName}); err != nil {
+		http.Error(w, err.Error(), namespaceErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "User \"%s\" successfully added as owner of namespace \"%s\"\n", uName, name)
+}
+
+func removeNamespaceOwner(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	uName := r.URL.Query().Get(":user")
+	if err := repository.RemoveNamespaceOwners(name, []string{uName}); err != nil {
+		http.Error(w, err.Error(), namespaceErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "User \"%s\" successfully removed from owners of namespace \"%s\"\n", uName, name)
+}
+
+// namespaceAccessParameters parses the users and groups of a namespace grant
+// or revoke request.
+func namespaceAccessParameters(body io.ReadCloser) (users, groups []string, err error) {
+	var params map[string][]string
+	if err := parseBody(body, &params); err != nil {
+		return nil, nil, err
+	}
+	users, hasUsers := params["users"]
+	groups, hasGroups := params["groups"]
+	if !hasUsers && !hasGroups {
+		return nil, nil, errors.New("It is need a user or group list")
+	}
+	return users, groups, nil
+}
+
+func grantNamespaceAccess(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
 	readOnly := r.URL.Query().Get("readonly") == "yes"
+	users, groups, err := namespaceAccessParameters(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := repository.GrantAccess(repositories, users, readOnly); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if err := repository.GrantNamespaceAccess(name, users, groups, readOnly); err != nil {
+		http.Error(w, err.Error(), namespaceErrorStatus(err))
 		return
 	}
+	access := "full"
 	if readOnly {
-		fmt.Fprintf(w, "Successfully granted read-only access to users \"%s\" into repository \"%s\"", users, repositories)
-	} else {
-		fmt.Fprintf(w, "Successfully granted full access to users \"%s\" into repository \"%s\"", users, repositories)
+		access = "read-only"
 	}
+	fmt.Fprintf(w, "Successfully granted %s access to users \"%s\" and groups \"%s\" into namespace \"%s\"", access, users, groups, name)
 }
 
-func revokeAccess(w http.ResponseWriter, r *http.Request) {
-	repositories, users, err := accessParameters(r.Body)
+func revokeNamespaceAccess(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	users, groups, err := namespaceAccessParameters(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := repository.RevokeAccess(repositories, users, true); err != nil {
+	if err := repository.RevokeNamespaceAccess(name, users, groups); err != nil {
+		http.Error(w, err.Error(), namespaceErrorStatus(err))
+		return
+	}
+	fmt.Fprintf(w, "Successfully revoked access to users \"%s\" and groups \"%s\" into namespace \"%s\"", users, groups, name)
+}
+
+func newRepository(w http.ResponseWriter, r *http.Request) {
+	var repo repository.Repository
+	if err := parseBody(r.Body, &repo); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err := repository.NewWithVisibility(repo.Name, repo.Users, repo.ReadOnlyUsers, repo.VisibilityLevel())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryAlreadyExists {
+			status = http.StatusConflict
+		}
+		if _, ok := err.(*repository.InvalidRepositoryError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "Repository \"%s\" successfully created\n", repo.Name)
+}
+
+func getRepository(w http.ResponseWriter, r *http.Request) {
+	repo, err := repository.Get(r.URL.Query().Get(":name"))
+	if err != nil {
 		status := http.StatusInternalServerError
 		if err == repository.ErrRepositoryNotFound {
 			status = http.StatusNotFound
@@ -114,82 +909,71 @@ func revokeAccess(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), status)
 		return
 	}
-	if err := repository.RevokeAccess(repositories, users, false); err != nil {
+	out, err := json.Marshal(&repo)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "Successfully revoked access to users \"%s\" into repositories \"%s\"", users, repositories)
+	w.Write(out)
 }
 
-func addKey(w http.ResponseWriter, r *http.Request) {
-	keys := map[string]string{}
-	if err := parseBody(r.Body, &keys); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func getPermission(w http.ResponseWriter, r *http.Request) {
+	repo, err := repository.Get(r.URL.Query().Get(":name"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
-	if len(keys) == 0 {
-		http.Error(w, "A key is needed", http.StatusBadRequest)
+	uName := r.URL.Query().Get(":user")
+	if _, err = getUserOr404(uName); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	uName := r.URL.Query().Get(":name")
-	if err := user.AddKey(uName, keys); err != nil {
-		switch err {
-		case user.ErrInvalidKey:
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		case user.ErrDuplicateKey:
-			http.Error(w, "Key already exists.", http.StatusConflict)
-		case user.ErrUserNotFound:
-			http.Error(w, err.Error(), http.StatusNotFound)
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	out, err := json.Marshal(repo.Permission(uName))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprint(w, "Key(s) successfully created")
+	w.Write(out)
 }
 
-func updateKey(w http.ResponseWriter, r *http.Request) {
+func listUserRepositories(w http.ResponseWriter, r *http.Request) {
 	uName := r.URL.Query().Get(":name")
-	kName := r.URL.Query().Get(":keyname")
-	defer r.Body.Close()
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, err := getUserOr404(uName); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	key := user.Key{Name: kName, Body: string(content)}
-	if err := user.UpdateKey(uName, key); err != nil {
-		switch err {
-		case user.ErrInvalidKey:
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		case user.ErrUserNotFound, user.ErrKeyNotFound:
-			http.Error(w, err.Error(), http.StatusNotFound)
-		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	permissions, err := repository.ListPermissions(uName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "Key %q successfully updated!", kName)
-}
-
-func removeKey(w http.ResponseWriter, r *http.Request) {
-	uName := r.URL.Query().Get(":name")
-	kName := r.URL.Query().Get(":keyname")
-	if err := user.RemoveKey(uName, kName); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	out, err := json.Marshal(permissions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "Key \"%s\" successfully removed", kName)
+	w.Write(out)
 }
 
-func listKeys(w http.ResponseWriter, r *http.Request) {
-	uName := r.URL.Query().Get(":name")
-	keys, err := user.ListKeys(uName)
+func getRules(w http.ResponseWriter, r *http.Request) {
+	repo, err := repository.Get(r.URL.Query().Get(":name"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
-	out, err := json.Marshal(&keys)
+	rules := repo.Rules
+	if rules == nil {
+		rules = []repository.RefRule{}
+	}
+	out, err := json.Marshal(rules)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -197,67 +981,162 @@ func listKeys(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
-type jsonUser struct {
-	Name string
-	Keys map[string]string
-}
-
-func newUser(w http.ResponseWriter, r *http.Request) {
-	var usr jsonUser
-	if err := parseBody(r.Body, &usr); err != nil {
-		http.Error(w, "Got error while parsing body: "+err.Error(), http.StatusBadRequest)
+func setRules(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	var rules []repository.RefRule
+	if err := parseBody(r.Body, &rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	u, err := user.New(usr.Name, usr.Keys)
-	if err != nil {
+	if err := repository.SetRules(name, rules); err != nil {
 		status := http.StatusInternalServerError
-		if err == user.ErrUserAlreadyExists {
-			status = http.StatusConflict
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
 		}
-		if _, ok := err.(*user.InvalidUserError); ok {
+		if _, ok := err.(*repository.InvalidRefRuleError); ok {
 			status = http.StatusBadRequest
 		}
 		http.Error(w, err.Error(), status)
 		return
 	}
-	fmt.Fprintf(w, "User \"%s\" successfully created\n", u.Name)
+	fmt.Fprintf(w, "Rules of repository \"%s\" successfully updated\n", name)
 }
 
-func removeUser(w http.ResponseWriter, r *http.Request) {
-	name := r.URL.Query().Get(":name")
-	if err := user.Remove(name); err != nil {
+func getAllowedSources(w http.ResponseWriter, r *http.Request) {
+	repo, err := repository.Get(r.URL.Query().Get(":name"))
+	if err != nil {
 		status := http.StatusInternalServerError
-		if err == user.ErrUserNotFound {
+		if err == repository.ErrRepositoryNotFound {
 			status = http.StatusNotFound
 		}
 		http.Error(w, err.Error(), status)
 		return
 	}
-	fmt.Fprintf(w, "User \"%s\" successfully removed\n", name)
+	sources := repo.AllowedSources
+	if sources == nil {
+		sources = []string{}
+	}
+	out, err := json.Marshal(sources)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
 }
 
-func newRepository(w http.ResponseWriter, r *http.Request) {
-	var repo repository.Repository
-	if err := parseBody(r.Body, &repo); err != nil {
+func setAllowedSources(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	var sources []string
+	if err := parseBody(r.Body, &sources); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err := repository.New(repo.Name, repo.Users, repo.ReadOnlyUsers, repo.IsPublic)
-	if err != nil {
+	if err := repository.SetAllowedSources(name, sources); err != nil {
 		status := http.StatusInternalServerError
-		if err == repository.ErrRepositoryAlreadyExists {
-			status = http.StatusConflict
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
 		}
-		if _, ok := err.(*repository.InvalidRepositoryError); ok {
+		if _, ok := err.(*repository.InvalidSourceError); ok {
 			status = http.StatusBadRequest
 		}
 		http.Error(w, err.Error(), status)
 		return
 	}
-	fmt.Fprintf(w, "Repository \"%s\" successfully created\n", repo.Name)
+	fmt.Fprintf(w, "Allowed sources of repository \"%s\" successfully updated\n", name)
 }
 
-func getRepository(w http.ResponseWriter, r *http.Request) {
+// auditFilter parses the filters of audit queries: the "since" and "until"
+// times, in RFC 3339 format, and the "limit" and "offset" of the page.
+func auditFilter(r *http.Request) (audit.Filter, error) {
+	var filter audit.Filter
+	var err error
+	query := r.URL.Query()
+	times := []struct {
+		param string
+		value *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}}
+	for _, t := range times {
+		if value := query.Get(t.param); value != "" {
+			if *t.value, err = time.Parse(time.RFC3339, value); err != nil {
+				return filter, fmt.Errorf("Invalid %s time, it must be in RFC 3339 format.", t.param)
+			}
+		}
+	}
+	numbers := []struct {
+		param string
+		value *int
+	}{{"limit", &filter.Limit}, {"offset", &filter.Offset}}
+	for _, n := range numbers {
+		if value := query.Get(n.param); value != "" {
+			if *n.value, err = strconv.Atoi(value); err != nil || *n.value < 0 {
+				return filter, fmt.Errorf("Invalid %s, it must be a non-negative integer.", n.param)
+			}
+		}
+	}
+	return filter, nil
+}
+
+func writeAudit(w http.ResponseWriter, filter audit.Filter) {
+	operations, err := audit.List(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(operations)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func getRepositoryAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Repository = r.URL.Query().Get(":name")
+	writeAudit(w, filter)
+}
+
+func getUserAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.User = r.URL.Query().Get(":name")
+	writeAudit(w, filter)
+}
+
+func getChanges(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes, err := audit.ListChanges(audit.ChangeFilter{
+		Actor:  r.URL.Query().Get("actor"),
+		Target: r.URL.Query().Get("target"),
+		Since:  filter.Since,
+		Until:  filter.Until,
+		Limit:  filter.Limit,
+		Offset: filter.Offset,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(out)
+}
+
+func getProtectedBranches(w http.ResponseWriter, r *http.Request) {
 	repo, err := repository.Get(r.URL.Query().Get(":name"))
 	if err != nil {
 		status := http.StatusInternalServerError
@@ -267,7 +1146,11 @@ func getRepository(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), status)
 		return
 	}
-	out, err := json.Marshal(&repo)
+	branches := repo.ProtectedBranches
+	if branches == nil {
+		branches = []repository.ProtectedBranch{}
+	}
+	out, err := json.Marshal(branches)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -275,6 +1158,27 @@ func getRepository(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
+func setProtectedBranches(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	var branches []repository.ProtectedBranch
+	if err := parseBody(r.Body, &branches); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := repository.SetProtectedBranches(name, branches); err != nil {
+		status := http.StatusInternalServerError
+		if err == repository.ErrRepositoryNotFound {
+			status = http.StatusNotFound
+		}
+		if _, ok := err.(*repository.InvalidProtectedBranchError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	fmt.Fprintf(w, "Protected branches of repository \"%s\" successfully updated\n", name)
+}
+
 func removeRepository(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get(":name")
 	if err := repository.Remove(name); err != nil {
@@ -296,14 +1200,30 @@ func updateRepository(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	err = parseBody(r.Body, &repo)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = parseBody(ioutil.NopCloser(bytes.NewReader(body)), &repo)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// Clients that only know about ispublic change the visibility with it.
+	var sent struct {
+		IsPublic   *bool
+		Visibility *string
+	}
+	json.Unmarshal(body, &sent)
+	if sent.IsPublic != nil && sent.Visibility == nil {
+		repo.Visibility = ""
+	}
 	err = repository.Update(name, repo)
-	if err != nil && err == repository.ErrRepositoryNotFound {
+	if err == repository.ErrRepositoryNotFound || err == group.ErrGroupNotFound {
 		http.Error(w, err.Error(), http.StatusNotFound)
+	} else if _, ok := err.(*repository.InvalidRepositoryError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -388,6 +1308,9 @@ func getMimeType(path string, content []byte) string {
 
 func getFileContents(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
+	if !authorizeRead(w, r, repo) {
+		return
+	}
 	path := r.URL.Query().Get("path")
 	ref := r.URL.Query().Get("ref")
 	if ref == "" {
@@ -410,6 +1333,9 @@ func getFileContents(w http.ResponseWriter, r *http.Request) {
 
 func getArchive(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
+	if !authorizeRead(w, r, repo) {
+		return
+	}
 	ref := r.URL.Query().Get("ref")
 	format := r.URL.Query().Get("format")
 	if ref == "" || format == "" {
@@ -446,6 +1372,9 @@ func getArchive(w http.ResponseWriter, r *http.Request) {
 
 func getTree(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
+	if !authorizeRead(w, r, repo) {
+		return
+	}
 	path := r.URL.Query().Get("path")
 	ref := r.URL.Query().Get("ref")
 	if ref == "" {
@@ -471,6 +1400,9 @@ func getTree(w http.ResponseWriter, r *http.Request) {
 
 func getBranches(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
+	if !authorizeRead(w, r, repo) {
+		return
+	}
 	branches, err := repository.GetBranches(repo)
 	if err != nil {
 		err = fmt.Errorf("Error when trying to obtain the branches of repository %s (%s).", repo, err)
@@ -488,6 +1420,9 @@ func getBranches(w http.ResponseWriter, r *http.Request) {
 
 func getTags(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
+	if !authorizeRead(w, r, repo) {
+		return
+	}
 	ref := r.URL.Query().Get("ref")
 	tags, err := repository.GetTags(repo)
 	if err != nil {
@@ -506,6 +1441,9 @@ func getTags(w http.ResponseWriter, r *http.Request) {
 
 func getDiff(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
+	if !authorizeRead(w, r, repo) {
+		return
+	}
 	previousCommit := r.URL.Query().Get("previous_commit")
 	lastCommit := r.URL.Query().Get("last_commit")
 	if previousCommit == "" || lastCommit == "" {
@@ -538,13 +1476,20 @@ func commit(w http.ResponseWriter, r *http.Request) {
 		"committer-name":  "",
 		"committer-email": "",
 	}
+	force := forceCommitter()
 	for key := range data {
+		if force && strings.HasPrefix(key, "committer-") {
+			continue
+		}
 		data[key], err = multipartzip.ValueField(form, key)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
+	if !authorizeCommit(w, r, repo, data["branch"]) {
+		return
+	}
 	commit := repository.GitCommit{
 		Branch:  data["branch"],
 		Message: data["message"],
@@ -557,6 +1502,9 @@ func commit(w http.ResponseWriter, r *http.Request) {
 			Email: data["committer-email"],
 		},
 	}
+	if force {
+		commit.Committer = actingCommitter(actingUser(r))
+	}
 	ref, err := repository.CommitZip(repo, r.MultipartForm.File["zipfile"][0], commit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -572,6 +1520,9 @@ func commit(w http.ResponseWriter, r *http.Request) {
 
 func getLogs(w http.ResponseWriter, r *http.Request) {
 	repo := r.URL.Query().Get(":name")
+	if !authorizeRead(w, r, repo) {
+		return
+	}
 	ref := r.URL.Query().Get("ref")
 	path := r.URL.Query().Get("path")
 	total, err := strconv.Atoi(r.URL.Query().Get("total"))
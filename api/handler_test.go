@@ -16,12 +16,15 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/audit"
 	"github.com/tsuru/gandalf/db"
 	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/gandalf/group"
 	"github.com/tsuru/gandalf/multipartzip"
 	"github.com/tsuru/gandalf/repository"
 	"github.com/tsuru/gandalf/user"
@@ -95,31 +98,40 @@ func (s *S) TestMaxMemoryValueDontResetMaxMemory(c *check.C) {
 
 func (s *S) TestAccessParametersShouldReturnErrorWhenInvalidJSONInput(c *check.C) {
 	b := bufferCloser{bytes.NewBufferString(``)}
-	_, _, err := accessParameters(b)
+	_, _, _, err := accessParameters(b)
 	c.Assert(err, check.ErrorMatches, `^Could not parse json: .+$`)
 	b = bufferCloser{bytes.NewBufferString(`{`)}
-	_, _, err = accessParameters(b)
+	_, _, _, err = accessParameters(b)
 	c.Assert(err, check.ErrorMatches, `^Could not parse json: .+$`)
 	b = bufferCloser{bytes.NewBufferString(`bang`)}
-	_, _, err = accessParameters(b)
+	_, _, _, err = accessParameters(b)
 	c.Assert(err, check.ErrorMatches, `^Could not parse json: .+$`)
 	b = bufferCloser{bytes.NewBufferString(` `)}
-	_, _, err = accessParameters(b)
+	_, _, _, err = accessParameters(b)
 	c.Assert(err, check.ErrorMatches, `^Could not parse json: .+$`)
 }
 
 func (s *S) TestAccessParametersShouldReturnErrorWhenNoUserListProvided(c *check.C) {
 	b := bufferCloser{bytes.NewBufferString(`{"users": "oneuser"}`)}
-	_, _, err := accessParameters(b)
+	_, _, _, err := accessParameters(b)
 	c.Assert(err, check.ErrorMatches, `^Could not parse json: json: cannot unmarshal string into Go value of type \[\]string$`)
 	b = bufferCloser{bytes.NewBufferString(`{"repositories": ["barad-dur"]}`)}
-	_, _, err = accessParameters(b)
-	c.Assert(err, check.ErrorMatches, `^It is need a user list$`)
+	_, _, _, err = accessParameters(b)
+	c.Assert(err, check.ErrorMatches, `^It is need a user or group list$`)
+}
+
+func (s *S) TestAccessParametersWithGroups(c *check.C) {
+	b := bufferCloser{bytes.NewBufferString(`{"repositories": ["barad-dur"], "groups": ["nazgul"]}`)}
+	repositories, users, groups, err := accessParameters(b)
+	c.Assert(err, check.IsNil)
+	c.Assert(repositories, check.DeepEquals, []string{"barad-dur"})
+	c.Assert(users, check.HasLen, 0)
+	c.Assert(groups, check.DeepEquals, []string{"nazgul"})
 }
 
 func (s *S) TestAccessParametersShouldReturnErrorWhenNoRepositoryListProvided(c *check.C) {
 	b := bufferCloser{bytes.NewBufferString(`{"users": ["nazgul"]}`)}
-	_, _, err := accessParameters(b)
+	_, _, _, err := accessParameters(b)
 	c.Assert(err, check.ErrorMatches, `^It is need a repository list$`)
 }
 
@@ -218,10 +230,11 @@ func (s *S) TestGetRepository(c *check.C) {
 	err = json.Unmarshal(body, &data)
 	c.Assert(err, check.IsNil)
 	expected := map[string]interface{}{
-		"name":    r.Name,
-		"public":  r.IsPublic,
-		"ssh_url": r.ReadWriteURL(),
-		"git_url": r.ReadOnlyURL(),
+		"name":       r.Name,
+		"public":     r.IsPublic,
+		"visibility": "private",
+		"ssh_url":    r.ReadWriteURL(),
+		"git_url":    r.ReadOnlyURL(),
 	}
 	c.Assert(data, check.DeepEquals, expected)
 }
@@ -242,10 +255,11 @@ func (s *S) TestGetRepositoryWithNamespace(c *check.C) {
 	err = json.Unmarshal(body, &data)
 	c.Assert(err, check.IsNil)
 	expected := map[string]interface{}{
-		"name":    r.Name,
-		"public":  r.IsPublic,
-		"ssh_url": r.ReadWriteURL(),
-		"git_url": r.ReadOnlyURL(),
+		"name":       r.Name,
+		"public":     r.IsPublic,
+		"visibility": "private",
+		"ssh_url":    r.ReadWriteURL(),
+		"git_url":    r.ReadOnlyURL(),
 	}
 	c.Assert(data, check.DeepEquals, expected)
 }
@@ -269,6 +283,21 @@ func (s *S) TestNewRepository(c *check.C) {
 	c.Assert(got, check.Equals, expected)
 }
 
+func (s *S) TestNewRepositoryWithVisibility(c *check.C) {
+	b := strings.NewReader(`{"name": "myRepository", "users": ["r2d2"], "visibility": "internal"}`)
+	recorder, request := post("/repository", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId("myRepository")
+	repo, err := repository.Get("myRepository")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.Visibility, check.Equals, repository.VisibilityInternal)
+	c.Assert(repo.IsPublic, check.Equals, false)
+}
+
 func (s *S) TestNewRepositoryShouldSaveInDB(c *check.C) {
 	b := strings.NewReader(`{"name": "myRepository", "users": ["r2d2"]}`)
 	recorder, request := post("/repository", b, c)
@@ -457,17 +486,702 @@ func (s *S) TestGrantAccessReadOnlyUpdatesReposDocument(c *check.C) {
 	var repos []repository.Repository
 	err = conn.Repository().Find(bson.M{"_id": bson.M{"$in": []string{r.Name, r2.Name}}}).All(&repos)
 	c.Assert(err, check.IsNil)
-	c.Assert(rec.Code, check.Equals, 200)
-	for _, repo := range repos {
-		c.Assert(repo.ReadOnlyUsers, check.DeepEquals, []string{u.Name})
-	}
+	c.Assert(rec.Code, check.Equals, 200)
+	for _, repo := range repos {
+		c.Assert(repo.ReadOnlyUsers, check.DeepEquals, []string{u.Name})
+	}
+}
+
+func (s *S) TestGrantAccessRepositoryNotFound(c *check.C) {
+	b := bytes.NewBufferString(`{"repositories":["super-repo"],"users":["someuser"]}`)
+	rec, req := post("/repository/grant?readonly=yes", b, c)
+	s.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestGrantAccessWithExpiration(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	r := repository.Repository{Name: "onerepo", Users: []string{"pippin"}}
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	b := bytes.NewBufferString(`{"repositories": ["onerepo"], "users": ["vendor"]}`)
+	rec, req := post("/repository/grant?expires="+expiresAt.Format(time.RFC3339), b, c)
+	s.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(rec.Body, c), check.Equals, `Successfully granted temporary full access to users "[vendor]" into repository "[onerepo]"`)
+	err = conn.Repository().FindId(r.Name).One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Users, check.DeepEquals, []string{"pippin", "vendor"})
+	c.Assert(r.Expirations, check.HasLen, 1)
+	c.Assert(r.Expirations[0].ExpiresAt.Equal(expiresAt), check.Equals, true)
+}
+
+func (s *S) TestGrantAccessWithExpirationInThePast(c *check.C) {
+	b := bytes.NewBufferString(`{"repositories": ["onerepo"], "users": ["vendor"]}`)
+	rec, req := post("/repository/grant?expires=2016-01-02T15:04:05Z", b, c)
+	s.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(readBody(rec.Body, c), check.Equals, "The expiration time must be in the future.\n")
+}
+
+func (s *S) TestGrantAccessToGroupsWithExpiration(c *check.C) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	b := bytes.NewBufferString(`{"repositories": ["onerepo"], "groups": ["hobbits"]}`)
+	rec, req := post("/repository/grant?expires="+expiresAt, b, c)
+	s.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(readBody(rec.Body, c), check.Equals, "Only the access of users may expire.\n")
+}
+
+func (s *S) TestGrantAccessToGroups(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	r := repository.Repository{Name: "onerepo", Users: []string{"pippin"}}
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	_, err = group.New("hobbits", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("hobbits")
+	b := bytes.NewBufferString(fmt.Sprintf(`{"repositories": ["%s"], "groups": ["hobbits"]}`, r.Name))
+	rec, req := post("/repository/grant?readonly=yes", b, c)
+	s.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(rec.Body, c), check.Equals, `Successfully granted read-only access to groups "[hobbits]" into repository "[onerepo]"`)
+	err = conn.Repository().FindId(r.Name).One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.ReadOnlyGroups, check.DeepEquals, []string{"hobbits"})
+	c.Assert(r.Users, check.DeepEquals, []string{"pippin"})
+}
+
+func (s *S) TestGrantAccessToGroupNotFound(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	r := repository.Repository{Name: "onerepo", Users: []string{"pippin"}}
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	b := bytes.NewBufferString(fmt.Sprintf(`{"repositories": ["%s"], "users": ["frodo"], "groups": ["orcs"]}`, r.Name))
+	rec, req := post("/repository/grant", b, c)
+	s.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusNotFound)
+	c.Assert(readBody(rec.Body, c), check.Equals, "group not found\n")
+	err = conn.Repository().FindId(r.Name).One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Users, check.DeepEquals, []string{"pippin"})
+}
+
+func (s *S) TestRevokeAccessFromGroups(c *check.C) {
+	r := repository.Repository{Name: "onerepo", Users: []string{"Umi"}, Groups: []string{"jedi", "sith"}, ReadOnlyGroups: []string{"jedi"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().Remove(bson.M{"_id": r.Name})
+	b := bytes.NewBufferString(fmt.Sprintf(`{"repositories": ["%s"], "groups": ["jedi"]}`, r.Name))
+	rec, req := del("/repository/revoke", b, c)
+	s.router.ServeHTTP(rec, req)
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+	err = conn.Repository().FindId(r.Name).One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Users, check.DeepEquals, []string{"Umi"})
+	c.Assert(r.Groups, check.DeepEquals, []string{"sith"})
+	c.Assert(r.ReadOnlyGroups, check.DeepEquals, []string{})
+}
+
+func (s *S) TestNewGroup(c *check.C) {
+	b := strings.NewReader(`{"name": "hobbits", "members": ["frodo", "sam"]}`)
+	recorder, request := post("/group", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "Group \"hobbits\" successfully created\n")
+	defer group.Remove("hobbits")
+	g, err := group.Get("hobbits")
+	c.Assert(err, check.IsNil)
+	c.Assert(g.Members, check.DeepEquals, []string{"frodo", "sam"})
+}
+
+func (s *S) TestNewGroupInvalidName(c *check.C) {
+	b := strings.NewReader(`{"name": "the fellowship"}`)
+	recorder, request := post("/group", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestNewGroupDuplicate(c *check.C) {
+	_, err := group.New("hobbits", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("hobbits")
+	b := strings.NewReader(`{"name": "hobbits"}`)
+	recorder, request := post("/group", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *S) TestGetGroup(c *check.C) {
+	_, err := group.New("hobbits", []string{"frodo"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("hobbits")
+	recorder, request := get("/group/hobbits", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var g group.Group
+	err = json.NewDecoder(recorder.Body).Decode(&g)
+	c.Assert(err, check.IsNil)
+	c.Assert(g, check.DeepEquals, group.Group{Name: "hobbits", Members: []string{"frodo"}})
+}
+
+func (s *S) TestGetGroupNotFound(c *check.C) {
+	recorder, request := get("/group/orcs", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestListGroups(c *check.C) {
+	_, err := group.New("hobbits", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("hobbits")
+	recorder, request := get("/group", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var groups []group.Group
+	err = json.NewDecoder(recorder.Body).Decode(&groups)
+	c.Assert(err, check.IsNil)
+	c.Assert(groups, check.HasLen, 1)
+	c.Assert(groups[0].Name, check.Equals, "hobbits")
+}
+
+func (s *S) TestRemoveGroup(c *check.C) {
+	_, err := group.New("hobbits", nil)
+	c.Assert(err, check.IsNil)
+	recorder, request := del("/group/hobbits", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	_, err = group.Get("hobbits")
+	c.Assert(err, check.Equals, group.ErrGroupNotFound)
+}
+
+func (s *S) TestAddAndRemoveGroupMember(c *check.C) {
+	_, err := group.New("hobbits", []string{"frodo"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("hobbits")
+	recorder, request := post("/group/hobbits/member/sam", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	g, err := group.Get("hobbits")
+	c.Assert(err, check.IsNil)
+	c.Assert(g.Members, check.DeepEquals, []string{"frodo", "sam"})
+	recorder, request = del("/group/hobbits/member/frodo", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	g, err = group.Get("hobbits")
+	c.Assert(err, check.IsNil)
+	c.Assert(g.Members, check.DeepEquals, []string{"sam"})
+}
+
+func (s *S) TestAddGroupMemberGroupNotFound(c *check.C) {
+	recorder, request := post("/group/orcs/member/sam", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestNewNamespace(c *check.C) {
+	b := strings.NewReader(`{"name": "shire", "owners": ["bilbo"]}`)
+	recorder, request := post("/namespace", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "Namespace \"shire\" successfully created\n")
+	defer repository.RemoveNamespace("shire")
+	n, err := repository.GetNamespace("shire")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Owners, check.DeepEquals, []string{"bilbo"})
+}
+
+func (s *S) TestNewNamespaceWithoutOwners(c *check.C) {
+	b := strings.NewReader(`{"name": "shire"}`)
+	recorder, request := post("/namespace", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestGetNamespace(c *check.C) {
+	_, err := repository.NewNamespace("shire", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer repository.RemoveNamespace("shire")
+	recorder, request := get("/namespace/shire", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var n repository.Namespace
+	err = json.NewDecoder(recorder.Body).Decode(&n)
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Name, check.Equals, "shire")
+	c.Assert(n.Owners, check.DeepEquals, []string{"bilbo"})
+}
+
+func (s *S) TestListNamespaces(c *check.C) {
+	_, err := repository.NewNamespace("shire", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer repository.RemoveNamespace("shire")
+	recorder, request := get("/namespace", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var namespaces []repository.Namespace
+	err = json.NewDecoder(recorder.Body).Decode(&namespaces)
+	c.Assert(err, check.IsNil)
+	c.Assert(namespaces, check.HasLen, 1)
+	c.Assert(namespaces[0].Name, check.Equals, "shire")
+}
+
+func (s *S) TestRemoveNamespace(c *check.C) {
+	_, err := repository.NewNamespace("shire", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	recorder, request := del("/namespace/shire", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	_, err = repository.GetNamespace("shire")
+	c.Assert(err, check.Equals, repository.ErrNamespaceNotFound)
+}
+
+func (s *S) TestRemoveNamespaceNotFound(c *check.C) {
+	recorder, request := del("/namespace/mordor", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestAddAndRemoveNamespaceOwner(c *check.C) {
+	_, err := repository.NewNamespace("shire", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer repository.RemoveNamespace("shire")
+	recorder, request := post("/namespace/shire/owner/frodo", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	recorder, request = del("/namespace/shire/owner/bilbo", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	n, err := repository.GetNamespace("shire")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Owners, check.DeepEquals, []string{"frodo"})
+	recorder, request = del("/namespace/shire/owner/frodo", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestGrantAndRevokeNamespaceAccess(c *check.C) {
+	_, err := repository.NewNamespace("shire", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer repository.RemoveNamespace("shire")
+	_, err = group.New("hobbits", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("hobbits")
+	b := strings.NewReader(`{"users": ["frodo"], "groups": ["hobbits"]}`)
+	recorder, request := post("/namespace/shire/grant?readonly=yes", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	n, err := repository.GetNamespace("shire")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.ReadOnlyUsers, check.DeepEquals, []string{"frodo"})
+	c.Assert(n.ReadOnlyGroups, check.DeepEquals, []string{"hobbits"})
+	c.Assert(n.Users, check.HasLen, 0)
+	b = strings.NewReader(`{"users": ["frodo"]}`)
+	recorder, request = del("/namespace/shire/revoke", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	n, err = repository.GetNamespace("shire")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.ReadOnlyUsers, check.HasLen, 0)
+	c.Assert(n.ReadOnlyGroups, check.DeepEquals, []string{"hobbits"})
+}
+
+func (s *S) TestGrantNamespaceAccessToGroupNotFound(c *check.C) {
+	_, err := repository.NewNamespace("shire", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer repository.RemoveNamespace("shire")
+	b := strings.NewReader(`{"users": ["frodo"], "groups": ["orcs"]}`)
+	recorder, request := post("/namespace/shire/grant", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "group not found\n")
+	n, err := repository.GetNamespace("shire")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Users, check.HasLen, 0)
+}
+
+func (s *S) TestGrantNamespaceAccessWithoutUsersOrGroups(c *check.C) {
+	b := strings.NewReader(`{}`)
+	recorder, request := post("/namespace/shire/grant", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "It is need a user or group list\n")
+}
+
+func (s *S) TestGetRules(c *check.C) {
+	r := repository.Repository{Name: "myrepo", Rules: []repository.RefRule{{Ref: "refs/tags/*", Actions: []string{"delete"}, Deny: true}}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	recorder, request := get("/repository/myrepo/rules", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, `[{"ref":"refs/tags/*","actions":["delete"],"deny":true}]`)
+}
+
+func (s *S) TestGetRulesRepositoryNotFound(c *check.C) {
+	recorder, request := get("/repository/ghost/rules", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestSetRules(c *check.C) {
+	r := repository.Repository{Name: "myrepo"}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	b := strings.NewReader(`[{"ref": "refs/heads/release/*", "groups": ["release-managers"]}]`)
+	recorder, request := put("/repository/myrepo/rules", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "Rules of repository \"myrepo\" successfully updated\n")
+	repo, err := repository.Get("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.Rules, check.DeepEquals, []repository.RefRule{{Ref: "refs/heads/release/*", Groups: []string{"release-managers"}}})
+}
+
+func (s *S) TestSetRulesInvalidRule(c *check.C) {
+	b := strings.NewReader(`[{"ref": "master"}]`)
+	recorder, request := put("/repository/myrepo/rules", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "invalid ref \"master\", it should start with refs/\n")
+}
+
+func (s *S) TestGetProtectedBranches(c *check.C) {
+	r := repository.Repository{Name: "myrepo", ProtectedBranches: []repository.ProtectedBranch{{Name: "master", DenyDelete: true}}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	recorder, request := get("/repository/myrepo/protected-branches", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, `[{"name":"master","denyNonFastForward":false,"denyDelete":true,"requireLinearHistory":false}]`)
+}
+
+func (s *S) TestSetProtectedBranches(c *check.C) {
+	r := repository.Repository{Name: "myrepo"}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	b := strings.NewReader(`[{"name": "master", "denyNonFastForward": true, "requireLinearHistory": true}]`)
+	recorder, request := put("/repository/myrepo/protected-branches", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "Protected branches of repository \"myrepo\" successfully updated\n")
+	repo, err := repository.Get("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.ProtectedBranches, check.DeepEquals, []repository.ProtectedBranch{{Name: "master", DenyNonFastForward: true, RequireLinearHistory: true}})
+}
+
+func (s *S) TestSetProtectedBranchesInvalidBranch(c *check.C) {
+	b := strings.NewReader(`[{"name": "refs/heads/master"}]`)
+	recorder, request := put("/repository/myrepo/protected-branches", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestGetAllowedSources(c *check.C) {
+	r := repository.Repository{Name: "myrepo", AllowedSources: []string{"10.0.0.0/8"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	recorder, request := get("/repository/myrepo/allowed-sources", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, `["10.0.0.0/8"]`)
+}
+
+func (s *S) TestSetAllowedSources(c *check.C) {
+	r := repository.Repository{Name: "myrepo"}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	b := strings.NewReader(`["10.0.0.0/8", "192.168.1.10"]`)
+	recorder, request := put("/repository/myrepo/allowed-sources", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "Allowed sources of repository \"myrepo\" successfully updated\n")
+	repo, err := repository.Get("myrepo")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.AllowedSources, check.DeepEquals, []string{"10.0.0.0/8", "192.168.1.10"})
+}
+
+func (s *S) TestSetAllowedSourcesInvalidSource(c *check.C) {
+	b := strings.NewReader(`["10.0.0.0/33"]`)
+	recorder, request := put("/repository/myrepo/allowed-sources", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestSetNamespaceAllowedSources(c *check.C) {
+	_, err := repository.NewNamespace("team", []string{"gandalf"})
+	c.Assert(err, check.IsNil)
+	defer repository.RemoveNamespace("team")
+	b := strings.NewReader(`["10.0.0.0/8"]`)
+	recorder, request := put("/namespace/team/allowed-sources", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	n, err := repository.GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.AllowedSources, check.DeepEquals, []string{"10.0.0.0/8"})
+}
+
+func (s *S) TestSetNamespaceAllowedSourcesNotFound(c *check.C) {
+	b := strings.NewReader(`["10.0.0.0/8"]`)
+	recorder, request := put("/namespace/ghost/allowed-sources", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestGetRepositoryAudit(c *check.C) {
+	op := audit.Start(repository.Session{User: "bilbo", Repository: "myrepo", Action: "git-upload-pack", ClientAddress: "192.168.50.1"})
+	err := op.Finish(0)
+	c.Assert(err, check.IsNil)
+	other := audit.Start(repository.Session{User: "bilbo", Repository: "otherrepo", Action: "git-upload-pack"})
+	err = other.Finish(0)
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Audit().RemoveAll(nil)
+	recorder, request := get("/repository/myrepo/audit?since="+op.StartedAt.Add(-time.Minute).UTC().Format(time.RFC3339), nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var operations []audit.Operation
+	err = json.NewDecoder(recorder.Body).Decode(&operations)
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].ID, check.Equals, op.ID)
+	c.Assert(operations[0].ClientAddress, check.Equals, "192.168.50.1")
+}
+
+func (s *S) TestGetUserAudit(c *check.C) {
+	op := audit.Start(repository.Session{User: "bilbo", Repository: "myrepo", Action: "git-receive-pack"})
+	err := op.Deny("You don't have access to write in this repository.")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Audit().RemoveAll(nil)
+	recorder, request := get("/user/bilbo/audit?limit=10&offset=0", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var operations []audit.Operation
+	err = json.NewDecoder(recorder.Body).Decode(&operations)
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].Denied, check.Equals, "You don't have access to write in this repository.")
+}
+
+func (s *S) TestGetChanges(c *check.C) {
+	err := audit.RecordChange(audit.Change{Actor: "gandalf", Method: "DELETE", Target: "/user/bilbo", Status: 200})
+	c.Assert(err, check.IsNil)
+	err = audit.RecordChange(audit.Change{Actor: "saruman", Method: "DELETE", Target: "/user/frodo", Status: 200})
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.APIAudit().RemoveAll(nil)
+	recorder, request := get("/audit/changes?actor=gandalf&target=/user/", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var changes []audit.Change
+	err = json.NewDecoder(recorder.Body).Decode(&changes)
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.HasLen, 1)
+	c.Assert(changes[0].Target, check.Equals, "/user/bilbo")
+}
+
+func (s *S) TestGetChangesInvalidFilters(c *check.C) {
+	recorder, request := get("/audit/changes?until=tomorrow", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "Invalid until time, it must be in RFC 3339 format.\n")
+}
+
+func (s *S) TestNewToken(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	b := strings.NewReader(`{"name": "laptop", "scope": "write"}`)
+	recorder, request := post("/user/bilbo/tokens?expires="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339), b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var result map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result["name"], check.Equals, "laptop")
+	c.Assert(result["user"], check.Equals, "bilbo")
+	c.Assert(result["scope"], check.Equals, "write")
+	c.Assert(result["token"], check.Matches, user.TokenPrefix+"[0-9a-f]{64}")
+	t, err := user.AuthenticateToken(result["token"].(string))
+	c.Assert(err, check.IsNil)
+	c.Assert(t.ID, check.Equals, result["id"])
+}
+
+func (s *S) TestNewTokenErrors(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	_, _, err = user.NewToken("bilbo", "laptop", user.TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	tests := []struct {
+		url    string
+		body   string
+		status int
+	}{
+		{"/user/bilbo/tokens", `{"name": "desktop", "scope": "admin"}`, http.StatusBadRequest},
+		{"/user/bilbo/tokens?expires=tomorrow", `{"name": "desktop"}`, http.StatusBadRequest},
+		{"/user/bilbo/tokens", `{"name": "laptop"}`, http.StatusConflict},
+		{"/user/frodo/tokens", `{"name": "laptop"}`, http.StatusNotFound},
+	}
+	for _, t := range tests {
+		recorder, request := post(t.url, strings.NewReader(t.body), c)
+		s.router.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.status, check.Commentf(t.url))
+	}
+}
+
+func (s *S) TestListTokens(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	t, _, err := user.NewToken("bilbo", "laptop", user.TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	recorder, request := get("/user/bilbo/tokens", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Not(check.Matches), `.*hash.*`)
+	var tokens []user.Token
+	err = json.NewDecoder(recorder.Body).Decode(&tokens)
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.HasLen, 1)
+	c.Assert(tokens[0].ID, check.Equals, t.ID)
+	c.Assert(tokens[0].Hash, check.Equals, "")
+	recorder, request = get("/user/frodo/tokens", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestRevokeToken(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	t, plain, err := user.NewToken("bilbo", "laptop", user.TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	recorder, request := del("/user/bilbo/tokens/"+t.ID, nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "Token successfully revoked from user \"bilbo\"\n")
+	_, err = user.AuthenticateToken(plain)
+	c.Assert(err, check.Equals, user.ErrInvalidToken)
+	recorder, request = del("/user/bilbo/tokens/"+t.ID, nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestGetAuditInvalidFilters(c *check.C) {
+	urls := map[string]string{
+		"/repository/myrepo/audit?since=yesterday": "Invalid since time, it must be in RFC 3339 format.\n",
+		"/repository/myrepo/audit?limit=-1":        "Invalid limit, it must be a non-negative integer.\n",
+		"/user/bilbo/audit?offset=many":            "Invalid offset, it must be a non-negative integer.\n",
+	}
+	for url, msg := range urls {
+		recorder, request := get(url, nil, c)
+		s.router.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusBadRequest)
+		c.Check(readBody(recorder.Body, c), check.Equals, msg)
+	}
+}
+
+func (s *S) TestGetPermission(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	r := repository.Repository{Name: "myrepo", ReadOnlyUsers: []string{"bilbo"}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	recorder, request := get("/repository/myrepo/permissions/bilbo", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, `{"repository":"myrepo","user":"bilbo","access":"read","source":"read-only"}`)
+}
+
+func (s *S) TestGetPermissionWithNamespace(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	r := repository.Repository{Name: "shire/myrepo"}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	recorder, request := get("/repository/shire/myrepo/permissions/bilbo", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, `{"repository":"shire/myrepo","user":"bilbo","access":"none"}`)
 }
 
-func (s *S) TestGrantAccessRepositoryNotFound(c *check.C) {
-	b := bytes.NewBufferString(`{"repositories":["super-repo"],"users":["someuser"]}`)
-	rec, req := post("/repository/grant?readonly=yes", b, c)
-	s.router.ServeHTTP(rec, req)
-	c.Assert(rec.Code, check.Equals, http.StatusNotFound)
+func (s *S) TestGetPermissionRepositoryNotFound(c *check.C) {
+	recorder, request := get("/repository/ghost/permissions/bilbo", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestListUserRepositories(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, r := range []repository.Repository{{Name: "myrepo", Users: []string{"bilbo"}}, {Name: "otherrepo"}} {
+		err = conn.Repository().Insert(&r)
+		c.Assert(err, check.IsNil)
+		defer conn.Repository().RemoveId(r.Name)
+	}
+	recorder, request := get("/user/bilbo/repositories", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, `[{"repository":"myrepo","user":"bilbo","access":"write","source":"direct"}]`)
 }
 
 func (s *S) TestRevokeAccessUpdatesReposDocument(c *check.C) {
@@ -544,6 +1258,40 @@ func (s *S) TestAddKey(c *check.C) {
 	c.Assert(k.Comment, check.Equals, keyComment)
 }
 
+func (s *S) TestAddKeyWithExpiration(c *check.C) {
+	usr, err := user.New("Frodo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(usr.Name)
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	b := strings.NewReader(fmt.Sprintf(`{"keyname": %q}`, rawKey))
+	recorder, request := post(fmt.Sprintf("/user/%s/key?expires=%s", usr.Name, expiresAt.Format(time.RFC3339)), b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var k user.Key
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Key().Find(bson.M{"name": "keyname", "username": usr.Name}).One(&k)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.ExpiresAt.Equal(expiresAt), check.Equals, true)
+}
+
+func (s *S) TestAddKeyInvalidExpiration(c *check.C) {
+	b := strings.NewReader(fmt.Sprintf(`{"keyname": %q}`, rawKey))
+	recorder, request := post("/user/Frodo/key?expires=tomorrow", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "Invalid expiration time, it must be in RFC 3339 format.\n")
+}
+
+func (s *S) TestAddKeyExpirationInThePast(c *check.C) {
+	b := strings.NewReader(fmt.Sprintf(`{"keyname": %q}`, rawKey))
+	recorder, request := post("/user/Frodo/key?expires=2015-01-01T00:00:00Z", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "The expiration time must be in the future.\n")
+}
+
 func (s *S) TestUpdateKey(c *check.C) {
 	usr, err := user.New("Frodo", map[string]string{})
 	c.Assert(err, check.IsNil)
@@ -565,6 +1313,27 @@ func (s *S) TestUpdateKey(c *check.C) {
 	c.Assert(k.Body, check.Equals, otherKey+"\n")
 }
 
+func (s *S) TestUpdateKeyWithExpiration(c *check.C) {
+	usr, err := user.New("Frodo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(usr.Name)
+	err = user.AddKey(usr.Name, map[string]string{"keyname": rawKey})
+	c.Assert(err, check.IsNil)
+	defer user.RemoveKey(usr.Name, "keyname")
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	b := strings.NewReader(otherKey)
+	recorder, request := put(fmt.Sprintf("/user/%s/key/keyname?expires=%s", usr.Name, expiresAt.Format(time.RFC3339)), b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var k user.Key
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Key().Find(bson.M{"name": "keyname", "username": usr.Name}).One(&k)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.ExpiresAt.Equal(expiresAt), check.Equals, true)
+}
+
 func (s *S) TestUpdateKeyUserNotFound(c *check.C) {
 	b := strings.NewReader(rawKey)
 	recorder, request := put("/user/frodo/key/keyname", b, c)
@@ -933,6 +1702,327 @@ func (s *S) TestListKeysWithoutKeysGivesEmptyJSON(c *check.C) {
 	c.Assert(b, check.Equals, "{}")
 }
 
+func (s *S) TestListKeysDetailed(c *check.C) {
+	u, err := user.New("Gandalf", map[string]string{"key1": rawKey})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	request, err := http.NewRequest("GET", "/user/Gandalf/keys?detailed=true", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var keys []user.Key
+	err = json.NewDecoder(recorder.Body).Decode(&keys)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0].Name, check.Equals, "key1")
+	c.Assert(keys[0].UserName, check.Equals, "Gandalf")
+	c.Assert(keys[0].LastUsedAt.IsZero(), check.Equals, true)
+	c.Assert(keys[0].LastUsedFrom, check.Equals, "")
+}
+
+func (s *S) TestListKeysDetailedJSON(c *check.C) {
+	u, err := user.New("Gandalf", map[string]string{"key1": rawKey})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	request, err := http.NewRequest("GET", "/user/Gandalf/keys?detailed=true", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var keys []map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&keys)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0]["name"], check.Equals, "key1")
+	c.Assert(keys[0]["userName"], check.Equals, "Gandalf")
+	c.Assert(keys[0]["type"], check.Equals, "ssh-rsa")
+	c.Assert(keys[0]["fingerprint"], check.Matches, "SHA256:.+")
+	c.Assert(keys[0]["md5Fingerprint"], check.Matches, "MD5:.+")
+	c.Assert(keys[0]["createdAt"], check.NotNil)
+	for _, field := range []string{"expiresAt", "lastUsedAt", "lastUsedFrom"} {
+		_, ok := keys[0][field]
+		c.Check(ok, check.Equals, false, check.Commentf(field))
+	}
+}
+
+func (s *S) TestListKeysDetailedWithoutKeys(c *check.C) {
+	u, err := user.New("Gandalf", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	request, err := http.NewRequest("GET", "/user/Gandalf/keys?detailed=true", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "[]")
+}
+
+func (s *S) TestAddKeyViolatingKeyPolicy(c *check.C) {
+	config.Set("keys:policy:min-rsa-bits", 4096)
+	defer config.Unset("keys:policy:min-rsa-bits")
+	usr, err := user.New("Frodo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(usr.Name)
+	b := strings.NewReader(fmt.Sprintf(`{"keyname": "%s"}`, otherKey))
+	recorder, request := post("/user/Frodo/key", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(recorder.Body.String(), check.Equals, "RSA keys must have at least 4096 bits.\n")
+}
+
+func (s *S) TestListKeyPolicyViolations(c *check.C) {
+	u, err := user.New("Gandalf", map[string]string{"key1": rawKey, "key2": otherKey})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	config.Set("keys:policy:algorithms", []interface{}{"ssh-rsa"})
+	defer config.Unset("keys:policy:algorithms")
+	recorder, request := get("/keys/policy-violations", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var violations []user.KeyPolicyViolation
+	err = json.NewDecoder(recorder.Body).Decode(&violations)
+	c.Assert(err, check.IsNil)
+	c.Assert(violations, check.HasLen, 1)
+	c.Assert(violations[0].Key.Name, check.Equals, "key1")
+	c.Assert(violations[0].Reason, check.Equals, "Keys of type ssh-dss are not allowed.")
+}
+
+func (s *S) TestAddAuthority(c *check.C) {
+	b := strings.NewReader(fmt.Sprintf(`{"shire": "%s"}`, otherKey))
+	recorder, request := post("/authority", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "Authority(ies) successfully created")
+	defer user.RemoveAuthority("shire")
+	authorities, err := user.ListAuthorities()
+	c.Assert(err, check.IsNil)
+	c.Assert(authorities, check.HasLen, 1)
+	c.Assert(authorities[0].Name, check.Equals, "shire")
+	c.Assert(authorities[0].Fingerprint, check.Equals, "SHA256:I2umWKJ9VicDB9y07tGdYX7M67/xsACLS8eUILZ7Ovw")
+}
+
+func (s *S) TestAddAuthorityInvalidKey(c *check.C) {
+	b := strings.NewReader(`{"shire": "not a key"}`)
+	recorder, request := post("/authority", b, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(readBody(recorder.Body, c), check.Equals, user.ErrInvalidKey.Error()+"\n")
+}
+
+func (s *S) TestListAuthorities(c *check.C) {
+	err := user.AddAuthority("shire", otherKey)
+	c.Assert(err, check.IsNil)
+	defer user.RemoveAuthority("shire")
+	recorder, request := get("/authority", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var authorities []user.Authority
+	err = json.NewDecoder(recorder.Body).Decode(&authorities)
+	c.Assert(err, check.IsNil)
+	c.Assert(authorities, check.HasLen, 1)
+	c.Assert(authorities[0].Name, check.Equals, "shire")
+}
+
+func (s *S) TestRemoveAuthority(c *check.C) {
+	err := user.AddAuthority("shire", otherKey)
+	c.Assert(err, check.IsNil)
+	recorder, request := del("/authority/shire", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	authorities, err := user.ListAuthorities()
+	c.Assert(err, check.IsNil)
+	c.Assert(authorities, check.HasLen, 0)
+}
+
+func (s *S) TestRemoveAuthorityNotFound(c *check.C) {
+	recorder, request := del("/authority/mordor", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestAddPrincipal(c *check.C) {
+	u, err := user.New("Gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	recorder, request := post("/user/Gandalf/principal/gandalf@valinor", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	found, err := user.GetUserByPrincipal("gandalf@valinor")
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Name, check.Equals, "Gandalf")
+}
+
+func (s *S) TestAddPrincipalInUse(c *check.C) {
+	u, err := user.New("Gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	other, err := user.New("Saruman", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove(other.Name)
+	err = user.AddPrincipal("Saruman", "istar@valinor")
+	c.Assert(err, check.IsNil)
+	recorder, request := post("/user/Gandalf/principal/istar@valinor", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *S) TestAddPrincipalUserNotFound(c *check.C) {
+	recorder, request := post("/user/nobody/principal/nobody@valinor", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestRemovePrincipal(c *check.C) {
+	u, err := user.New("Gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	err = user.AddPrincipal("Gandalf", "gandalf@valinor")
+	c.Assert(err, check.IsNil)
+	recorder, request := del("/user/Gandalf/principal/gandalf@valinor", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	_, err = user.GetUserByPrincipal("gandalf@valinor")
+	c.Assert(err, check.Equals, user.ErrPrincipalNotFound)
+}
+
+func (s *S) TestSuspendUser(c *check.C) {
+	u, err := user.New("Gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	recorder, request := post("/user/Gandalf/suspend", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "User \"Gandalf\" successfully suspended\n")
+	suspended, err := user.IsSuspended("Gandalf")
+	c.Assert(err, check.IsNil)
+	c.Assert(suspended, check.Equals, true)
+}
+
+func (s *S) TestSuspendUserAlreadySuspended(c *check.C) {
+	u, err := user.New("Gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	err = user.Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	recorder, request := post("/user/Gandalf/suspend", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *S) TestSuspendUserNotFound(c *check.C) {
+	recorder, request := post("/user/nobody/suspend", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+}
+
+func (s *S) TestUnsuspendUser(c *check.C) {
+	u, err := user.New("Gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	err = user.Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	recorder, request := post("/user/Gandalf/unsuspend", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "User \"Gandalf\" successfully unsuspended\n")
+	suspended, err := user.IsSuspended("Gandalf")
+	c.Assert(err, check.IsNil)
+	c.Assert(suspended, check.Equals, false)
+}
+
+func (s *S) TestUnsuspendUserNotSuspended(c *check.C) {
+	u, err := user.New("Gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	recorder, request := post("/user/Gandalf/unsuspend", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusConflict)
+}
+
+func (s *S) TestSyncKeysDryRun(c *check.C) {
+	u, err := user.New("Gandalf", map[string]string{"key1": otherKey})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	recorder, request := post("/keys/sync?dry-run=true", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var report user.SyncReport
+	err = json.NewDecoder(recorder.Body).Decode(&report)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.Missing, check.HasLen, 0)
+	c.Assert(report.Orphaned, check.HasLen, 0)
+}
+
+func (s *S) TestSyncKeysAuthorizedKeysDisabled(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	recorder, request := post("/keys/sync", nil, c)
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+	c.Assert(readBody(recorder.Body, c), check.Equals, user.ErrAuthorizedKeysDisabled.Error()+"\n")
+}
+
+func (s *S) TestGetKey(c *check.C) {
+	u, err := user.New("Gandalf", map[string]string{"key1": otherKey})
+	c.Assert(err, check.IsNil)
+	defer user.Remove(u.Name)
+	request, err := http.NewRequest("GET", "/key/SHA256:I2umWKJ9VicDB9y07tGdYX7M67/xsACLS8eUILZ7Ovw", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var key user.Key
+	err = json.NewDecoder(recorder.Body).Decode(&key)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.Name, check.Equals, "key1")
+	c.Assert(key.UserName, check.Equals, "Gandalf")
+	c.Assert(key.Type, check.Equals, "ssh-rsa")
+	c.Assert(key.Bits, check.Equals, 2048)
+}
+
+func (s *S) TestGetKeyNotFound(c *check.C) {
+	request, err := http.NewRequest("GET", "/key/SHA256:I2umWKJ9VicDB9y07tGdYX7M67/xsACLS8eUILZ7Ovw", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(recorder.Body.String(), check.Equals, user.ErrKeyNotFound.Error()+"\n")
+}
+
+func (s *S) TestListUnusedKeys(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	old := time.Now().Add(-72 * time.Hour)
+	err = conn.Key().Insert(user.Key{Name: "old", Body: "ssh-rsa old", UserName: "Gandalf", CreatedAt: old, LastUsedAt: old})
+	c.Assert(err, check.IsNil)
+	err = conn.Key().Insert(user.Key{Name: "recent", Body: "ssh-rsa recent", UserName: "Gandalf", CreatedAt: old, LastUsedAt: time.Now()})
+	c.Assert(err, check.IsNil)
+	defer conn.Key().RemoveAll(bson.M{"username": "Gandalf"})
+	request, err := http.NewRequest("GET", "/keys/unused?days=2", nil)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	var keys []user.Key
+	err = json.NewDecoder(recorder.Body).Decode(&keys)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	c.Assert(keys[0].Name, check.Equals, "old")
+}
+
+func (s *S) TestListUnusedKeysInvalidDays(c *check.C) {
+	for _, days := range []string{"", "abc", "0", "-1"} {
+		request, err := http.NewRequest("GET", "/keys/unused?days="+days, nil)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		s.router.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, http.StatusBadRequest)
+		c.Check(recorder.Body.String(), check.Equals, "The number of days must be a positive integer.\n")
+	}
+}
+
 func (s *S) TestListKeysWithInvalidUserReturnsNotFound(c *check.C) {
 	url := "/user/no-Gandalf/keys"
 	request, err := http.NewRequest("GET", url, nil)
@@ -1055,6 +2145,7 @@ func (s *S) TestUpdateRepositoryData(c *check.C) {
 	r.Users = []string{"b"}
 	r.ReadOnlyUsers = []string{"a"}
 	r.IsPublic = false
+	r.Visibility = repository.VisibilityPrivate
 	repo, err := repository.Get("something")
 	c.Assert(err, check.IsNil)
 	c.Assert(repo, check.DeepEquals, *r)
@@ -1082,6 +2173,57 @@ func (s *S) TestUpdateRepositoryDataPartial(c *check.C) {
 	c.Assert(repo, check.DeepEquals, *r)
 }
 
+func (s *S) TestUpdateRepositoryVisibility(c *check.C) {
+	r, err := repository.New("something", []string{"pippin"}, nil, true)
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	tests := []struct {
+		body       string
+		status     int
+		visibility repository.Visibility
+	}{
+		{`{"visibility": "internal"}`, http.StatusOK, repository.VisibilityInternal},
+		{`{"readonlyusers": ["merry"]}`, http.StatusOK, repository.VisibilityInternal},
+		{`{"ispublic": true}`, http.StatusOK, repository.VisibilityPublic},
+		{`{"ispublic": false}`, http.StatusOK, repository.VisibilityPrivate},
+		{`{"visibility": "secret"}`, http.StatusBadRequest, repository.VisibilityPrivate},
+	}
+	for _, t := range tests {
+		request, err := http.NewRequest("PUT", "/repository/something", strings.NewReader(t.body))
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		s.router.ServeHTTP(recorder, request)
+		c.Check(recorder.Code, check.Equals, t.status, check.Commentf(t.body))
+		repo, err := repository.Get("something")
+		c.Assert(err, check.IsNil)
+		c.Check(repo.Visibility, check.Equals, t.visibility, check.Commentf(t.body))
+		c.Check(repo.IsPublic, check.Equals, t.visibility == repository.VisibilityPublic, check.Commentf(t.body))
+	}
+}
+
+func (s *S) TestUpdateRepositoryGroupNotFound(c *check.C) {
+	r, err := repository.New("something", []string{"pippin"}, nil, true)
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	body := strings.NewReader(`{"users": ["frodo"], "readonlygroups": ["orcs"]}`)
+	request, err := http.NewRequest("PUT", "/repository/something", body)
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	s.router.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	c.Assert(readBody(recorder.Body, c), check.Equals, "group not found\n")
+	repo, err := repository.Get("something")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.Users, check.DeepEquals, []string{"pippin"})
+	c.Assert(repo.ReadOnlyGroups, check.HasLen, 0)
+}
+
 func (s *S) TestUpdateRepositoryNotFound(c *check.C) {
 	url := "/repository/foo"
 	body := strings.NewReader(`{"ispublic":true}`)
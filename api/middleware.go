@@ -5,12 +5,23 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/negroni"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/audit"
+	"github.com/tsuru/gandalf/auth"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
 )
 
 type loggerMiddleware struct {
@@ -49,3 +60,250 @@ func (m *responseHeaderMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Req
 	rw.Header().Set(m.name, m.value)
 	next(rw, r)
 }
+
+// maxAuditedBody is the size limit of request bodies stored in the audit
+// trail, longer bodies are truncated.
+const maxAuditedBody = 64 << 10
+
+const redacted = "[REDACTED]"
+
+// keyPath matches the endpoints whose request bodies carry key material: all
+// of their values are redacted in the audit trail. The router matches paths by
+// prefix, so trailing segments still reach these endpoints and are matched
+// too.
+var keyPath = regexp.MustCompile(`^/(user/[^/]+/key|authority)(/.*)?$`)
+
+// userPath matches the endpoints that may create users, whose keys are
+// redacted in the audit trail. Like keyPath, it allows trailing segments.
+var userPath = regexp.MustCompile(`^/user(/.*)?$`)
+
+type auditMiddleware struct {
+	logger *log.Logger
+	record func(audit.Change) error
+}
+
+// NewAuditMiddleware returns a middleware that records the changes made
+// through the API, that is, every request that is not a GET or a HEAD, except
+// git pushes and fetches over HTTP, which are served by git.
+//
+// The actor of a change is the name of the credential that authenticated the
+// request. Without API authentication, it's read from the header defined by
+// audit:actor-header, forwarded by the client or by a reverse proxy.
+func NewAuditMiddleware() *auditMiddleware {
+	return &auditMiddleware{
+		logger: log.New(os.Stdout, "", 0),
+		record: audit.RecordChange,
+	}
+}
+
+func (m *auditMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !audited(r) {
+		next(rw, r)
+		return
+	}
+	change := audit.Change{
+		RemoteAddress: r.RemoteAddr,
+		Method:        r.Method,
+		Target:        r.URL.RequestURI(),
+		Time:          time.Now(),
+	}
+	if id := auth.FromContext(r.Context()); id != nil {
+		change.Actor = id.Name
+	} else if header, _ := config.GetString("audit:actor-header"); header != "" {
+		change.Actor = r.Header.Get(header)
+	}
+	if r.Body != nil && !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			change.Body = redactBody(r.URL.Path, body)
+		}
+	}
+	next(rw, r)
+	change.Status = rw.(negroni.ResponseWriter).Status()
+	if err := m.record(change); err != nil {
+		m.logger.Printf("Could not record change %s %s in the audit trail: %s", change.Method, change.Target, err)
+	}
+}
+
+func audited(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return false
+	}
+	return !strings.HasSuffix(r.URL.Path, "/git-upload-pack") && !strings.HasSuffix(r.URL.Path, "/git-receive-pack")
+}
+
+// redactBody returns the body of a request to be stored in the audit trail.
+// The key material in requests that add users, keys or authorities is
+// replaced with [REDACTED], keeping the names of keys. Bodies of such requests
+// that can't be parsed are redacted entirely.
+func redactBody(path string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if keyPath.MatchString(path) {
+		var keys map[string]interface{}
+		if err := json.Unmarshal(body, &keys); err != nil {
+			return redacted
+		}
+		return redactedJSON(redactValues(keys))
+	}
+	if userPath.MatchString(path) {
+		var usr map[string]interface{}
+		if err := json.Unmarshal(body, &usr); err != nil {
+			return redacted
+		}
+		for field, value := range usr {
+			if !strings.EqualFold(field, "keys") {
+				continue
+			}
+			if keys, ok := value.(map[string]interface{}); ok {
+				usr[field] = redactValues(keys)
+			} else {
+				usr[field] = redacted
+			}
+		}
+		return redactedJSON(usr)
+	}
+	if len(body) > maxAuditedBody {
+		body = body[:maxAuditedBody]
+	}
+	return string(body)
+}
+
+func redactValues(values map[string]interface{}) map[string]interface{} {
+	for name := range values {
+		values[name] = redacted
+	}
+	return values
+}
+
+func redactedJSON(value interface{}) string {
+	out, err := json.Marshal(value)
+	if err != nil {
+		return redacted
+	}
+	return string(out)
+}
+
+type authMiddleware struct {
+	logger *log.Logger
+}
+
+// NewAuthMiddleware returns a middleware that authenticates and authorizes
+// requests when api:auth:enabled is true, with the credentials defined in
+// api:auth:tokens and api:auth:hmac. Requests that are not allowed are
+// answered with a 401 or 403 status, the others carry the identity of the
+// client in their context.
+func NewAuthMiddleware() *authMiddleware {
+	return &authMiddleware{
+		logger: log.New(os.Stdout, "", 0),
+	}
+}
+
+func (m *authMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if enabled, _ := config.GetBool("api:auth:enabled"); !enabled {
+		next(rw, r)
+		return
+	}
+	authenticators, err := configAuthenticators()
+	if err != nil {
+		m.logger.Printf("Could not load the API credentials: %s", err)
+		http.Error(rw, "Could not load the API credentials.", http.StatusInternalServerError)
+		return
+	}
+	id, err := auth.Authorize(r, authenticators...)
+	if err != nil {
+		http.Error(rw, err.Error(), auth.Status(err))
+		return
+	}
+	if id != nil {
+		r = r.WithContext(auth.NewContext(r.Context(), id))
+	}
+	next(rw, r)
+}
+
+// configAuthenticators returns the authenticators of the credentials defined
+// in the config, in the form:
+//
+//	api:
+//	  auth:
+//	    tokens:
+//	      <name>:
+//	        token: <token>
+//	        scope: <scope>
+//	    hmac:
+//	      <name>:
+//	        secret: <secret>
+//	        scope: <scope>
+func configAuthenticators() ([]auth.Authenticator, error) {
+	tokens, err := configCredentials("api:auth:tokens", "token")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := configCredentials("api:auth:hmac", "secret")
+	if err != nil {
+		return nil, err
+	}
+	return []auth.Authenticator{userTokenAuthenticator{}, auth.TokenAuthenticator(tokens), auth.HMACAuthenticator(keys)}, nil
+}
+
+// userTokenAuthenticator authenticates requests carrying a personal access
+// token in the Authorization header, in the form "Authorization: Bearer
+// <token>". They act for the user of the token, with the read-only scope, or
+// the commit scope for tokens with the write scope, and only reach the
+// content endpoints, the resources of the user and the namespaces it owns
+// (see auth.Identity.Allows).
+type userTokenAuthenticator struct{}
+
+func (userTokenAuthenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !strings.HasPrefix(token, user.TokenPrefix) {
+		return nil, nil
+	}
+	t, err := user.AuthenticateToken(token)
+	if err == user.ErrInvalidToken || err == user.ErrUserSuspended {
+		return nil, auth.ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	scope := auth.ScopeReadOnly
+	if t.CanWrite() {
+		scope = auth.ScopeCommit
+	}
+	id := &auth.Identity{Name: t.UserName, User: t.UserName, Scope: scope}
+	if strings.HasPrefix(r.URL.Path, "/namespace/") {
+		if id.Namespaces, err = repository.OwnedNamespaces(t.UserName); err != nil {
+			return nil, err
+		}
+	}
+	return id, nil
+}
+
+func configCredentials(key, secretKey string) ([]auth.Credential, error) {
+	value, err := config.Get(key)
+	if err != nil {
+		return nil, nil
+	}
+	entries, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a map of credentials", key)
+	}
+	var credentials []auth.Credential
+	for name := range entries {
+		prefix := fmt.Sprintf("%s:%v", key, name)
+		secret, err := config.GetString(prefix + ":" + secretKey)
+		if err != nil || secret == "" {
+			return nil, fmt.Errorf("%s:%s is required", prefix, secretKey)
+		}
+		scopeName, _ := config.GetString(prefix + ":scope")
+		scope, err := auth.ParseScope(scopeName)
+		if err != nil {
+			return nil, fmt.Errorf("%s:scope: %s", prefix, err)
+		}
+		credentials = append(credentials, auth.Credential{Name: fmt.Sprint(name), Secret: secret, Scope: scope})
+	}
+	return credentials, nil
+}
@@ -6,13 +6,21 @@ package api
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/negroni"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/audit"
+	"github.com/tsuru/gandalf/auth"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
 	"gopkg.in/check.v1"
 )
 
@@ -53,3 +61,361 @@ func (s *S) TestResponseHeaderMiddlewareDuplicate(c *check.C) {
 	}))
 	c.Assert(recorder.Header().Get("Server"), check.Equals, "mini-server/0.1")
 }
+
+func (s *S) TestAuditMiddleware(c *check.C) {
+	config.Set("audit:actor-header", "X-Gandalf-Actor")
+	defer config.Unset("audit:actor-header")
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("PUT", "/repository/myapp?force=1", strings.NewReader(`{"name":"otherapp"}`))
+	c.Assert(err, check.IsNil)
+	request.RemoteAddr = "192.168.50.1:5312"
+	request.Header.Set("X-Gandalf-Actor", "gandalf")
+	var changes []audit.Change
+	middle := auditMiddleware{record: func(change audit.Change) error {
+		changes = append(changes, change)
+		return nil
+	}}
+	var body []byte
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusConflict)
+	}))
+	c.Assert(string(body), check.Equals, `{"name":"otherapp"}`)
+	c.Assert(changes, check.HasLen, 1)
+	c.Assert(changes[0].Actor, check.Equals, "gandalf")
+	c.Assert(changes[0].RemoteAddress, check.Equals, "192.168.50.1:5312")
+	c.Assert(changes[0].Method, check.Equals, "PUT")
+	c.Assert(changes[0].Target, check.Equals, "/repository/myapp?force=1")
+	c.Assert(changes[0].Body, check.Equals, `{"name":"otherapp"}`)
+	c.Assert(changes[0].Status, check.Equals, http.StatusConflict)
+	c.Assert(changes[0].Time.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestAuditMiddlewareRedactsKeysWithTrailingSlash(c *check.C) {
+	var changes []audit.Change
+	middle := auditMiddleware{record: func(change audit.Change) error {
+		changes = append(changes, change)
+		return nil
+	}}
+	for _, path := range []string{"/user/bilbo/key/", "/authority/"} {
+		request, err := http.NewRequest("POST", path, strings.NewReader(`{"ring":"ssh-rsa AAAAB3NzaC1yc2E bilbo@shire"}`))
+		c.Assert(err, check.IsNil)
+		middle.ServeHTTP(negroni.NewResponseWriter(httptest.NewRecorder()), request, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}
+	c.Assert(changes, check.HasLen, 2)
+	c.Assert(changes[0].Body, check.Equals, `{"ring":"[REDACTED]"}`)
+	c.Assert(changes[1].Body, check.Equals, `{"ring":"[REDACTED]"}`)
+}
+
+func (s *S) TestAuditMiddlewareIgnoresReadsAndGit(c *check.C) {
+	var changes []audit.Change
+	middle := auditMiddleware{record: func(change audit.Change) error {
+		changes = append(changes, change)
+		return nil
+	}}
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/repository/myapp"},
+		{"HEAD", "/repository/myapp"},
+		{"POST", "/myapp.git/git-upload-pack"},
+		{"POST", "/team/myapp.git/git-receive-pack"},
+	} {
+		request, err := http.NewRequest(r.method, r.path, strings.NewReader("0000"))
+		c.Assert(err, check.IsNil)
+		middle.ServeHTTP(negroni.NewResponseWriter(httptest.NewRecorder()), request, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	}
+	c.Assert(changes, check.HasLen, 0)
+}
+
+func (s *S) TestAuditMiddlewareRecordFailure(c *check.C) {
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("DELETE", "/user/bilbo", nil)
+	c.Assert(err, check.IsNil)
+	var out bytes.Buffer
+	middle := auditMiddleware{
+		logger: log.New(&out, "", 0),
+		record: func(change audit.Change) error { return errors.New("no reachable servers") },
+	}
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("User bilbo successfully removed"))
+	}))
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(out.String(), check.Equals, "Could not record change DELETE /user/bilbo in the audit trail: no reachable servers\n")
+}
+
+func (s *S) TestRedactBody(c *check.C) {
+	tests := []struct{ path, body, expected string }{
+		{"/user", `{"name":"bilbo","keys":{"ring":"ssh-rsa AAAAB3NzaC1yc2E bilbo@shire"}}`, `{"keys":{"ring":"[REDACTED]"},"name":"bilbo"}`},
+		{"/user", `{"Name":"bilbo","Keys":"ssh-rsa AAAAB3NzaC1yc2E"}`, `{"Keys":"[REDACTED]","Name":"bilbo"}`},
+		{"/user", `{"name":"bilbo"`, "[REDACTED]"},
+		{"/user/bilbo/key", `{"ring":"ssh-rsa AAAAB3NzaC1yc2E bilbo@shire"}`, `{"ring":"[REDACTED]"}`},
+		{"/user/bilbo/key/ring", "ssh-rsa AAAAB3NzaC1yc2E bilbo@shire", "[REDACTED]"},
+		{"/authority", `{"ca":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5"}`, `{"ca":"[REDACTED]"}`},
+		{"/user/", `{"name":"bilbo","keys":{"ring":"ssh-rsa AAAAB3NzaC1yc2E bilbo@shire"}}`, `{"keys":{"ring":"[REDACTED]"},"name":"bilbo"}`},
+		{"/user/bilbo/key/", `{"ring":"ssh-rsa AAAAB3NzaC1yc2E bilbo@shire"}`, `{"ring":"[REDACTED]"}`},
+		{"/user/bilbo/key/ring/", "ssh-rsa AAAAB3NzaC1yc2E bilbo@shire", "[REDACTED]"},
+		{"/authority/", `{"ca":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5"}`, `{"ca":"[REDACTED]"}`},
+		{"/authority/x", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5", "[REDACTED]"},
+		{"/user/bilbo/tokens", `{"name":"laptop","scope":"read"}`, `{"name":"laptop","scope":"read"}`},
+		{"/repository/grant", `{"repositories":["myapp"],"users":["bilbo"]}`, `{"repositories":["myapp"],"users":["bilbo"]}`},
+		{"/repository/grant", "", ""},
+	}
+	for _, t := range tests {
+		c.Check(redactBody(t.path, []byte(t.body)), check.Equals, t.expected, check.Commentf(t.path))
+	}
+	long := strings.Repeat("x", maxAuditedBody+10)
+	c.Assert(redactBody("/hook/post-receive", []byte(long)), check.HasLen, maxAuditedBody)
+}
+
+func (s *S) setAPICredentials() func() {
+	config.Set("api:auth:enabled", true)
+	config.Set("api:auth:tokens", map[interface{}]interface{}{
+		"tsuru":     map[interface{}]interface{}{"token": "admin-token"},
+		"dashboard": map[interface{}]interface{}{"token": "read-token", "scope": "read-only"},
+	})
+	config.Set("api:auth:hmac", map[interface{}]interface{}{
+		"ci": map[interface{}]interface{}{"secret": "hmac-secret", "scope": "repository-admin"},
+	})
+	return func() {
+		config.Unset("api:auth")
+	}
+}
+
+func (s *S) TestAuthMiddleware(c *check.C) {
+	defer s.setAPICredentials()()
+	middle := authMiddleware{logger: log.New(ioutil.Discard, "", 0)}
+	var id *auth.Identity
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = auth.FromContext(r.Context())
+	})
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("DELETE", "/user/bilbo", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(id, check.DeepEquals, &auth.Identity{Name: "tsuru", Scope: auth.ScopeAdmin})
+	recorder = httptest.NewRecorder()
+	request, err = http.NewRequest("PUT", "/repository/myapp", strings.NewReader(`{"name":"otherapp"}`))
+	c.Assert(err, check.IsNil)
+	err = auth.Sign(request, "ci", "hmac-secret")
+	c.Assert(err, check.IsNil)
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(id, check.DeepEquals, &auth.Identity{Name: "ci", Scope: auth.ScopeRepositoryAdmin})
+}
+
+func (s *S) TestAuthMiddlewareDenied(c *check.C) {
+	defer s.setAPICredentials()()
+	middle := authMiddleware{logger: log.New(ioutil.Discard, "", 0)}
+	called := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	tests := []struct {
+		method        string
+		path          string
+		authorization string
+		status        int
+	}{
+		{"POST", "/hook/post-receive", "", http.StatusUnauthorized},
+		{"POST", "/hook/post-receive", "Bearer wrong-token", http.StatusUnauthorized},
+		{"POST", "/hook/post-receive", "Bearer read-token", http.StatusForbidden},
+		{"DELETE", "/user/bob/key/mykey/x.git/info/refs", "", http.StatusUnauthorized},
+		{"POST", "/hook/post-receive/x/y.git/git-upload-pack", "", http.StatusUnauthorized},
+	}
+	for _, t := range tests {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(t.method, t.path, nil)
+		c.Assert(err, check.IsNil)
+		if t.authorization != "" {
+			request.Header.Set("Authorization", t.authorization)
+		}
+		middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+		c.Check(recorder.Code, check.Equals, t.status)
+	}
+	c.Assert(called, check.Equals, false)
+}
+
+func (s *S) TestAuthMiddlewareExemptPaths(c *check.C) {
+	defer s.setAPICredentials()()
+	middle := authMiddleware{logger: log.New(ioutil.Discard, "", 0)}
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/healthcheck", nil)
+	c.Assert(err, check.IsNil)
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("WORKING"))
+	}))
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestAuthMiddlewareDisabled(c *check.C) {
+	middle := authMiddleware{logger: log.New(ioutil.Discard, "", 0)}
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("POST", "/hook/post-receive", nil)
+	c.Assert(err, check.IsNil)
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestAuthMiddlewareInvalidConfig(c *check.C) {
+	defer s.setAPICredentials()()
+	config.Set("api:auth:tokens", map[interface{}]interface{}{
+		"tsuru": map[interface{}]interface{}{"token": "admin-token", "scope": "root"},
+	})
+	var out bytes.Buffer
+	middle := authMiddleware{logger: log.New(&out, "", 0)}
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/repository/myapp", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c.Assert(recorder.Code, check.Equals, http.StatusInternalServerError)
+	c.Assert(out.String(), check.Matches, `Could not load the API credentials: api:auth:tokens:tsuru:scope: invalid scope "root".*\n`)
+}
+
+func (s *S) TestAuditMiddlewareActorFromIdentity(c *check.C) {
+	var changes []audit.Change
+	middle := auditMiddleware{record: func(change audit.Change) error {
+		changes = append(changes, change)
+		return nil
+	}}
+	request, err := http.NewRequest("DELETE", "/user/bilbo", nil)
+	c.Assert(err, check.IsNil)
+	request = request.WithContext(auth.NewContext(request.Context(), &auth.Identity{Name: "tsuru", Scope: auth.ScopeAdmin}))
+	middle.ServeHTTP(negroni.NewResponseWriter(httptest.NewRecorder()), request, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c.Assert(changes, check.HasLen, 1)
+	c.Assert(changes[0].Actor, check.Equals, "tsuru")
+}
+
+func (s *S) TestAuthMiddlewareUserToken(c *check.C) {
+	defer s.setAPICredentials()()
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	_, token, err := user.NewToken("bilbo", "laptop", user.TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	middle := authMiddleware{logger: log.New(ioutil.Discard, "", 0)}
+	var id *auth.Identity
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = auth.FromContext(r.Context())
+	})
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/repository/myapp/tree", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(id, check.DeepEquals, &auth.Identity{Name: "bilbo", User: "bilbo", Scope: auth.ScopeReadOnly})
+	recorder = httptest.NewRecorder()
+	request, err = http.NewRequest("DELETE", "/repository/myapp", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	recorder = httptest.NewRecorder()
+	request, err = http.NewRequest("GET", "/repository/myapp/tree", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer "+user.TokenPrefix+"0123")
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *S) TestAuthMiddlewareUserTokenWriteScope(c *check.C) {
+	defer s.setAPICredentials()()
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	_, token, err := user.NewToken("bilbo", "laptop", user.TokenScopeWrite, time.Time{})
+	c.Assert(err, check.IsNil)
+	middle := authMiddleware{logger: log.New(ioutil.Discard, "", 0)}
+	var id *auth.Identity
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = auth.FromContext(r.Context())
+	})
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("POST", "/repository/myapp/commit", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(id, check.DeepEquals, &auth.Identity{Name: "bilbo", User: "bilbo", Scope: auth.ScopeCommit})
+	recorder = httptest.NewRecorder()
+	request, err = http.NewRequest("DELETE", "/repository/myapp", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+}
+
+func (s *S) TestAuthMiddlewareUserTokenOtherResources(c *check.C) {
+	defer s.setAPICredentials()()
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	_, token, err := user.NewToken("bilbo", "laptop", user.TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	middle := authMiddleware{logger: log.New(ioutil.Discard, "", 0)}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	paths := []string{
+		"/audit/changes",
+		"/user/frodo/keys",
+		"/user/frodo/tokens",
+		"/user/frodo/audit",
+		"/repository/myapp/audit",
+		"/repository/myapp",
+	}
+	for _, path := range paths {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", path, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+		c.Check(recorder.Code, check.Equals, http.StatusForbidden, check.Commentf(path))
+	}
+	recorder := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "/user/bilbo/tokens", nil)
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+}
+
+func (s *S) TestAuthMiddlewareUserTokenNamespaceOwner(c *check.C) {
+	defer s.setAPICredentials()()
+	_, err := user.New("bilbo", map[string]string{})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	_, err = repository.NewNamespace("team", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer repository.RemoveNamespace("team")
+	_, err = repository.NewNamespace("other", []string{"frodo"})
+	c.Assert(err, check.IsNil)
+	defer repository.RemoveNamespace("other")
+	_, token, err := user.NewToken("bilbo", "laptop", user.TokenScopeWrite, time.Time{})
+	c.Assert(err, check.IsNil)
+	middle := authMiddleware{logger: log.New(ioutil.Discard, "", 0)}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/namespace/team", http.StatusOK},
+		{"POST", "/namespace/team/grant", http.StatusOK},
+		{"DELETE", "/namespace/team/revoke", http.StatusOK},
+		{"POST", "/namespace/team/owner/frodo", http.StatusOK},
+		{"PUT", "/namespace/team/allowed-sources", http.StatusOK},
+		{"DELETE", "/namespace/team", http.StatusForbidden},
+		{"DELETE", "/namespace/team/grant", http.StatusForbidden},
+		{"POST", "/namespace/other/grant", http.StatusForbidden},
+		{"GET", "/namespace/other", http.StatusForbidden},
+	}
+	for _, t := range tests {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest(t.method, t.path, nil)
+		c.Assert(err, check.IsNil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		middle.ServeHTTP(negroni.NewResponseWriter(recorder), request, handler)
+		c.Check(recorder.Code, check.Equals, t.code, check.Commentf("%s %s", t.method, t.path))
+	}
+}
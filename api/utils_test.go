@@ -13,6 +13,7 @@ import (
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
 	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/gandalf/hook"
 	"github.com/tsuru/gandalf/user"
 	"github.com/tsuru/tsuru/fs/fstest"
 	"gopkg.in/check.v1"
@@ -33,6 +34,8 @@ func (s *S) SetUpSuite(c *check.C) {
 	c.Assert(err, check.IsNil)
 	config.Set("database:url", "127.0.0.1:27017")
 	config.Set("database:name", "gandalf_api_tests")
+	// git is only checked once, before it's mocked.
+	c.Assert(hook.CheckGitVersion(), check.IsNil)
 	s.tmpdir, err = commandmocker.Add("git", "")
 	c.Assert(err, check.IsNil)
 	s.router = SetupRouter()
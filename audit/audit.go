@@ -0,0 +1,200 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package audit records the git operations run by users in repositories:
+// who fetched from or pushed to which repository, from where and when, with
+// the refs updated by pushes and the operations that were denied. It also
+// records the changes made through the API.
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+)
+
+// DefaultLimit is the maximum number of operations returned by List when the
+// filter doesn't set one.
+const DefaultLimit = 100
+
+// MaxLimit is the maximum number of operations returned by List, and of
+// changes returned by ListChanges, larger limits are capped to it.
+const MaxLimit = 1000
+
+// pageLimit returns the limit of a page of results, given the limit of a
+// filter.
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultLimit
+	}
+	if limit > MaxLimit {
+		return MaxLimit
+	}
+	return limit
+}
+
+// RefUpdate is the change of a ref in a push.
+type RefUpdate struct {
+	Ref    string `json:"ref"`
+	OldRev string `json:"oldRev"`
+	NewRev string `json:"newRev"`
+}
+
+// Operation is a git operation run by a user in a repository. Denied has the
+// reason when the operation was not allowed to run.
+type Operation struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	User           string        `json:"user"`
+	KeyName        string        `json:"keyName,omitempty"`
+	KeyFingerprint string        `json:"keyFingerprint,omitempty"`
+	Principal      string        `json:"principal,omitempty"`
+	Repository     string        `json:"repository"`
+	Action         string        `json:"action"`
+	ClientAddress  string        `json:"clientAddress"`
+	StartedAt      time.Time     `json:"startedAt"`
+	FinishedAt     time.Time     `json:"finishedAt"`
+	ExitStatus     int           `json:"exitStatus"`
+	Denied         string        `json:"denied,omitempty"`
+	RefUpdates     []RefUpdate   `json:"refUpdates,omitempty"`
+	refsFile       string
+}
+
+// Filter selects the operations returned by List. Empty fields match any
+// operation.
+type Filter struct {
+	Repository string
+	User       string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+// Start starts the audit of the operation of the session, which is only
+// stored when it finishes or is denied.
+func Start(session repository.Session) *Operation {
+	return &Operation{
+		ID:             bson.NewObjectId(),
+		User:           session.User,
+		KeyName:        session.KeyName,
+		KeyFingerprint: session.KeyFingerprint,
+		Principal:      session.Principal,
+		Repository:     session.Repository,
+		Action:         session.Action,
+		ClientAddress:  session.ClientAddress,
+		StartedAt:      time.Now(),
+	}
+}
+
+// WatchRefs makes the post-receive hook of a push record the refs it
+// updated, so Finish stores them. The hook appends them to a file named by
+// GANDALF_REF_UPDATES, in the returned environment of git-receive-pack: it
+// only sees the refs of this push, even when other pushes to the repository
+// run at the same time.
+func (op *Operation) WatchRefs() ([]string, error) {
+	f, err := ioutil.TempFile("", "gandalf-refs")
+	if err != nil {
+		return nil, err
+	}
+	op.refsFile = f.Name()
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	return []string{"GANDALF_REF_UPDATES=" + op.refsFile}, nil
+}
+
+// Finish stores the operation with its exit status. When the refs were
+// watched, the refs updated by the operation are stored too; the operation
+// is stored even if they can't be read, and the error is returned after
+// that.
+func (op *Operation) Finish(exitStatus int) error {
+	op.FinishedAt = time.Now()
+	op.ExitStatus = exitStatus
+	var refsErr error
+	if op.refsFile != "" {
+		var data []byte
+		if data, refsErr = ioutil.ReadFile(op.refsFile); refsErr == nil {
+			op.RefUpdates = ParseRefUpdates(string(data))
+		}
+		os.Remove(op.refsFile)
+	}
+	if err := op.save(); err != nil {
+		return err
+	}
+	return refsErr
+}
+
+// Deny stores the operation as denied, for the given reason.
+func (op *Operation) Deny(reason string) error {
+	op.FinishedAt = time.Now()
+	op.ExitStatus = 1
+	op.Denied = reason
+	return op.save()
+}
+
+func (op *Operation) save() error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Audit().Insert(op)
+}
+
+// ParseRefUpdates parses the ref updates received by the post-receive hook,
+// one per line in the form "<old revision> <new revision> <ref>", returning
+// them sorted by ref name. Malformed lines are skipped.
+func ParseRefUpdates(input string) []RefUpdate {
+	var updates []RefUpdate
+	for _, line := range strings.Split(input, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		updates = append(updates, RefUpdate{Ref: fields[2], OldRev: fields[0], NewRev: fields[1]})
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Ref < updates[j].Ref
+	})
+	return updates
+}
+
+// List returns the operations that match the filter, the most recent first.
+func List(filter Filter) ([]Operation, error) {
+	q := bson.M{}
+	if filter.Repository != "" {
+		q["repository"] = filter.Repository
+	}
+	if filter.User != "" {
+		q["user"] = filter.User
+	}
+	startedAt := bson.M{}
+	if !filter.Since.IsZero() {
+		startedAt["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		startedAt["$lt"] = filter.Until
+	}
+	if len(startedAt) > 0 {
+		q["startedat"] = startedAt
+	}
+	limit := pageLimit(filter.Limit)
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	operations := []Operation{}
+	err = conn.Audit().Find(q).Sort("-startedat").Skip(filter.Offset).Limit(limit).All(&operations)
+	if err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Check(err, check.IsNil)
+	config.Set("database:name", "gandalf_audit_tests")
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	conn, err := db.Conn()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Audit().RemoveAll(nil)
+	conn.APIAudit().RemoveAll(nil)
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.Audit().Database.DropDatabase()
+}
+
+func (s *S) TestStart(c *check.C) {
+	session := repository.Session{
+		User:           "bilbo",
+		KeyName:        "deploy",
+		KeyFingerprint: "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM",
+		Repository:     "myapp",
+		Action:         "git-upload-pack",
+		ClientAddress:  "192.168.50.1",
+	}
+	op := Start(session)
+	c.Assert(op.ID.Valid(), check.Equals, true)
+	c.Assert(op.User, check.Equals, "bilbo")
+	c.Assert(op.KeyName, check.Equals, "deploy")
+	c.Assert(op.KeyFingerprint, check.Equals, session.KeyFingerprint)
+	c.Assert(op.Repository, check.Equals, "myapp")
+	c.Assert(op.Action, check.Equals, "git-upload-pack")
+	c.Assert(op.ClientAddress, check.Equals, "192.168.50.1")
+	c.Assert(op.StartedAt.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestParseRefUpdates(c *check.C) {
+	input := `4444444444444444444444444444444444444444 0000000000000000000000000000000000000000 refs/heads/feature
+0000000000000000000000000000000000000000 5555555555555555555555555555555555555555 refs/heads/fix
+1111111111111111111111111111111111111111 4444444444444444444444444444444444444444 refs/heads/master
+
+malformed line
+`
+	expected := []RefUpdate{
+		{Ref: "refs/heads/feature", OldRev: "4444444444444444444444444444444444444444", NewRev: "0000000000000000000000000000000000000000"},
+		{Ref: "refs/heads/fix", OldRev: "0000000000000000000000000000000000000000", NewRev: "5555555555555555555555555555555555555555"},
+		{Ref: "refs/heads/master", OldRev: "1111111111111111111111111111111111111111", NewRev: "4444444444444444444444444444444444444444"},
+	}
+	c.Assert(ParseRefUpdates(input), check.DeepEquals, expected)
+	c.Assert(ParseRefUpdates(""), check.HasLen, 0)
+}
+
+func (s *S) TestFinishWithWatchedRefs(c *check.C) {
+	op := Start(repository.Session{User: "bilbo", Repository: "myapp", Action: "git-receive-pack"})
+	env, err := op.WatchRefs()
+	c.Assert(err, check.IsNil)
+	c.Assert(env, check.HasLen, 1)
+	c.Assert(strings.HasPrefix(env[0], "GANDALF_REF_UPDATES="), check.Equals, true)
+	refsFile := strings.TrimPrefix(env[0], "GANDALF_REF_UPDATES=")
+	update := "1111111111111111111111111111111111111111 2222222222222222222222222222222222222222 refs/heads/master\n"
+	err = ioutil.WriteFile(refsFile, []byte(update), 0600)
+	c.Assert(err, check.IsNil)
+	err = op.Finish(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(op.RefUpdates, check.DeepEquals, []RefUpdate{{Ref: "refs/heads/master", OldRev: "1111111111111111111111111111111111111111", NewRev: "2222222222222222222222222222222222222222"}})
+	_, err = os.Stat(refsFile)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestPageLimit(c *check.C) {
+	c.Assert(pageLimit(0), check.Equals, DefaultLimit)
+	c.Assert(pageLimit(-1), check.Equals, DefaultLimit)
+	c.Assert(pageLimit(50), check.Equals, 50)
+	c.Assert(pageLimit(MaxLimit+1), check.Equals, MaxLimit)
+}
+
+func (s *S) TestFinish(c *check.C) {
+	op := Start(repository.Session{User: "bilbo", Repository: "myapp", Action: "git-upload-pack"})
+	err := op.Finish(0)
+	c.Assert(err, check.IsNil)
+	operations, err := List(Filter{Repository: "myapp"})
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].ID, check.Equals, op.ID)
+	c.Assert(operations[0].User, check.Equals, "bilbo")
+	c.Assert(operations[0].ExitStatus, check.Equals, 0)
+	c.Assert(operations[0].Denied, check.Equals, "")
+	c.Assert(operations[0].FinishedAt.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestDeny(c *check.C) {
+	op := Start(repository.Session{User: "bilbo", Repository: "myapp", Action: "git-receive-pack"})
+	err := op.Deny("You don't have access to write in this repository.")
+	c.Assert(err, check.IsNil)
+	operations, err := List(Filter{User: "bilbo"})
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].ExitStatus, check.Equals, 1)
+	c.Assert(operations[0].Denied, check.Equals, "You don't have access to write in this repository.")
+}
+
+func (s *S) TestList(c *check.C) {
+	now := time.Now()
+	for i, name := range []string{"bilbo", "frodo", "bilbo"} {
+		op := Start(repository.Session{User: name, Repository: "myapp", Action: "git-upload-pack"})
+		op.StartedAt = now.Add(time.Duration(i-3) * time.Hour)
+		err := op.Finish(0)
+		c.Assert(err, check.IsNil)
+	}
+	op := Start(repository.Session{User: "bilbo", Repository: "otherapp", Action: "git-upload-pack"})
+	err := op.Finish(0)
+	c.Assert(err, check.IsNil)
+	operations, err := List(Filter{Repository: "myapp"})
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 3)
+	c.Assert(operations[0].StartedAt.After(operations[1].StartedAt), check.Equals, true)
+	operations, err = List(Filter{Repository: "myapp", User: "bilbo"})
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 2)
+	operations, err = List(Filter{Repository: "myapp", Since: now.Add(-150 * time.Minute)})
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 2)
+	operations, err = List(Filter{Repository: "myapp", Until: now.Add(-150 * time.Minute)})
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].User, check.Equals, "bilbo")
+}
+
+func (s *S) TestListPagination(c *check.C) {
+	now := time.Now()
+	for _, name := range []string{"bilbo", "frodo", "sam"} {
+		op := Start(repository.Session{User: name, Repository: "myapp", Action: "git-upload-pack"})
+		op.StartedAt = now
+		now = now.Add(-time.Minute)
+		err := op.Finish(0)
+		c.Assert(err, check.IsNil)
+	}
+	operations, err := List(Filter{Repository: "myapp", Limit: 2})
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 2)
+	c.Assert(operations[0].User, check.Equals, "bilbo")
+	operations, err = List(Filter{Repository: "myapp", Limit: 2, Offset: 2})
+	c.Assert(err, check.IsNil)
+	c.Assert(operations, check.HasLen, 1)
+	c.Assert(operations[0].User, check.Equals, "sam")
+}
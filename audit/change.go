@@ -0,0 +1,88 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+)
+
+// Change is a change made through the API: who requested it, the request and
+// the status of the response. Body has the request body, with the key
+// material removed.
+type Change struct {
+	ID            bson.ObjectId `bson:"_id" json:"id"`
+	Actor         string        `json:"actor,omitempty"`
+	RemoteAddress string        `json:"remoteAddress"`
+	Method        string        `json:"method"`
+	Target        string        `json:"target"`
+	Body          string        `json:"body,omitempty"`
+	Status        int           `json:"status"`
+	Time          time.Time     `json:"time"`
+}
+
+// ChangeFilter selects the changes returned by ListChanges. Empty fields match
+// any change. Target matches the changes whose target starts with it.
+type ChangeFilter struct {
+	Actor  string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
+}
+
+// RecordChange stores a change made through the API.
+func RecordChange(change Change) error {
+	if change.ID == "" {
+		change.ID = bson.NewObjectId()
+	}
+	if change.Time.IsZero() {
+		change.Time = time.Now()
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.APIAudit().Insert(change)
+}
+
+// ListChanges returns the changes that match the filter, the most recent
+// first.
+func ListChanges(filter ChangeFilter) ([]Change, error) {
+	q := bson.M{}
+	if filter.Actor != "" {
+		q["actor"] = filter.Actor
+	}
+	if filter.Target != "" {
+		q["target"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(filter.Target)}
+	}
+	changedAt := bson.M{}
+	if !filter.Since.IsZero() {
+		changedAt["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		changedAt["$lt"] = filter.Until
+	}
+	if len(changedAt) > 0 {
+		q["time"] = changedAt
+	}
+	limit := pageLimit(filter.Limit)
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	changes := []Change{}
+	err = conn.APIAudit().Find(q).Sort("-time").Skip(filter.Offset).Limit(limit).All(&changes)
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
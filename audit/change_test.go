@@ -0,0 +1,64 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestRecordChange(c *check.C) {
+	err := RecordChange(Change{
+		Actor:         "gandalf",
+		RemoteAddress: "192.168.50.1:5312",
+		Method:        "DELETE",
+		Target:        "/user/bilbo",
+		Status:        200,
+	})
+	c.Assert(err, check.IsNil)
+	changes, err := ListChanges(ChangeFilter{})
+	c.Assert(err, check.IsNil)
+	c.Assert(changes, check.HasLen, 1)
+	c.Assert(changes[0].ID.Valid(), check.Equals, true)
+	c.Assert(changes[0].Actor, check.Equals, "gandalf")
+	c.Assert(changes[0].Method, check.Equals, "DELETE")
+	c.Assert(changes[0].Target, check.Equals, "/user/bilbo")
+	c.Assert(changes[0].Status, check.Equals, 200)
+	c.Assert(changes[0].Time.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestListChanges(c *check.C) {
+	now := time.Now()
+	changes := []Change{
+		{Actor: "gandalf", Method: "PUT", Target: "/repository/myapp", Time: now.Add(-3 * time.Hour)},
+		{Actor: "saruman", Method: "DELETE", Target: "/repository/revoke", Time: now.Add(-2 * time.Hour)},
+		{Actor: "gandalf", Method: "POST", Target: "/repository/myapp.git/x", Time: now.Add(-time.Hour)},
+		{Actor: "gandalf", Method: "POST", Target: "/user", Time: now},
+	}
+	for _, change := range changes {
+		err := RecordChange(change)
+		c.Assert(err, check.IsNil)
+	}
+	result, err := ListChanges(ChangeFilter{Actor: "gandalf"})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 3)
+	c.Assert(result[0].Target, check.Equals, "/user")
+	result, err = ListChanges(ChangeFilter{Target: "/repository/myapp"})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 2)
+	result, err = ListChanges(ChangeFilter{Target: "/repository/myapp.git"})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 1)
+	result, err = ListChanges(ChangeFilter{Since: now.Add(-150 * time.Minute), Until: now.Add(-time.Minute)})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 2)
+	c.Assert(result[0].Target, check.Equals, "/repository/myapp.git/x")
+	result, err = ListChanges(ChangeFilter{Limit: 1, Offset: 3})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.HasLen, 1)
+	c.Assert(result[0].Actor, check.Equals, "gandalf")
+	c.Assert(result[0].Method, check.Equals, "PUT")
+}
@@ -0,0 +1,366 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package auth authenticates and authorizes requests to the Gandalf API.
+//
+// Requests are authenticated by a list of authenticators, each one handling a
+// kind of credential: static tokens and HMAC-signed requests. The identity of
+// an authenticated request has a scope, which limits the requests it may
+// perform.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingCredentials = errors.New("Authentication required.")
+	ErrInvalidCredentials = errors.New("Invalid credentials.")
+	ErrSignatureExpired   = errors.New("The request signature has expired, check the Date header.")
+	ErrForbidden          = errors.New("The credentials are not allowed to perform this request.")
+)
+
+// MaxClockSkew is the maximum difference between the Date of a signed request
+// and the time it's received.
+const MaxClockSkew = 5 * time.Minute
+
+// Scope limits the requests an identity may perform.
+type Scope string
+
+const (
+	// ScopeAdmin allows any request.
+	ScopeAdmin = Scope("admin")
+	// ScopeReadOnly allows only GET and HEAD requests.
+	ScopeReadOnly = Scope("read-only")
+	// ScopeUserAdmin allows reads and changes to users, their keys, groups
+	// and certificate authorities.
+	ScopeUserAdmin = Scope("user-admin")
+	// ScopeRepositoryAdmin allows reads and changes to repositories and
+	// namespaces.
+	ScopeRepositoryAdmin = Scope("repository-admin")
+	// ScopeCommit allows reads and commits to repositories through the API.
+	ScopeCommit = Scope("commit")
+)
+
+var scopePrefixes = map[Scope][]string{
+	ScopeUserAdmin:       {"/user", "/group", "/authority", "/keys", "/key"},
+	ScopeRepositoryAdmin: {"/repository", "/namespace"},
+}
+
+// commitPath matches the path of commits to repositories through the API,
+// with the same repository name pattern as the router.
+var commitPath = regexp.MustCompile(`^/repository/[^/]*/?[^/]+/commit$`)
+
+// contentPath matches the paths of the content endpoints of repositories and
+// of commits, with the same repository name pattern as the router.
+var contentPath = regexp.MustCompile(`^/repository/[^/]*/?[^/]+/(archive|contents|tree|branches|tags|diff/commits|logs|commit)$`)
+
+// exemptRoutes are the routes that don't require authentication: the
+// healthcheck and git's smart HTTP protocol, which authenticates users by
+// itself. Paths are anchored at both ends and use the same repository name
+// pattern as the router, which matches routes by prefix, so paths of other
+// routes with a git suffix appended are not exempt.
+var exemptRoutes = []struct {
+	methods []string
+	path    *regexp.Regexp
+}{
+	{[]string{"GET", "HEAD"}, regexp.MustCompile(`^/healthcheck$`)},
+	{[]string{"GET", "HEAD"}, regexp.MustCompile(`^/[^/]*/?[^/]+\.git/info/refs$`)},
+	{[]string{"POST"}, regexp.MustCompile(`^/[^/]*/?[^/]+\.git/(git-upload-pack|git-receive-pack)$`)},
+}
+
+// namespaceRoutes are the routes that manage a namespace, which the owners of
+// the namespace may reach with personal access tokens: reads with any token,
+// changes with tokens that allow writes. The first submatch of the path is
+// the name of the namespace. Paths are anchored at both ends and the methods
+// are checked, as the router matches routes by prefix: removing a namespace
+// stays with the administrators.
+var namespaceRoutes = []struct {
+	methods []string
+	path    *regexp.Regexp
+}{
+	{[]string{"GET", "HEAD"}, regexp.MustCompile(`^/namespace/([^/]+)$`)},
+	{[]string{"POST", "DELETE"}, regexp.MustCompile(`^/namespace/([^/]+)/owner/[^/]+$`)},
+	{[]string{"POST"}, regexp.MustCompile(`^/namespace/([^/]+)/grant$`)},
+	{[]string{"DELETE"}, regexp.MustCompile(`^/namespace/([^/]+)/revoke$`)},
+	{[]string{"PUT"}, regexp.MustCompile(`^/namespace/([^/]+)/allowed-sources$`)},
+}
+
+// ParseScope parses the name of a scope. An empty name is the admin scope.
+func ParseScope(name string) (Scope, error) {
+	if name == "" {
+		return ScopeAdmin, nil
+	}
+	scope := Scope(name)
+	switch scope {
+	case ScopeAdmin, ScopeReadOnly, ScopeUserAdmin, ScopeRepositoryAdmin, ScopeCommit:
+		return scope, nil
+	}
+	return "", fmt.Errorf("invalid scope %q, it must be one of admin, read-only, user-admin, repository-admin or commit", name)
+}
+
+// Allows returns whether the scope allows a request with the given method to
+// the given path.
+func (s Scope) Allows(method, path string) bool {
+	if s == ScopeAdmin || method == "GET" || method == "HEAD" {
+		return true
+	}
+	if s == ScopeCommit {
+		return method == "POST" && commitPath.MatchString(path)
+	}
+	for _, prefix := range scopePrefixes[s] {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity is the identity of an authenticated request. User is the name of
+// the gandalf user the request acts for, when it's authenticated with a
+// personal access token, and Namespaces has the names of the namespaces owned
+// by the user.
+type Identity struct {
+	Name       string
+	User       string
+	Scope      Scope
+	Namespaces []string
+}
+
+// Allows returns whether the identity may perform a request with the given
+// method to the given path. Identities that act for a user, besides being
+// limited by their scope, only reach the content endpoints of repositories,
+// which check the access of the user, the resources of the user itself and
+// the namespaceRoutes of the namespaces owned by the user. Tokens that allow
+// writes have the commit scope.
+func (id *Identity) Allows(method, path string) bool {
+	if id.User != "" && id.managesNamespace(method, path) {
+		return method == "GET" || method == "HEAD" || id.Scope == ScopeCommit
+	}
+	if !id.Scope.Allows(method, path) {
+		return false
+	}
+	if id.User == "" {
+		return true
+	}
+	userPath := "/user/" + id.User
+	return contentPath.MatchString(path) || path == userPath || strings.HasPrefix(path, userPath+"/")
+}
+
+// managesNamespace returns whether the request is to one of the
+// namespaceRoutes of a namespace in id.Namespaces.
+func (id *Identity) managesNamespace(method, path string) bool {
+	for _, route := range namespaceRoutes {
+		m := route.path.FindStringSubmatch(path)
+		if m == nil || !contains(route.methods, method) {
+			continue
+		}
+		return contains(id.Namespaces, m[1])
+	}
+	return false
+}
+
+// Credential is a secret shared with an API client: a static token or the
+// key of HMAC signatures.
+type Credential struct {
+	Name   string
+	Secret string
+	Scope  Scope
+}
+
+func (c *Credential) identity() *Identity {
+	return &Identity{Name: c.Name, Scope: c.Scope}
+}
+
+// Authenticator authenticates requests carrying a kind of credential. It
+// returns a nil identity and a nil error when the request doesn't carry its
+// kind of credential.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Authenticate authenticates the request with the first authenticator that
+// handles its credentials.
+func Authenticate(r *http.Request, authenticators ...Authenticator) (*Identity, error) {
+	for _, a := range authenticators {
+		id, err := a.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if id != nil {
+			return id, nil
+		}
+	}
+	return nil, ErrMissingCredentials
+}
+
+// Authorize authenticates the request and checks whether its identity is
+// allowed to perform it. It returns a nil identity for requests that don't
+// require authentication.
+func Authorize(r *http.Request, authenticators ...Authenticator) (*Identity, error) {
+	if exempt(r) {
+		return nil, nil
+	}
+	id, err := Authenticate(r, authenticators...)
+	if err != nil {
+		return nil, err
+	}
+	if !id.Allows(r.Method, r.URL.Path) {
+		return id, ErrForbidden
+	}
+	return id, nil
+}
+
+// exempt returns whether the request is to one of the exemptRoutes.
+func exempt(r *http.Request) bool {
+	for _, route := range exemptRoutes {
+		if route.path.MatchString(r.URL.Path) && contains(route.methods, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the HTTP status of an error returned by Authorize.
+func Status(err error) int {
+	if err == ErrForbidden {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the identity.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity carried by ctx, if any.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// TokenAuthenticator authenticates requests carrying a static token in the
+// Authorization header, in the form "Authorization: Bearer <token>".
+type TokenAuthenticator []Credential
+
+func (a TokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token, ok := authorization(r, "Bearer")
+	if !ok {
+		return nil, nil
+	}
+	for i := range a {
+		if subtle.ConstantTimeCompare([]byte(a[i].Secret), []byte(token)) == 1 {
+			return a[i].identity(), nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// HMACAuthenticator authenticates requests signed with Sign.
+type HMACAuthenticator []Credential
+
+func (a HMACAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	value, ok := authorization(r, "HMAC")
+	if !ok {
+		return nil, nil
+	}
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCredentials
+	}
+	var credential *Credential
+	for i := range a {
+		if a[i].Name == parts[0] {
+			credential = &a[i]
+			break
+		}
+	}
+	if credential == nil {
+		return nil, ErrInvalidCredentials
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return nil, ErrSignatureExpired
+	}
+	if skew := time.Since(date); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, ErrSignatureExpired
+	}
+	signature, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	expected, err := sign(r, credential.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(signature, expected) {
+		return nil, ErrInvalidCredentials
+	}
+	return credential.identity(), nil
+}
+
+// Sign signs the request with the key of the named credential, setting its
+// Date and Authorization headers. The signature is the HMAC-SHA256 of the
+// method, the request URI, the date and the SHA-256 of the body, separated by
+// new lines, and the Authorization header has the form
+// "Authorization: HMAC <name>:<hex encoded signature>".
+func Sign(r *http.Request, name, secret string) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	signature, err := sign(r, secret)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", fmt.Sprintf("HMAC %s:%x", name, signature))
+	return nil
+}
+
+func sign(r *http.Request, secret string) ([]byte, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%x", r.Method, r.URL.RequestURI(), r.Header.Get("Date"), bodySum)
+	return mac.Sum(nil), nil
+}
+
+// authorization returns the value of the Authorization header of the request
+// when it uses the given scheme.
+func authorization(r *http.Request, scheme string) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)+1], scheme+" ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(scheme)+1:]), true
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+var authenticators = []Authenticator{
+	TokenAuthenticator{
+		{Name: "tsuru", Secret: "admin-token", Scope: ScopeAdmin},
+		{Name: "dashboard", Secret: "read-token", Scope: ScopeReadOnly},
+	},
+	HMACAuthenticator{
+		{Name: "ci", Secret: "hmac-secret", Scope: ScopeRepositoryAdmin},
+	},
+}
+
+func (s *S) TestParseScope(c *check.C) {
+	scope, err := ParseScope("")
+	c.Assert(err, check.IsNil)
+	c.Assert(scope, check.Equals, ScopeAdmin)
+	for _, name := range []string{"admin", "read-only", "user-admin", "repository-admin", "commit"} {
+		scope, err = ParseScope(name)
+		c.Check(err, check.IsNil)
+		c.Check(scope, check.Equals, Scope(name))
+	}
+	_, err = ParseScope("root")
+	c.Assert(err, check.ErrorMatches, `invalid scope "root", .*`)
+}
+
+func (s *S) TestScopeAllows(c *check.C) {
+	tests := []struct {
+		scope   Scope
+		method  string
+		path    string
+		allowed bool
+	}{
+		{ScopeAdmin, "POST", "/hook/post-receive", true},
+		{ScopeReadOnly, "GET", "/repository/myapp", true},
+		{ScopeReadOnly, "HEAD", "/repository/myapp", true},
+		{ScopeReadOnly, "DELETE", "/repository/myapp", false},
+		{ScopeUserAdmin, "POST", "/user", true},
+		{ScopeUserAdmin, "DELETE", "/user/bilbo/key/ring", true},
+		{ScopeUserAdmin, "POST", "/authority", true},
+		{ScopeUserAdmin, "POST", "/users", false},
+		{ScopeUserAdmin, "PUT", "/repository/myapp", false},
+		{ScopeRepositoryAdmin, "PUT", "/repository/myapp", true},
+		{ScopeRepositoryAdmin, "POST", "/namespace/team/grant", true},
+		{ScopeRepositoryAdmin, "POST", "/user", false},
+		{ScopeRepositoryAdmin, "POST", "/hook/post-receive", false},
+		{ScopeCommit, "GET", "/repository/myapp/tree", true},
+		{ScopeCommit, "POST", "/repository/myapp/commit", true},
+		{ScopeCommit, "POST", "/repository/team/myapp/commit", true},
+		{ScopeCommit, "PUT", "/repository/myapp/commit", false},
+		{ScopeCommit, "POST", "/repository/myapp", false},
+		{ScopeCommit, "POST", "/repository/grant/x/y/commit", false},
+		{ScopeCommit, "POST", "/repository/a/b/c/commit", false},
+	}
+	for _, t := range tests {
+		c.Check(t.scope.Allows(t.method, t.path), check.Equals, t.allowed, check.Commentf("%s %s %s", t.scope, t.method, t.path))
+	}
+}
+
+func (s *S) TestTokenAuthenticator(c *check.C) {
+	request, _ := http.NewRequest("GET", "/repository/myapp", nil)
+	request.Header.Set("Authorization", "Bearer read-token")
+	id, err := Authenticate(request, authenticators...)
+	c.Assert(err, check.IsNil)
+	c.Assert(id, check.DeepEquals, &Identity{Name: "dashboard", Scope: ScopeReadOnly})
+	request.Header.Set("Authorization", "bearer admin-token")
+	id, err = Authenticate(request, authenticators...)
+	c.Assert(err, check.IsNil)
+	c.Assert(id.Name, check.Equals, "tsuru")
+	request.Header.Set("Authorization", "Bearer wrong-token")
+	id, err = Authenticate(request, authenticators...)
+	c.Assert(err, check.Equals, ErrInvalidCredentials)
+	c.Assert(id, check.IsNil)
+}
+
+func (s *S) TestAuthenticateMissingCredentials(c *check.C) {
+	request, _ := http.NewRequest("GET", "/repository/myapp", nil)
+	_, err := Authenticate(request, authenticators...)
+	c.Assert(err, check.Equals, ErrMissingCredentials)
+	request.Header.Set("Authorization", "Basic YmlsYm86cmluZw==")
+	_, err = Authenticate(request, authenticators...)
+	c.Assert(err, check.Equals, ErrMissingCredentials)
+}
+
+func (s *S) TestHMACAuthenticator(c *check.C) {
+	request, _ := http.NewRequest("PUT", "http://gandalf:8000/repository/myapp?force=1", strings.NewReader(`{"name":"otherapp"}`))
+	err := Sign(request, "ci", "hmac-secret")
+	c.Assert(err, check.IsNil)
+	c.Assert(request.Header.Get("Authorization"), check.Matches, `HMAC ci:[0-9a-f]{64}`)
+	id, err := Authenticate(request, authenticators...)
+	c.Assert(err, check.IsNil)
+	c.Assert(id, check.DeepEquals, &Identity{Name: "ci", Scope: ScopeRepositoryAdmin})
+	body, err := ioutil.ReadAll(request.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, `{"name":"otherapp"}`)
+}
+
+func (s *S) TestHMACAuthenticatorInvalidSignature(c *check.C) {
+	request, _ := http.NewRequest("PUT", "/repository/myapp", strings.NewReader(`{"name":"otherapp"}`))
+	err := Sign(request, "ci", "hmac-secret")
+	c.Assert(err, check.IsNil)
+	request.Body = ioutil.NopCloser(strings.NewReader(`{"name":"evilapp"}`))
+	_, err = Authenticate(request, authenticators...)
+	c.Assert(err, check.Equals, ErrInvalidCredentials)
+	err = Sign(request, "ci", "wrong-secret")
+	c.Assert(err, check.IsNil)
+	_, err = Authenticate(request, authenticators...)
+	c.Assert(err, check.Equals, ErrInvalidCredentials)
+	err = Sign(request, "unknown", "hmac-secret")
+	c.Assert(err, check.IsNil)
+	_, err = Authenticate(request, authenticators...)
+	c.Assert(err, check.Equals, ErrInvalidCredentials)
+}
+
+func (s *S) TestHMACAuthenticatorExpiredSignature(c *check.C) {
+	request, _ := http.NewRequest("GET", "/repository/myapp", nil)
+	request.Header.Set("Date", time.Now().Add(-MaxClockSkew-time.Minute).UTC().Format(http.TimeFormat))
+	signature, err := sign(request, "hmac-secret")
+	c.Assert(err, check.IsNil)
+	request.Header.Set("Authorization", fmt.Sprintf("HMAC ci:%x", signature))
+	_, err = Authenticate(request, authenticators...)
+	c.Assert(err, check.Equals, ErrSignatureExpired)
+}
+
+func (s *S) TestAuthorize(c *check.C) {
+	request, _ := http.NewRequest("DELETE", "/repository/myapp", nil)
+	request.Header.Set("Authorization", "Bearer read-token")
+	id, err := Authorize(request, authenticators...)
+	c.Assert(err, check.Equals, ErrForbidden)
+	c.Assert(id.Name, check.Equals, "dashboard")
+	c.Assert(Status(err), check.Equals, http.StatusForbidden)
+	request.Header.Set("Authorization", "Bearer admin-token")
+	id, err = Authorize(request, authenticators...)
+	c.Assert(err, check.IsNil)
+	c.Assert(id.Name, check.Equals, "tsuru")
+	request.Header.Del("Authorization")
+	_, err = Authorize(request, authenticators...)
+	c.Assert(err, check.Equals, ErrMissingCredentials)
+	c.Assert(Status(err), check.Equals, http.StatusUnauthorized)
+}
+
+func (s *S) TestIdentityAllows(c *check.C) {
+	tests := []struct {
+		id      Identity
+		method  string
+		path    string
+		allowed bool
+	}{
+		{Identity{Name: "dashboard", Scope: ScopeReadOnly}, "GET", "/audit/changes", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/repository/myapp/tree", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/repository/team/myapp/diff/commits", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/user/bilbo/keys", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/user/bilbo/tokens", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/audit/changes", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/user/frodo/keys", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/user/frodo/tokens", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/user/frodo/audit", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/user/bilbofrodo/keys", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/repository/myapp/audit", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/repository/myapp", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "POST", "/repository/myapp/commit", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit}, "POST", "/repository/myapp/commit", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit}, "POST", "/user/bilbo/tokens", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly, Namespaces: []string{"team"}}, "GET", "/namespace/team", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly, Namespaces: []string{"team"}}, "POST", "/namespace/team/grant", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeReadOnly}, "GET", "/namespace/team", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "POST", "/namespace/team/grant", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "DELETE", "/namespace/team/revoke", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "POST", "/namespace/team/owner/frodo", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "DELETE", "/namespace/team/owner/frodo", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "PUT", "/namespace/team/allowed-sources", true},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "DELETE", "/namespace/team", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "DELETE", "/namespace/team/grant", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "POST", "/namespace/team/grant/", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "POST", "/namespace", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit, Namespaces: []string{"team"}}, "POST", "/namespace/other/grant", false},
+		{Identity{Name: "bilbo", User: "bilbo", Scope: ScopeCommit}, "POST", "/namespace/team/grant", false},
+		{Identity{Name: "deploy", Scope: ScopeCommit, Namespaces: []string{"team"}}, "POST", "/namespace/team/grant", false},
+	}
+	for _, t := range tests {
+		c.Check(t.id.Allows(t.method, t.path), check.Equals, t.allowed, check.Commentf("%s %s %s", t.id.Name, t.method, t.path))
+	}
+}
+
+func (s *S) TestAuthorizeExemptPaths(c *check.C) {
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/healthcheck"},
+		{"GET", "/myapp.git/info/refs"},
+		{"POST", "/myapp.git/git-upload-pack"},
+		{"POST", "/team/myapp.git/git-receive-pack"},
+	}
+	for _, t := range tests {
+		request, _ := http.NewRequest(t.method, t.path, nil)
+		id, err := Authorize(request, authenticators...)
+		c.Check(err, check.IsNil, check.Commentf("%s %s", t.method, t.path))
+		c.Check(id, check.IsNil, check.Commentf("%s %s", t.method, t.path))
+	}
+}
+
+func (s *S) TestAuthorizeNotExemptPaths(c *check.C) {
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"POST", "/healthcheck"},
+		{"DELETE", "/myapp.git/info/refs"},
+		{"GET", "/myapp.git/git-receive-pack"},
+		{"DELETE", "/user/bob/key/mykey/x.git/info/refs"},
+		{"POST", "/hook/post-receive/x/y.git/git-upload-pack"},
+	}
+	for _, t := range tests {
+		request, _ := http.NewRequest(t.method, t.path, nil)
+		_, err := Authorize(request, authenticators...)
+		c.Check(err, check.Equals, ErrMissingCredentials, check.Commentf("%s %s", t.method, t.path))
+	}
+}
+
+func (s *S) TestContext(c *check.C) {
+	c.Assert(FromContext(context.Background()), check.IsNil)
+	id := &Identity{Name: "tsuru", Scope: ScopeAdmin}
+	ctx := NewContext(context.Background(), id)
+	c.Assert(FromContext(ctx), check.Equals, id)
+}
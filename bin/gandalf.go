@@ -13,12 +13,14 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"regexp"
 	"strings"
+	"syscall"
 
 	"github.com/globalsign/mgo/bson"
 	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/audit"
 	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/hook"
 	"github.com/tsuru/gandalf/repository"
 	"github.com/tsuru/gandalf/user"
 )
@@ -26,29 +28,11 @@ import (
 var log *syslog.Writer
 
 func hasWritePermission(u *user.User, r *repository.Repository) (allowed bool) {
-	for _, userName := range r.Users {
-		if u.Name == userName {
-			return true
-		}
-	}
-	return false
+	return r.HasWritePermission(u.Name)
 }
 
 func hasReadPermission(u *user.User, r *repository.Repository) (allowed bool) {
-	if r.IsPublic {
-		return true
-	}
-	for _, userName := range r.Users {
-		if u.Name == userName {
-			return true
-		}
-	}
-	for _, userName := range r.ReadOnlyUsers {
-		if u.Name == userName {
-			return true
-		}
-	}
-	return false
+	return r.HasReadPermission(u.Name)
 }
 
 // Returns the command being executed by ssh.
@@ -62,6 +46,18 @@ func action() string {
 	return strings.Split(os.Getenv("SSH_ORIGINAL_COMMAND"), " ")[0]
 }
 
+// Returns the address of the client, available through the SSH_CLIENT
+// environment variable, in the form "<address> <port> <local port>", or
+// through SSH_CONNECTION, in the form "<address> <port> <local address>
+// <local port>".
+func clientAddress() string {
+	info := os.Getenv("SSH_CLIENT")
+	if info == "" {
+		info = os.Getenv("SSH_CONNECTION")
+	}
+	return strings.Split(info, " ")[0]
+}
+
 // Get the repository name requested in SSH_ORIGINAL_COMMAND and retrieves
 // the related document on the database and returns it.
 // This function does two distinct things, parses the SSH_ORIGINAL_COMMAND and
@@ -89,23 +85,7 @@ func requestedRepository() (repository.Repository, error) {
 // The following format is allowed:
 // (git-[a-z-]+) '/?([\w-+@][\w-+.@]*/)?([\w-]+)\.git'
 func parseGitCommand() (command, name string, err error) {
-	// The following regex validates the git command, which is in the form:
-	//    <git-command> [<namespace>/]<name>
-	// with namespace being optional. If a namespace is used, we validate it
-	// according to the following:
-	//  - a namespace is optional
-	//  - a namespace contains only alphanumerics, underlines, @´s, -´s, +´s
-	//    and periods but it does not start with a period (.)
-	//  - one and exactly one slash (/) separates namespace and the actual name
-	r, err := regexp.Compile(`(git-[a-z-]+) '/?([\w-+@][\w-+.@]*/)?([\w-]+)\.git'`)
-	if err != nil {
-		panic(err)
-	}
-	m := r.FindStringSubmatch(os.Getenv("SSH_ORIGINAL_COMMAND"))
-	if len(m) != 4 {
-		return "", "", errors.New("You've tried to execute some weird command, I'm deliberately denying you to do that, get over it.")
-	}
-	return m[1], m[2] + m[3], nil
+	return repository.ParseGitCommand(os.Getenv("SSH_ORIGINAL_COMMAND"))
 }
 
 // Executes the SSH_ORIGINAL_COMMAND based on the condition
@@ -119,9 +99,55 @@ func executeAction(f func(*user.User, *repository.Repository) bool, errMsg strin
 		return
 	}
 	defer conn.Close()
-	if err = conn.User().Find(bson.M{"_id": os.Args[1]}).One(&u); err != nil {
-		log.Err("Error obtaining user. Gandalf database is probably in an inconsistent state.")
-		fmt.Fprintln(os.Stderr, "Error obtaining user. Gandalf database is probably in an inconsistent state.")
+	_, repoName, _ := parseGitCommand()
+	session := repository.Session{Repository: repoName, Action: action(), ClientAddress: clientAddress()}
+	// deny records the denial of the session, as far as it's known, in the
+	// audit trail and tells the user the reason.
+	deny := func(reason string) {
+		auditError(audit.Start(session).Deny(reason))
+		fmt.Fprintln(os.Stderr, "Permission denied.")
+		fmt.Fprintln(os.Stderr, reason)
+	}
+	var key *user.Key
+	if len(os.Args) > 2 && os.Args[1] == "--principal" {
+		session.Principal = os.Args[2]
+		p, err := user.GetUserByPrincipal(session.Principal)
+		if err != nil {
+			log.Err("Error obtaining user of principal " + session.Principal + ": " + err.Error())
+			deny("The principal " + session.Principal + " does not belong to any user.")
+			return
+		}
+		u = *p
+		session.User = u.Name
+	} else {
+		if err = conn.User().Find(bson.M{"_id": os.Args[1]}).One(&u); err != nil {
+			log.Err("Error obtaining user. Gandalf database is probably in an inconsistent state.")
+			fmt.Fprintln(os.Stderr, "Error obtaining user. Gandalf database is probably in an inconsistent state.")
+			return
+		}
+		session.User = u.Name
+		if len(os.Args) > 2 {
+			key, err = user.GetKeyByFingerprint(os.Args[2])
+			if err != nil || key.UserName != u.Name {
+				log.Err("Error obtaining key. Gandalf database is probably in an inconsistent state.")
+				fmt.Fprintln(os.Stderr, "Error obtaining key. Gandalf database is probably in an inconsistent state.")
+				return
+			}
+			session.KeyName = key.Name
+			session.KeyFingerprint = key.Fingerprint
+			if key.Expired() {
+				log.Err("Key " + key.Name + " of user " + u.Name + " has expired.")
+				deny("Your key has expired.")
+				return
+			}
+			if err = user.MarkKeyUsed(key, session.ClientAddress); err != nil {
+				log.Err("Could not record key usage: " + err.Error())
+			}
+		}
+	}
+	if u.Suspended {
+		log.Err("User " + u.Name + " is suspended.")
+		deny("Your account is suspended.")
 		return
 	}
 	repo, err := requestedRepository()
@@ -130,7 +156,15 @@ func executeAction(f func(*user.User, *repository.Repository) bool, errMsg strin
 		fmt.Fprintln(os.Stderr, err.Error())
 		return
 	}
+	op := audit.Start(session)
 	if f(&u, &repo) {
+		if err = repo.CheckSource(session.ClientAddress); err != nil {
+			log.Err("Access of user " + u.Name + " denied: " + err.Error())
+			auditError(op.Deny(err.Error()))
+			fmt.Fprintln(os.Stderr, "Permission denied.")
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
 		// split into a function (maybe executeCmd)
 		c, err := formatCommand()
 		if err != nil {
@@ -141,9 +175,19 @@ func executeAction(f func(*user.User, *repository.Repository) bool, errMsg strin
 		cmd := exec.Command(c[0], c[1:]...)
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = stdout
-		baseEnv := os.Environ()
-		baseEnv = append(baseEnv, "TSURU_USER="+u.Name)
-		cmd.Env = baseEnv
+		cmd.Env = append(os.Environ(), session.Env()...)
+		if session.Action == "git-receive-pack" {
+			hookEnv, err := hook.ReceivePackEnv()
+			if err != nil {
+				log.Err("Could not install gandalf hooks: " + err.Error())
+				fmt.Fprintln(os.Stderr, "Could not install gandalf hooks: "+err.Error())
+				return
+			}
+			cmd.Env = append(cmd.Env, hookEnv...)
+			refsEnv, err := op.WatchRefs()
+			auditError(err)
+			cmd.Env = append(cmd.Env, refsEnv...)
+		}
 		stderr := &bytes.Buffer{}
 		cmd.Stderr = stderr
 		err = cmd.Run()
@@ -153,14 +197,68 @@ func executeAction(f func(*user.User, *repository.Repository) bool, errMsg strin
 			fmt.Fprintln(os.Stderr, "Got error while executing original command: "+err.Error())
 			fmt.Fprintln(os.Stderr, stderr.String())
 		}
+		auditError(op.Finish(exitStatus(err)))
 		return
 	}
 	log.Err("Permission denied.")
 	log.Err(errMsg)
+	auditError(op.Deny(errMsg))
 	fmt.Fprintln(os.Stderr, "Permission denied.")
 	fmt.Fprintln(os.Stderr, errMsg)
 }
 
+// auditError logs errors recording operations in the audit log, which don't
+// stop the operations.
+func auditError(err error) {
+	if err != nil {
+		log.Err("Could not record the operation in the audit log: " + err.Error())
+	}
+}
+
+// exitStatus returns the exit status of a command, given the error returned
+// when running it.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// updateHook checks the rules and the protected branches of the repository
+// for a change in a ref, given the ref and its old and new revisions, and
+// returns the exit status of the hook. It's run by git-receive-pack as the
+// update hook, with the session of the push in the environment.
+func updateHook(args []string, stderr io.Writer) int {
+	if len(args) != 3 {
+		fmt.Fprintln(stderr, "Usage: gandalf-ssh --update-hook <ref> <old> <new>")
+		return 1
+	}
+	repo, err := repository.Get(os.Getenv("GANDALF_REPOSITORY"))
+	if err != nil {
+		log.Err("Error obtaining repository in update hook: " + err.Error())
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	err = repo.CheckPush(os.Getenv("GANDALF_USER"), args[0], args[1], args[2])
+	if _, ok := err.(*repository.RefUpdateDeniedError); ok {
+		log.Err("Permission denied. " + err.Error())
+		fmt.Fprintln(stderr, "Permission denied.")
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	if err != nil {
+		log.Err(err.Error())
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
 func formatCommand() ([]string, error) {
 	p, err := config.GetString("git:bare:location")
 	if err != nil {
@@ -189,12 +287,22 @@ func main() {
 		fmt.Fprintln(os.Stderr, err.Error())
 		panic(err.Error())
 	}
-	err = config.ReadConfigFile("/etc/gandalf.conf")
+	configFile := hook.ConfigFile
+	updateHookMode := len(os.Args) > 1 && os.Args[1] == "--update-hook"
+	// the update hook reads the configuration of the server that runs
+	// git-receive-pack, which may not be the default one.
+	if f := os.Getenv("GANDALF_CONFIG"); updateHookMode && f != "" {
+		configFile = f
+	}
+	err = config.ReadConfigFile(configFile)
 	if err != nil {
 		log.Err(err.Error())
 		fmt.Fprintln(os.Stderr, err.Error())
 		return
 	}
+	if updateHookMode {
+		os.Exit(updateHook(os.Args[2:], os.Stderr))
+	}
 	_, _, err = parseGitCommand()
 	if err != nil {
 		log.Err(err.Error())
@@ -10,16 +10,26 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/globalsign/mgo/bson"
 	"github.com/tsuru/commandmocker"
 	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/audit"
 	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/gandalf/hook"
 	"github.com/tsuru/gandalf/repository"
 	"github.com/tsuru/gandalf/user"
+	"github.com/tsuru/tsuru/fs/fstest"
 	"gopkg.in/check.v1"
 )
 
+const (
+	rawKey         = "ssh-dss AAAAB3NzaC1kc3MAAACBAIHfSDLpSCfIIVEJ/Is3RFMQhsCi7WZtFQeeyfi+DzVP0NGX4j/rMoQEHgXgNlOKVCJvPk5e00tukSv6iVzJPFcozArvVaoCc5jCoDi5Ef8k3Jil4Q7qNjcoRDDyqjqLcaviJEz5GrtmqAyXEIzJ447BxeEdw3Z7UrIWYcw2YyArAAAAFQD7wiOGZIoxu4XIOoeEe5aToTxN1QAAAIAZNAbJyOnNceGcgRRgBUPfY5ChX+9A29n2MGnyJ/Cxrhuh8d7B0J8UkvEBlfgQICq1UDZbC9q5NQprwD47cGwTjUZ0Z6hGpRmEEZdzsoj9T6vkLiteKH3qLo7IPVx4mV6TTF6PWQbQMUsuxjuDErwS9nhtTM4nkxYSmUbnWb6wfwAAAIB2qm/1J6Jl8bByBaMQ/ptbm4wQCvJ9Ll9u6qtKy18D4ldoXM0E9a1q49swml5CPFGyU+cgPRhEjN5oUr5psdtaY8CHa2WKuyIVH3B8UhNzqkjpdTFSpHs6tGluNVC+SQg1MVwfG2wsZUdkUGyn+6j8ZZarUfpAmbb5qJJpgMFEKQ== f@xikinbook.local"
+	keyFingerprint = "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM"
+)
+
 func Test(t *testing.T) { check.TestingT(t) }
 
 type S struct {
@@ -36,6 +46,7 @@ func (s *S) SetUpSuite(c *check.C) {
 	err = config.ReadConfigFile("../etc/gandalf.conf")
 	c.Check(err, check.IsNil)
 	config.Set("database:name", "gandalf_bin_tests")
+	fs.Fsystem = &fstest.RecordingFs{}
 	s.user, err = user.New("testuser", map[string]string{})
 	c.Check(err, check.IsNil)
 	// does not uses repository.New to avoid creation of bare git repo
@@ -54,6 +65,14 @@ func (s *S) TearDownSuite(c *check.C) {
 	conn.User().Database.DropDatabase()
 }
 
+// lastOperation returns the most recent operation in the audit trail.
+func lastOperation(c *check.C) audit.Operation {
+	ops, err := audit.List(audit.Filter{Limit: 1})
+	c.Assert(err, check.IsNil)
+	c.Assert(ops, check.HasLen, 1)
+	return ops[0]
+}
+
 func (s *S) TestHasWritePermissionSholdReturnTrueWhenUserCanWriteInRepo(c *check.C) {
 	allowed := hasWritePermission(s.user, s.repo)
 	c.Assert(allowed, check.Equals, true)
@@ -121,6 +140,23 @@ func (s *S) TestActionShouldReturnEmptyWhenEnvVarIsNotSet(c *check.C) {
 	c.Assert(cmd, check.Equals, "")
 }
 
+func (s *S) TestClientAddress(c *check.C) {
+	os.Setenv("SSH_CLIENT", "192.168.50.1 51970 22")
+	defer os.Setenv("SSH_CLIENT", "")
+	c.Assert(clientAddress(), check.Equals, "192.168.50.1")
+}
+
+func (s *S) TestClientAddressFromSSHConnection(c *check.C) {
+	os.Setenv("SSH_CONNECTION", "192.168.50.1 51970 192.168.50.10 22")
+	defer os.Setenv("SSH_CONNECTION", "")
+	c.Assert(clientAddress(), check.Equals, "192.168.50.1")
+}
+
+func (s *S) TestClientAddressWhenEnvVarIsNotSet(c *check.C) {
+	os.Setenv("SSH_CLIENT", "")
+	c.Assert(clientAddress(), check.Equals, "")
+}
+
 func (s *S) TestRequestedRepositoryShouldGetArgumentInSSH_ORIGINAL_COMMANDAndRetrieveTheEquivalentDatabaseRepository(c *check.C) {
 	r := repository.Repository{Name: "foo"}
 	conn, err := db.Conn()
@@ -249,6 +285,255 @@ func (s *S) TestExecuteActionShouldExecuteGitReceivePackWhenUserHasWritePermissi
 	c.Assert(commandmocker.Envs(dir), check.Matches, `(?s).*TSURU_USER=testuser.*`)
 }
 
+func (s *S) TestExecuteActionShouldExportKeyIdentity(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	err := user.AddKey(s.user.Name, map[string]string{"deploy": rawKey})
+	c.Assert(err, check.IsNil)
+	defer user.RemoveKey(s.user.Name, "deploy")
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", s.user.Name, keyFingerprint}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, true)
+	envs := commandmocker.Envs(dir)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_USER=testuser.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_KEY_NAME=deploy.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_KEY_FINGERPRINT=`+keyFingerprint+`.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_REPOSITORY=myapp.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_ACTION=git-receive-pack.*`)
+}
+
+func (s *S) TestExecuteActionShouldRunGandalfHooksOnReceivePack(c *check.C) {
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", s.user.Name}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, true)
+	hooksPath, err := hook.HooksPath()
+	c.Assert(err, check.IsNil)
+	envs := commandmocker.Envs(dir)
+	c.Assert(envs, check.Matches, `(?s).*GIT_CONFIG_KEY_0=core.hooksPath.*`)
+	c.Assert(envs, check.Matches, `(?s).*GIT_CONFIG_VALUE_0=`+hooksPath+`.*`)
+}
+
+func (s *S) TestUpdateHook(c *check.C) {
+	r := repository.Repository{Name: "ruledapp", Users: []string{s.user.Name}, Rules: []repository.RefRule{
+		{Ref: "refs/tags/*", Actions: []string{repository.RefDelete}, Deny: true},
+	}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	os.Setenv("GANDALF_USER", s.user.Name)
+	os.Setenv("GANDALF_REPOSITORY", r.Name)
+	defer os.Unsetenv("GANDALF_USER")
+	defer os.Unsetenv("GANDALF_REPOSITORY")
+	rev := "a367b5de5943632e47cb6f8bf5b2147bc0be5cf8"
+	zero := "0000000000000000000000000000000000000000"
+	stderr := &bytes.Buffer{}
+	c.Assert(updateHook([]string{"refs/tags/1.0", zero, rev}, stderr), check.Equals, 0)
+	c.Assert(stderr.String(), check.Equals, "")
+	c.Assert(updateHook([]string{"refs/tags/1.0", rev, zero}, stderr), check.Equals, 1)
+	c.Assert(stderr.String(), check.Equals, "Permission denied.\nYou are not allowed to delete refs/tags/1.0.\n")
+}
+
+func (s *S) TestUpdateHookProtectedBranch(c *check.C) {
+	r := repository.Repository{Name: "protectedapp", Users: []string{s.user.Name}, ProtectedBranches: []repository.ProtectedBranch{
+		{Name: "master", DenyDelete: true},
+	}}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(&r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	os.Setenv("GANDALF_USER", s.user.Name)
+	os.Setenv("GANDALF_REPOSITORY", r.Name)
+	defer os.Unsetenv("GANDALF_USER")
+	defer os.Unsetenv("GANDALF_REPOSITORY")
+	rev := "a367b5de5943632e47cb6f8bf5b2147bc0be5cf8"
+	zero := "0000000000000000000000000000000000000000"
+	stderr := &bytes.Buffer{}
+	c.Assert(updateHook([]string{"refs/heads/master", rev, zero}, stderr), check.Equals, 1)
+	c.Assert(stderr.String(), check.Equals, "Permission denied.\nThe branch master is protected, it can't be deleted.\n")
+}
+
+func (s *S) TestUpdateHookInvalidArguments(c *check.C) {
+	stderr := &bytes.Buffer{}
+	c.Assert(updateHook([]string{"refs/heads/master"}, stderr), check.Equals, 1)
+	c.Assert(stderr.String(), check.Equals, "Usage: gandalf-ssh --update-hook <ref> <old> <new>\n")
+}
+
+func (s *S) TestExecuteActionShouldLookUpUserByPrincipal(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	err := user.AddPrincipal(s.user.Name, "testuser@example.com")
+	c.Assert(err, check.IsNil)
+	defer user.RemovePrincipal(s.user.Name, "testuser@example.com")
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", "--principal", "testuser@example.com"}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, true)
+	envs := commandmocker.Envs(dir)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_USER=testuser.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_PRINCIPAL=testuser@example.com.*`)
+}
+
+func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenPrincipalIsUnknown(c *check.C) {
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", "--principal", "sauron@mordor"}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, false)
+	op := lastOperation(c)
+	c.Assert(op.Principal, check.Equals, "sauron@mordor")
+	c.Assert(op.Repository, check.Equals, "myapp")
+	c.Assert(op.Denied, check.Equals, "The principal sauron@mordor does not belong to any user.")
+}
+
+func (s *S) TestExecuteActionShouldRecordKeyUsage(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	err := user.AddKey(s.user.Name, map[string]string{"deploy": rawKey})
+	c.Assert(err, check.IsNil)
+	defer user.RemoveKey(s.user.Name, "deploy")
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", s.user.Name, keyFingerprint}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	os.Setenv("SSH_CLIENT", "192.168.50.1 51970 22")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+		os.Setenv("SSH_CLIENT", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	key, err := user.GetKeyByFingerprint(keyFingerprint)
+	c.Assert(err, check.IsNil)
+	c.Assert(key.LastUsedFrom, check.Equals, "192.168.50.1")
+	c.Assert(key.LastUsedAt.IsZero(), check.Equals, false)
+}
+
+func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenSourceIsNotAllowed(c *check.C) {
+	err := repository.SetAllowedSources(s.repo.Name, []string{"10.0.0.0/8"})
+	c.Assert(err, check.IsNil)
+	defer repository.SetAllowedSources(s.repo.Name, nil)
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", s.user.Name}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	os.Setenv("SSH_CLIENT", "192.168.50.1 51970 22")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+		os.Setenv("SSH_CLIENT", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, false)
+}
+
+func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenKeyHasExpired(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	err := user.AddExpiringKey(s.user.Name, map[string]string{"deploy": rawKey}, time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	defer user.RemoveKey(s.user.Name, "deploy")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Key().Update(bson.M{"name": "deploy"}, bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Minute)}})
+	c.Assert(err, check.IsNil)
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", s.user.Name, keyFingerprint}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, false)
+	op := lastOperation(c)
+	c.Assert(op.User, check.Equals, s.user.Name)
+	c.Assert(op.KeyName, check.Equals, "deploy")
+	c.Assert(op.Denied, check.Equals, "Your key has expired.")
+}
+
+func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenUserIsSuspended(c *check.C) {
+	err := user.Suspend(s.user.Name)
+	c.Assert(err, check.IsNil)
+	defer user.Unsuspend(s.user.Name)
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", s.user.Name}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, false)
+	op := lastOperation(c)
+	c.Assert(op.User, check.Equals, s.user.Name)
+	c.Assert(op.Action, check.Equals, "git-receive-pack")
+	c.Assert(op.Denied, check.Equals, "Your account is suspended.")
+}
+
+func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenKeyDoesNotExist(c *check.C) {
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Check(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	os.Args = []string{"gandalf", s.user.Name, keyFingerprint}
+	os.Setenv("SSH_ORIGINAL_COMMAND", "git-receive-pack 'myapp.git'")
+	defer func() {
+		os.Args = []string{}
+		os.Setenv("SSH_ORIGINAL_COMMAND", "")
+	}()
+	stdout := &bytes.Buffer{}
+	executeAction(hasWritePermission, "You don't have access to write in this repository.", stdout)
+	c.Assert(commandmocker.Ran(dir), check.Equals, false)
+}
+
 func (s *S) TestExecuteActionShouldNotCallSSH_ORIGINAL_COMMANDWhenUserDoesNotExist(c *check.C) {
 	dir, err := commandmocker.Add("git-receive-pack", "$*")
 	c.Check(err, check.IsNil)
@@ -63,8 +63,66 @@ func (s *Storage) User() *storage.Collection {
 func (s *Storage) Key() *storage.Collection {
 	bodyIndex := mgo.Index{Key: []string{"body"}, Unique: true}
 	nameIndex := mgo.Index{Key: []string{"username", "name"}, Unique: true}
+	fingerprintIndex := mgo.Index{Key: []string{"fingerprint"}}
+	md5FingerprintIndex := mgo.Index{Key: []string{"md5fingerprint"}}
 	c := s.Collection("key")
 	c.EnsureIndex(bodyIndex)
 	c.EnsureIndex(nameIndex)
+	c.EnsureIndex(fingerprintIndex)
+	c.EnsureIndex(md5FingerprintIndex)
+	return c
+}
+
+// Authority returns a reference to the "authority" collection in MongoDB.
+func (s *Storage) Authority() *storage.Collection {
+	fingerprintIndex := mgo.Index{Key: []string{"fingerprint"}}
+	c := s.Collection("authority")
+	c.EnsureIndex(fingerprintIndex)
+	return c
+}
+
+// Group returns a reference to the "group" collection in MongoDB.
+func (s *Storage) Group() *storage.Collection {
+	membersIndex := mgo.Index{Key: []string{"members"}}
+	c := s.Collection("group")
+	c.EnsureIndex(membersIndex)
+	return c
+}
+
+// Namespace returns a reference to the "namespace" collection in MongoDB.
+func (s *Storage) Namespace() *storage.Collection {
+	return s.Collection("namespace")
+}
+
+// Token returns a reference to the "token" collection in MongoDB, which
+// stores the personal access tokens of users.
+func (s *Storage) Token() *storage.Collection {
+	hashIndex := mgo.Index{Key: []string{"hash"}, Unique: true}
+	nameIndex := mgo.Index{Key: []string{"username", "name"}, Unique: true}
+	c := s.Collection("token")
+	c.EnsureIndex(hashIndex)
+	c.EnsureIndex(nameIndex)
+	return c
+}
+
+// Audit returns a reference to the "audit" collection in MongoDB, which
+// records the git operations run by users.
+func (s *Storage) Audit() *storage.Collection {
+	repositoryIndex := mgo.Index{Key: []string{"repository", "-startedat"}}
+	userIndex := mgo.Index{Key: []string{"user", "-startedat"}}
+	c := s.Collection("audit")
+	c.EnsureIndex(repositoryIndex)
+	c.EnsureIndex(userIndex)
+	return c
+}
+
+// APIAudit returns a reference to the "apiaudit" collection in MongoDB, which
+// records the changes made through the API.
+func (s *Storage) APIAudit() *storage.Collection {
+	actorIndex := mgo.Index{Key: []string{"actor", "-time"}}
+	timeIndex := mgo.Index{Key: []string{"-time"}}
+	c := s.Collection("apiaudit")
+	c.EnsureIndex(actorIndex)
+	c.EnsureIndex(timeIndex)
 	return c
 }
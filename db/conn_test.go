@@ -63,11 +63,104 @@ func (s *S) TestSessionKeyIndexes(c *check.C) {
 	key := conn.Key()
 	indexes, err := key.Indexes()
 	c.Assert(err, check.IsNil)
-	c.Check(indexes, check.HasLen, 3)
+	c.Check(indexes, check.HasLen, 5)
 	c.Check(indexes[1].Key, check.DeepEquals, []string{"body"})
 	c.Check(indexes[1].Unique, check.DeepEquals, true)
 	c.Check(indexes[2].Key, check.DeepEquals, []string{"username", "name"})
 	c.Check(indexes[2].Unique, check.DeepEquals, true)
+	c.Check(indexes[3].Key, check.DeepEquals, []string{"fingerprint"})
+	c.Check(indexes[3].Unique, check.DeepEquals, false)
+	c.Check(indexes[4].Key, check.DeepEquals, []string{"md5fingerprint"})
+	c.Check(indexes[4].Unique, check.DeepEquals, false)
+}
+
+func (s *S) TestSessionAuthorityShouldReturnAuthorityCollection(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	authority := conn.Authority()
+	cAuthority := conn.Collection("authority")
+	c.Assert(authority, check.DeepEquals, cAuthority)
+}
+
+func (s *S) TestSessionGroupShouldReturnGroupCollection(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	group := conn.Group()
+	cGroup := conn.Collection("group")
+	c.Assert(group, check.DeepEquals, cGroup)
+}
+
+func (s *S) TestSessionNamespaceShouldReturnNamespaceCollection(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	namespace := conn.Namespace()
+	cNamespace := conn.Collection("namespace")
+	c.Assert(namespace, check.DeepEquals, cNamespace)
+}
+
+func (s *S) TestSessionAuditShouldReturnAuditCollection(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	audit := conn.Audit()
+	cAudit := conn.Collection("audit")
+	c.Assert(audit, check.DeepEquals, cAudit)
+}
+
+func (s *S) TestSessionAuditShouldHaveIndexes(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	indexes, err := conn.Audit().Indexes()
+	c.Assert(err, check.IsNil)
+	c.Check(indexes, check.HasLen, 3)
+	c.Check(indexes[1].Key, check.DeepEquals, []string{"repository", "-startedat"})
+	c.Check(indexes[2].Key, check.DeepEquals, []string{"user", "-startedat"})
+}
+
+func (s *S) TestSessionAPIAuditShouldReturnAPIAuditCollection(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	audit := conn.APIAudit()
+	cAudit := conn.Collection("apiaudit")
+	c.Assert(audit, check.DeepEquals, cAudit)
+}
+
+func (s *S) TestSessionAPIAuditShouldHaveIndexes(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	indexes, err := conn.APIAudit().Indexes()
+	c.Assert(err, check.IsNil)
+	c.Check(indexes, check.HasLen, 3)
+	c.Check(indexes[1].Key, check.DeepEquals, []string{"actor", "-time"})
+	c.Check(indexes[2].Key, check.DeepEquals, []string{"-time"})
+}
+
+func (s *S) TestSessionTokenShouldReturnTokenCollection(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	token := conn.Token()
+	cToken := conn.Collection("token")
+	c.Assert(token, check.DeepEquals, cToken)
+}
+
+func (s *S) TestSessionTokenShouldHaveUniqueIndexes(c *check.C) {
+	conn, err := Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	indexes, err := conn.Token().Indexes()
+	c.Assert(err, check.IsNil)
+	c.Check(indexes, check.HasLen, 3)
+	c.Check(indexes[1].Key, check.DeepEquals, []string{"hash"})
+	c.Check(indexes[1].Unique, check.Equals, true)
+	c.Check(indexes[2].Key, check.DeepEquals, []string{"username", "name"})
+	c.Check(indexes[2].Unique, check.Equals, true)
 }
 
 func (s *S) TestConnect(c *check.C) {
@@ -14,6 +14,7 @@ import (
 	"sync"
 
 	"github.com/gorilla/pat"
+	"github.com/tsuru/gandalf/auth"
 	"github.com/tsuru/gandalf/repository"
 	"github.com/tsuru/gandalf/user"
 	"github.com/tsuru/tsuru/errors"
@@ -64,6 +65,9 @@ type GandalfServer struct {
 	usersLock sync.RWMutex
 	repoLock  sync.RWMutex
 	failures  chan Failure
+	authLock  sync.RWMutex
+	tokens    auth.TokenAuthenticator
+	hmacKeys  auth.HMACAuthenticator
 }
 
 // NewServer returns an instance of the test server, bound to the specified
@@ -106,9 +110,43 @@ func (s *GandalfServer) PrepareFailure(failure Failure) {
 	s.failures <- failure
 }
 
+// AddToken makes the server require authentication, like gandalf-webserver
+// with api:auth:enabled, and accept the given static token, with the given
+// scope.
+func (s *GandalfServer) AddToken(name, token string, scope auth.Scope) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	s.tokens = append(s.tokens, auth.Credential{Name: name, Secret: token, Scope: scope})
+}
+
+// AddHMACKey makes the server require authentication, like
+// gandalf-webserver with api:auth:enabled, and accept requests signed with
+// the given key, with the given scope. See auth.Sign.
+func (s *GandalfServer) AddHMACKey(name, secret string, scope auth.Scope) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	s.hmacKeys = append(s.hmacKeys, auth.Credential{Name: name, Secret: secret, Scope: scope})
+}
+
+// authorize checks the credentials of the request, when the server requires
+// authentication.
+func (s *GandalfServer) authorize(r *http.Request) error {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	if len(s.tokens) == 0 && len(s.hmacKeys) == 0 {
+		return nil
+	}
+	_, err := auth.Authorize(r, s.tokens, s.hmacKeys)
+	return err
+}
+
 // ServeHTTP handler HTTP requests, dealing with prepared failures before
 // dispatching the request to the proper internal handler.
 func (s *GandalfServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.authorize(r); err != nil {
+		http.Error(w, err.Error(), auth.Status(err))
+		return
+	}
 	if failure, ok := s.getFailure(r.Method, r.URL.Path); ok {
 		code := failure.Code
 		if code == 0 {
@@ -196,8 +234,12 @@ func (s *GandalfServer) PrepareLogs(repository string, log repository.GitHistory
 	}
 }
 
-// Reset resets all internal information of the server, like keys, repositories, users and prepared failures.
+// Reset resets all internal information of the server, like keys, repositories, users, credentials and prepared failures.
 func (s *GandalfServer) Reset() {
+	s.authLock.Lock()
+	s.tokens = nil
+	s.hmacKeys = nil
+	s.authLock.Unlock()
 	s.usersLock.Lock()
 	s.users = nil
 	s.keys = make(map[string][]key)
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/tsuru/gandalf/auth"
 	"github.com/tsuru/gandalf/repository"
 
 	"gopkg.in/check.v1"
@@ -141,11 +142,51 @@ func (s *S) TestReset(c *check.C) {
 	server.keys = map[string][]key{"user1": {{Name: "wat"}}}
 	server.repos = []Repository{{Name: "something"}, {Name: "otherthing"}}
 	server.PrepareFailure(Failure{Method: "POST", Path: "/user"})
+	server.AddToken("tsuru", "admin-token", auth.ScopeAdmin)
+	server.AddHMACKey("ci", "hmac-secret", auth.ScopeReadOnly)
 	server.Reset()
 	c.Assert(server.users, check.HasLen, 0)
 	c.Assert(server.keys, check.HasLen, 0)
 	c.Assert(server.repos, check.HasLen, 0)
 	c.Assert(server.failures, check.HasLen, 0)
+	c.Assert(server.tokens, check.HasLen, 0)
+	c.Assert(server.hmacKeys, check.HasLen, 0)
+}
+
+func (s *S) TestAuthentication(c *check.C) {
+	server, err := NewServer("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer server.Stop()
+	server.AddToken("tsuru", "admin-token", auth.ScopeAdmin)
+	server.AddHMACKey("ci", "hmac-secret", auth.ScopeReadOnly)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/user", strings.NewReader(`{"Name":"someuser"}`))
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+	c.Assert(server.users, check.HasLen, 0)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/user", strings.NewReader(`{"Name":"someuser"}`))
+	err = auth.Sign(request, "ci", "hmac-secret")
+	c.Assert(err, check.IsNil)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusForbidden)
+	c.Assert(server.users, check.HasLen, 0)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/user", strings.NewReader(`{"Name":"someuser"}`))
+	request.Header.Set("Authorization", "Bearer admin-token")
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(server.users, check.DeepEquals, []string{"someuser"})
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/repository/somerepo", nil)
+	err = auth.Sign(request, "ci", "hmac-secret")
+	c.Assert(err, check.IsNil)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/healthcheck", nil)
+	server.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
 }
 
 func (s *S) TestCreateUser(c *check.C) {
@@ -0,0 +1,186 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package group manages groups of users. Repositories may grant access to
+// groups, so adding a user to a group gives them access to all the
+// repositories of the group, and removing the user revokes it.
+package group
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/tsuru/log"
+)
+
+var (
+	ErrGroupAlreadyExists = errors.New("group already exists")
+	ErrGroupNotFound      = errors.New("group not found")
+
+	groupNameRegexp = regexp.MustCompile(`^[\w-+.@]+$`)
+)
+
+type Group struct {
+	Name    string `bson:"_id"`
+	Members []string
+}
+
+type InvalidGroupError struct {
+	message string
+}
+
+func (err *InvalidGroupError) Error() string {
+	return err.message
+}
+
+// New creates a group with the given members.
+func New(name string, members []string) (*Group, error) {
+	log.Debugf("Creating group %q", name)
+	if !groupNameRegexp.MatchString(name) {
+		return nil, &InvalidGroupError{message: "group name is not valid"}
+	}
+	if members == nil {
+		members = []string{}
+	}
+	g := &Group{Name: name, Members: members}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.Group().Insert(g); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrGroupAlreadyExists
+		}
+		return nil, err
+	}
+	return g, nil
+}
+
+// Get finds a group by name.
+func Get(name string) (Group, error) {
+	var g Group
+	conn, err := db.Conn()
+	if err != nil {
+		return g, err
+	}
+	defer conn.Close()
+	err = conn.Group().FindId(name).One(&g)
+	if err == mgo.ErrNotFound {
+		return g, ErrGroupNotFound
+	}
+	return g, err
+}
+
+// List lists all groups.
+func List() ([]Group, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	groups := []Group{}
+	err = conn.Group().Find(nil).Sort("_id").All(&groups)
+	return groups, err
+}
+
+// Remove deletes the group and revokes its access to all repositories and
+// namespaces.
+func Remove(name string) error {
+	log.Debugf("Removing group %q", name)
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.Group().RemoveId(name); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrGroupNotFound
+		}
+		return err
+	}
+	q := bson.M{"$or": []bson.M{{"groups": name}, {"readonlygroups": name}}}
+	update := bson.M{"$pull": bson.M{"groups": name, "readonlygroups": name}}
+	if _, err = conn.Repository().UpdateAll(q, update); err != nil {
+		return err
+	}
+	_, err = conn.Namespace().UpdateAll(q, update)
+	return err
+}
+
+// AddMembers adds users to the group. Like repository.GrantAccess, it does
+// not check whether the users exist.
+func AddMembers(name string, members []string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Group().UpdateId(name, bson.M{"$addToSet": bson.M{"members": bson.M{"$each": members}}})
+	if err == mgo.ErrNotFound {
+		return ErrGroupNotFound
+	}
+	return err
+}
+
+// RemoveMembers removes users from the group, revoking the access they had
+// through it.
+func RemoveMembers(name string, members []string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Group().UpdateId(name, bson.M{"$pullAll": bson.M{"members": members}})
+	if err == mgo.ErrNotFound {
+		return ErrGroupNotFound
+	}
+	return err
+}
+
+// RemoveFromAll removes the user from all groups.
+func RemoveFromAll(userName string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Group().UpdateAll(bson.M{"members": userName}, bson.M{"$pull": bson.M{"members": userName}})
+	return err
+}
+
+// IsMember returns whether the user belongs to any of the given groups.
+func IsMember(userName string, groups []string) (bool, error) {
+	if len(groups) == 0 {
+		return false, nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	n, err := conn.Group().Find(bson.M{"_id": bson.M{"$in": groups}, "members": userName}).Count()
+	return n > 0, err
+}
+
+// MemberOf returns the names of the groups the user belongs to.
+func MemberOf(userName string) ([]string, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var groups []Group
+	if err = conn.Group().Find(bson.M{"members": userName}).Select(bson.M{"_id": 1}).Sort("_id").All(&groups); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(groups))
+	for i, g := range groups {
+		names[i] = g.Name
+	}
+	return names, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package group
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Check(err, check.IsNil)
+	config.Set("database:name", "gandalf_group_tests")
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.Group().Database.DropDatabase()
+}
+
+func (s *S) TestNew(c *check.C) {
+	g, err := New("devs", []string{"bilbo", "frodo"})
+	c.Assert(err, check.IsNil)
+	defer Remove(g.Name)
+	found, err := Get("devs")
+	c.Assert(err, check.IsNil)
+	c.Assert(found, check.DeepEquals, Group{Name: "devs", Members: []string{"bilbo", "frodo"}})
+}
+
+func (s *S) TestNewWithoutMembers(c *check.C) {
+	g, err := New("devs", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(g.Name)
+	found, err := Get("devs")
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Members, check.DeepEquals, []string{})
+}
+
+func (s *S) TestNewInvalidName(c *check.C) {
+	g, err := New("dev team", nil)
+	c.Assert(g, check.IsNil)
+	c.Assert(err, check.FitsTypeOf, &InvalidGroupError{})
+	c.Assert(err, check.ErrorMatches, "group name is not valid")
+}
+
+func (s *S) TestNewDuplicate(c *check.C) {
+	g, err := New("devs", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(g.Name)
+	_, err = New("devs", nil)
+	c.Assert(err, check.Equals, ErrGroupAlreadyExists)
+}
+
+func (s *S) TestGetNotFound(c *check.C) {
+	_, err := Get("unknown")
+	c.Assert(err, check.Equals, ErrGroupNotFound)
+}
+
+func (s *S) TestList(c *check.C) {
+	_, err := New("qa", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove("qa")
+	_, err = New("devs", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove("devs")
+	groups, err := List()
+	c.Assert(err, check.IsNil)
+	c.Assert(groups, check.HasLen, 2)
+	c.Assert(groups[0].Name, check.Equals, "devs")
+	c.Assert(groups[1].Name, check.Equals, "qa")
+}
+
+func (s *S) TestRemoveRevokesRepositoryAccess(c *check.C) {
+	_, err := New("devs", nil)
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	repo := bson.M{"_id": "myapp", "groups": []string{"devs", "ops"}, "readonlygroups": []string{"devs"}}
+	err = conn.Repository().Insert(repo)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	err = Remove("devs")
+	c.Assert(err, check.IsNil)
+	var r struct {
+		Groups         []string
+		ReadOnlyGroups []string
+	}
+	err = conn.Repository().FindId("myapp").One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Groups, check.DeepEquals, []string{"ops"})
+	c.Assert(r.ReadOnlyGroups, check.DeepEquals, []string{})
+	_, err = Get("devs")
+	c.Assert(err, check.Equals, ErrGroupNotFound)
+}
+
+func (s *S) TestRemoveNotFound(c *check.C) {
+	err := Remove("unknown")
+	c.Assert(err, check.Equals, ErrGroupNotFound)
+}
+
+func (s *S) TestAddAndRemoveMembers(c *check.C) {
+	_, err := New("devs", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer Remove("devs")
+	err = AddMembers("devs", []string{"frodo", "bilbo", "sam"})
+	c.Assert(err, check.IsNil)
+	g, err := Get("devs")
+	c.Assert(err, check.IsNil)
+	c.Assert(g.Members, check.DeepEquals, []string{"bilbo", "frodo", "sam"})
+	err = RemoveMembers("devs", []string{"bilbo", "sam"})
+	c.Assert(err, check.IsNil)
+	g, err = Get("devs")
+	c.Assert(err, check.IsNil)
+	c.Assert(g.Members, check.DeepEquals, []string{"frodo"})
+}
+
+func (s *S) TestAddMembersGroupNotFound(c *check.C) {
+	err := AddMembers("unknown", []string{"bilbo"})
+	c.Assert(err, check.Equals, ErrGroupNotFound)
+}
+
+func (s *S) TestRemoveFromAll(c *check.C) {
+	_, err := New("devs", []string{"bilbo", "frodo"})
+	c.Assert(err, check.IsNil)
+	defer Remove("devs")
+	_, err = New("qa", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer Remove("qa")
+	err = RemoveFromAll("bilbo")
+	c.Assert(err, check.IsNil)
+	member, err := IsMember("bilbo", []string{"devs", "qa"})
+	c.Assert(err, check.IsNil)
+	c.Assert(member, check.Equals, false)
+	member, err = IsMember("frodo", []string{"devs"})
+	c.Assert(err, check.IsNil)
+	c.Assert(member, check.Equals, true)
+}
+
+func (s *S) TestIsMember(c *check.C) {
+	_, err := New("devs", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer Remove("devs")
+	member, err := IsMember("bilbo", []string{"qa", "devs"})
+	c.Assert(err, check.IsNil)
+	c.Assert(member, check.Equals, true)
+	member, err = IsMember("frodo", []string{"qa", "devs"})
+	c.Assert(err, check.IsNil)
+	c.Assert(member, check.Equals, false)
+}
+
+func (s *S) TestIsMemberWithoutGroups(c *check.C) {
+	member, err := IsMember("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(member, check.Equals, false)
+}
+
+func (s *S) TestMemberOf(c *check.C) {
+	_, err := New("devs", []string{"bilbo", "frodo"})
+	c.Assert(err, check.IsNil)
+	defer Remove("devs")
+	_, err = New("qa", []string{"frodo"})
+	c.Assert(err, check.IsNil)
+	defer Remove("qa")
+	groups, err := MemberOf("frodo")
+	c.Assert(err, check.IsNil)
+	c.Assert(groups, check.DeepEquals, []string{"devs", "qa"})
+	groups, err = MemberOf("sam")
+	c.Assert(err, check.IsNil)
+	c.Assert(groups, check.HasLen, 0)
+}
@@ -31,6 +31,8 @@ func (s *S) SetUpSuite(c *check.C) {
 	c.Assert(err, check.IsNil)
 	config.Set("database:url", "127.0.0.1:27017")
 	config.Set("database:name", "gandalf_hooks_tests")
+	// git is only checked once, before it's mocked.
+	c.Assert(CheckGitVersion(), check.IsNil)
 	s.tmpdir, err = commandmocker.Add("git", "")
 	c.Assert(err, check.IsNil)
 }
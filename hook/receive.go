@@ -0,0 +1,172 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/fs"
+)
+
+// receiveHooks lists the hooks run by git-receive-pack that gandalf runs
+// itself, before handing over to the hooks of the repository.
+var receiveHooks = []string{"pre-receive", "update", "post-receive", "post-update"}
+
+// receiveHookFmt runs the hook with the same name in the repository, if
+// there's one. Gandalf checks run before it, so hook scripts added to the
+// repository can't skip them.
+const receiveHookFmt = `#!/bin/sh
+# Installed by gandalf, do not edit.
+%shook="$GIT_DIR/hooks/%s"
+if [ -x "$hook" ]; then
+	%sexec "$hook" "$@"
+fi
+`
+
+// postReceiveRecord appends the refs updated by a push, read by the
+// post-receive hook from its input, to the file named by GANDALF_REF_UPDATES,
+// for the audit of the push. The input is kept for the hook of the
+// repository.
+const postReceiveRecord = `input=$(cat)
+[ -z "$GANDALF_REF_UPDATES" ] || printf '%s\n' "$input" >> "$GANDALF_REF_UPDATES"
+`
+
+// HooksPath returns the directory of the hooks gandalf runs on
+// git-receive-pack, defined by git:hooks-path. It defaults to the .gandalf
+// directory in git:bare:location, which is not a valid repository name.
+func HooksPath() (string, error) {
+	if p, err := config.GetString("git:hooks-path"); err == nil {
+		return p, nil
+	}
+	bare, err := config.GetString("git:bare:location")
+	if err != nil {
+		return "", err
+	}
+	return path.Join(bare, ".gandalf", "hooks"), nil
+}
+
+func receiveHookContent(name, binPath string) string {
+	var check, input string
+	switch name {
+	case "update":
+		check = fmt.Sprintf("'%s' --update-hook \"$@\" || exit 1\n", binPath)
+	case "post-receive":
+		check = postReceiveRecord
+		input = `printf '%s\n' "$input" | `
+	}
+	return fmt.Sprintf(receiveHookFmt, check, name, input)
+}
+
+// installReceiveHook writes the hook, unless it's already up to date. The
+// hook is written to a temporary file and then renamed, so pushes running
+// concurrently never see a partial script.
+func installReceiveHook(dir, name, content string) error {
+	hookPath := path.Join(dir, name)
+	if file, err := fs.Filesystem().Open(hookPath); err == nil {
+		current, err := ioutil.ReadAll(file)
+		file.Close()
+		if err == nil && string(current) == content {
+			return nil
+		}
+	}
+	tmpPath := fmt.Sprintf("%s.%d.tmp", hookPath, os.Getpid())
+	if err := createHookFile(tmpPath, []byte(content)); err != nil {
+		return err
+	}
+	return fs.Filesystem().Rename(tmpPath, hookPath)
+}
+
+// InstallReceiveHooks writes the hooks gandalf runs on git-receive-pack to
+// HooksPath.
+func InstallReceiveHooks() error {
+	dir, err := HooksPath()
+	if err != nil {
+		return err
+	}
+	binPath, err := config.GetString("bin-path")
+	if err != nil {
+		return err
+	}
+	if err = fs.Filesystem().MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range receiveHooks {
+		if err = installReceiveHook(dir, name, receiveHookContent(name, binPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigFile is the path of the configuration file of gandalf. It's passed to
+// the update hook in GANDALF_CONFIG, so the hook checks pushes with the same
+// configuration as the server that runs git-receive-pack.
+var ConfigFile = "/etc/gandalf.conf"
+
+// gitCheck holds the result of CheckGitVersion, git is only checked once.
+var gitCheck struct {
+	once sync.Once
+	err  error
+}
+
+// CheckGitVersion checks whether the installed git runs the gandalf hooks on
+// git-receive-pack. The hooks are set through GIT_CONFIG_COUNT, which git
+// before 2.31 silently ignores, running pushes without any checks.
+func CheckGitVersion() error {
+	gitCheck.once.Do(func() {
+		gitCheck.err = checkGitVersion()
+	})
+	return gitCheck.err
+}
+
+func checkGitVersion() error {
+	out, err := exec.Command("git", "version").Output()
+	if err != nil {
+		return fmt.Errorf("could not get the version of git: %s", err)
+	}
+	return checkVersionOutput(strings.TrimSpace(string(out)))
+}
+
+// checkVersionOutput checks the output of git version, e.g. "git version
+// 2.39.5".
+func checkVersionOutput(version string) error {
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "git version %d.%d", &major, &minor); err != nil {
+		return fmt.Errorf("could not parse the version of git: %q", version)
+	}
+	if major < 2 || major == 2 && minor < 31 {
+		return fmt.Errorf("pushes require git 2.31 or later to run the gandalf hooks, found %q", version)
+	}
+	return nil
+}
+
+// ReceivePackEnv installs the gandalf hooks and returns the environment
+// variables that make git-receive-pack run them, instead of the hooks of the
+// repository. It fails when git is too old to run them (see CheckGitVersion).
+func ReceivePackEnv() ([]string, error) {
+	if err := CheckGitVersion(); err != nil {
+		return nil, err
+	}
+	if err := InstallReceiveHooks(); err != nil {
+		return nil, err
+	}
+	dir, err := HooksPath()
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=core.hooksPath",
+		"GIT_CONFIG_VALUE_0=" + dir,
+		"GANDALF_CONFIG=" + ConfigFile,
+	}, nil
+}
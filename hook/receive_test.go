@@ -0,0 +1,156 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestHooksPath(c *check.C) {
+	p, err := HooksPath()
+	c.Assert(err, check.IsNil)
+	c.Assert(p, check.Equals, "/var/lib/gandalf/repositories/.gandalf/hooks")
+	config.Set("git:hooks-path", "/etc/gandalf/hooks")
+	defer config.Unset("git:hooks-path")
+	p, err = HooksPath()
+	c.Assert(err, check.IsNil)
+	c.Assert(p, check.Equals, "/etc/gandalf/hooks")
+}
+
+func (s *S) TestReceiveHookContent(c *check.C) {
+	expected := `#!/bin/sh
+# Installed by gandalf, do not edit.
+'/usr/bin/gandalf-ssh' --update-hook "$@" || exit 1
+hook="$GIT_DIR/hooks/update"
+if [ -x "$hook" ]; then
+	exec "$hook" "$@"
+fi
+`
+	c.Assert(receiveHookContent("update", "/usr/bin/gandalf-ssh"), check.Equals, expected)
+	expected = `#!/bin/sh
+# Installed by gandalf, do not edit.
+input=$(cat)
+[ -z "$GANDALF_REF_UPDATES" ] || printf '%s\n' "$input" >> "$GANDALF_REF_UPDATES"
+hook="$GIT_DIR/hooks/post-receive"
+if [ -x "$hook" ]; then
+	printf '%s\n' "$input" | exec "$hook" "$@"
+fi
+`
+	c.Assert(receiveHookContent("post-receive", "/usr/bin/gandalf-ssh"), check.Equals, expected)
+	expected = `#!/bin/sh
+# Installed by gandalf, do not edit.
+hook="$GIT_DIR/hooks/post-update"
+if [ -x "$hook" ]; then
+	exec "$hook" "$@"
+fi
+`
+	c.Assert(receiveHookContent("post-update", "/usr/bin/gandalf-ssh"), check.Equals, expected)
+}
+
+func (s *S) TestPostReceiveHookRecordsRefUpdates(c *check.C) {
+	dir, err := ioutil.TempDir("", "gandalf-hook")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	err = os.Mkdir(path.Join(dir, "hooks"), 0755)
+	c.Assert(err, check.IsNil)
+	repoHook := "#!/bin/sh\ncat > \"$GIT_DIR/received\"\n"
+	err = ioutil.WriteFile(path.Join(dir, "hooks", "post-receive"), []byte(repoHook), 0755)
+	c.Assert(err, check.IsNil)
+	hookPath := path.Join(dir, "gandalf-post-receive")
+	err = ioutil.WriteFile(hookPath, []byte(receiveHookContent("post-receive", "/usr/bin/gandalf-ssh")), 0755)
+	c.Assert(err, check.IsNil)
+	input := "1111111111111111111111111111111111111111 2222222222222222222222222222222222222222 refs/heads/master\n"
+	cmd := exec.Command(hookPath)
+	cmd.Env = append(os.Environ(), "GIT_DIR="+dir, "GANDALF_REF_UPDATES="+path.Join(dir, "refs"))
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, check.IsNil, check.Commentf("%s", out))
+	recorded, err := ioutil.ReadFile(path.Join(dir, "refs"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(recorded), check.Equals, input)
+	received, err := ioutil.ReadFile(path.Join(dir, "received"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(received), check.Equals, input)
+}
+
+func (s *S) TestInstallReceiveHooks(c *check.C) {
+	err := InstallReceiveHooks()
+	c.Assert(err, check.IsNil)
+	dir, err := HooksPath()
+	c.Assert(err, check.IsNil)
+	for _, name := range receiveHooks {
+		file, err := s.rfs.Open(dir + "/" + name)
+		c.Assert(err, check.IsNil)
+		content, err := ioutil.ReadAll(file)
+		file.Close()
+		c.Assert(err, check.IsNil)
+		c.Assert(string(content), check.Equals, receiveHookContent(name, "/usr/bin/gandalf-ssh"))
+		tmpPath := fmt.Sprintf("%s/%s.%d.tmp", dir, name, os.Getpid())
+		c.Assert(s.rfs.HasAction(fmt.Sprintf("rename %s %s/%s", tmpPath, dir, name)), check.Equals, true)
+	}
+}
+
+func (s *S) TestInstallReceiveHooksUpToDate(c *check.C) {
+	dir, err := HooksPath()
+	c.Assert(err, check.IsNil)
+	for _, name := range receiveHooks {
+		err = createHookFile(dir+"/"+name, []byte(receiveHookContent(name, "/usr/bin/gandalf-ssh")))
+		c.Assert(err, check.IsNil)
+	}
+	err = InstallReceiveHooks()
+	c.Assert(err, check.IsNil)
+	for _, name := range receiveHooks {
+		tmpPath := fmt.Sprintf("%s/%s.%d.tmp", dir, name, os.Getpid())
+		c.Assert(s.rfs.HasAction(fmt.Sprintf("rename %s %s/%s", tmpPath, dir, name)), check.Equals, false)
+	}
+}
+
+func (s *S) TestReceivePackEnv(c *check.C) {
+	env, err := ReceivePackEnv()
+	c.Assert(err, check.IsNil)
+	c.Assert(env, check.DeepEquals, []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=core.hooksPath",
+		"GIT_CONFIG_VALUE_0=/var/lib/gandalf/repositories/.gandalf/hooks",
+		"GANDALF_CONFIG=/etc/gandalf.conf",
+	})
+}
+
+func (s *S) TestReceivePackEnvConfigFile(c *check.C) {
+	old := ConfigFile
+	ConfigFile = "/home/gandalf/gandalf.conf"
+	defer func() { ConfigFile = old }()
+	env, err := ReceivePackEnv()
+	c.Assert(err, check.IsNil)
+	c.Assert(env[len(env)-1], check.Equals, "GANDALF_CONFIG=/home/gandalf/gandalf.conf")
+}
+
+func (s *S) TestReceivePackEnvOldGit(c *check.C) {
+	oldErr := gitCheck.err
+	gitCheck.err = checkVersionOutput("git version 2.30.1")
+	defer func() { gitCheck.err = oldErr }()
+	env, err := ReceivePackEnv()
+	c.Assert(err, check.ErrorMatches, `pushes require git 2.31 or later to run the gandalf hooks, found "git version 2.30.1"`)
+	c.Assert(env, check.IsNil)
+	_, err = s.rfs.Open("/var/lib/gandalf/repositories/.gandalf/hooks/update")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestCheckVersionOutput(c *check.C) {
+	c.Assert(checkVersionOutput("git version 2.31.0"), check.IsNil)
+	c.Assert(checkVersionOutput("git version 2.39.5 (Apple Git-154)"), check.IsNil)
+	c.Assert(checkVersionOutput("git version 3.0.0"), check.IsNil)
+	c.Assert(checkVersionOutput("git version 2.30.9"), check.NotNil)
+	c.Assert(checkVersionOutput("git version 1.9.1"), check.NotNil)
+	c.Assert(checkVersionOutput(""), check.ErrorMatches, `could not parse the version of git: ""`)
+}
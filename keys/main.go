@@ -0,0 +1,79 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// gandalf-keys is meant to be used as sshd's AuthorizedKeysCommand. Given the
+// user name and the fingerprint of the key used to log in, it prints the
+// authorized_keys line of the matching key, looked up in gandalf's database.
+// When also given the key type, it prints the lines of the registered
+// certificate authorities if the user logs in with a certificate:
+//
+//	AuthorizedKeysCommand /usr/bin/gandalf-keys %u %f %t
+//	AuthorizedKeysCommandUser git
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/user"
+)
+
+// printKey writes the authorized_keys line of the key with the given
+// fingerprint to w, or the lines of the certificate authorities when the key
+// is a certificate. Nothing is written when the login user is not the one
+// gandalf runs as, when the key is unknown or expired, or when its user is
+// suspended.
+func printKey(args []string, w io.Writer) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errors.New("Usage: gandalf-keys <user> <fingerprint> [<key type>]")
+	}
+	uid, err := config.GetString("uid")
+	if err != nil {
+		return err
+	}
+	if args[0] != uid {
+		return nil
+	}
+	if len(args) == 3 && strings.HasSuffix(args[2], "-cert-v01@openssh.com") {
+		authorities, err := user.AuthorizedAuthorities()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(w, authorities)
+		return err
+	}
+	k, err := user.GetKeyByFingerprint(args[1])
+	if err == user.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if k.Expired() {
+		return nil
+	}
+	suspended, err := user.IsSuspended(k.UserName)
+	if err != nil || suspended {
+		return err
+	}
+	_, err = fmt.Fprint(w, k.AuthorizedKey())
+	return err
+}
+
+func main() {
+	err := config.ReadConfigFile("/etc/gandalf.conf")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	err = printKey(os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
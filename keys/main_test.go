@@ -0,0 +1,104 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/user"
+	"gopkg.in/check.v1"
+)
+
+const rawKey = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCaNZSIEyP6FSdCX0WHDcUFTvebNbvqKiiLEiC7NTGvKrT15r2MtCDi4EPi4Ul+UyxWqb2D7FBnK1UmIcEFHd/ZCnBod2/FSplGOIbIb2UVVbqPX5Alv7IBCMyZJD14ex5cFh16zoqOsPOkOD803LMIlNvXPDDwKjY4TVOQV1JtA2tbZXvYUchqhTcKPxt5BDBZbeQkMMgUgHIEz6IueglFB3+dIZfrzlmM8CVSElKZOpucnJ5JOpGh3paSO/px2ZEcvY8WvjFdipvAWsis75GG/04F641I6XmYlo9fib/YytBXS23szqmvOqEqAopFnnGkDEo+LWI0+FXgPE8lc5BD me@host"
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Assert(err, check.IsNil)
+	config.Set("database:name", "gandalf_keys_tests")
+	config.Set("authorized-keys-disabled", true)
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	config.Unset("authorized-keys-disabled")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.User().Database.DropDatabase()
+}
+
+func (s *S) TestPrintKey(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{"mykey": rawKey})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	keys, err := user.ListKeys("bilbo")
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+	var buf bytes.Buffer
+	err = printKey([]string{"git", keys[0].Fingerprint}, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, keys[0].AuthorizedKey())
+}
+
+func (s *S) TestPrintKeySuspendedUser(c *check.C) {
+	_, err := user.New("bilbo", map[string]string{"mykey": rawKey})
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	err = user.Suspend("bilbo")
+	c.Assert(err, check.IsNil)
+	keys, err := user.ListKeys("bilbo")
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	err = printKey([]string{"git", keys[0].Fingerprint}, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "")
+}
+
+func (s *S) TestPrintKeyCertificate(c *check.C) {
+	_, err := user.New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer user.Remove("bilbo")
+	err = user.AddPrincipal("bilbo", "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	err = user.AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	defer user.RemoveAuthority("shire")
+	expected, err := user.AuthorizedAuthorities()
+	c.Assert(err, check.IsNil)
+	c.Assert(expected, check.Matches, `cert-authority,principals="bilbo@shire",.*\n`)
+	var buf bytes.Buffer
+	err = printKey([]string{"git", "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM", "ssh-rsa-cert-v01@openssh.com"}, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, expected)
+}
+
+func (s *S) TestPrintKeyNotFound(c *check.C) {
+	var buf bytes.Buffer
+	err := printKey([]string{"git", "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM"}, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "")
+}
+
+func (s *S) TestPrintKeyOtherUser(c *check.C) {
+	var buf bytes.Buffer
+	err := printKey([]string{"root", "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM"}, &buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(buf.String(), check.Equals, "")
+}
+
+func (s *S) TestPrintKeyInvalidArguments(c *check.C) {
+	var buf bytes.Buffer
+	err := printKey([]string{"git"}, &buf)
+	c.Assert(err, check.ErrorMatches, `^Usage: gandalf-keys <user> <fingerprint> \[<key type>\]$`)
+	c.Assert(buf.String(), check.Equals, "")
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+)
+
+// GrantExpiration is the time when the full or read-only access of a user in
+// a repository lapses. Expired grants are ignored by permission checks, and
+// removed by RemoveExpiredGrants.
+type GrantExpiration struct {
+	User      string    `json:"user"`
+	ReadOnly  bool      `json:"readOnly"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Expired returns whether the grant has expired.
+func (e *GrantExpiration) Expired() bool {
+	return !e.ExpiresAt.After(time.Now())
+}
+
+// GrantExpiringAccess gives full or read-only permission for users in all
+// specified repositories until expiresAt. A zero expiresAt gives permanent
+// access, like GrantAccess. Granting access again replaces the previous
+// expiration of the users.
+//
+// The new expirations are written before the users are added, so the access
+// is never permanent, not even for a moment or when the second update fails.
+// Until the old expirations are removed, the earliest one applies.
+func GrantExpiringAccess(rNames, uNames []string, readOnly bool, expiresAt time.Time) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	field := "users"
+	if readOnly {
+		field = "readonlyusers"
+	}
+	q := bson.M{"_id": bson.M{"$in": rNames}}
+	stale := bson.M{"user": bson.M{"$in": uNames}, "readonly": readOnly}
+	if !expiresAt.IsZero() {
+		// MongoDB stores times with millisecond precision.
+		expiresAt = expiresAt.Truncate(time.Millisecond)
+		expirations := make([]GrantExpiration, len(uNames))
+		for i, name := range uNames {
+			expirations[i] = GrantExpiration{User: name, ReadOnly: readOnly, ExpiresAt: expiresAt}
+		}
+		info, err := conn.Repository().UpdateAll(q, bson.M{"$addToSet": bson.M{"expirations": bson.M{"$each": expirations}}})
+		if err != nil {
+			return err
+		}
+		if info.Matched == 0 {
+			return ErrRepositoryNotFound
+		}
+		stale["expiresat"] = bson.M{"$ne": expiresAt}
+	}
+	info, err := conn.Repository().UpdateAll(q, bson.M{
+		"$addToSet": bson.M{field: bson.M{"$each": uNames}},
+		"$pull":     bson.M{"expirations": stale},
+	})
+	if err != nil {
+		return err
+	}
+	if info.Matched == 0 {
+		return ErrRepositoryNotFound
+	}
+	return nil
+}
+
+// expired returns whether the full or read-only access of the user in the
+// repository has expired. When the user has more than one expiration, while
+// a grant is being renewed, any of them expires the access.
+func (r *Repository) expired(userName string, readOnly bool) bool {
+	for _, e := range r.Expirations {
+		if e.User == userName && e.ReadOnly == readOnly && e.Expired() {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveExpiredGrants revokes the expired grants of all repositories,
+// returning them by repository name.
+func RemoveExpiredGrants() (map[string][]GrantExpiration, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	now := time.Now()
+	var repositories []Repository
+	err = conn.Repository().Find(bson.M{"expirations.expiresat": bson.M{"$lte": now}}).All(&repositories)
+	if err != nil {
+		return nil, err
+	}
+	removed := map[string][]GrantExpiration{}
+	for _, r := range repositories {
+		for _, e := range r.Expirations {
+			if e.ExpiresAt.After(now) {
+				continue
+			}
+			field := "users"
+			if e.ReadOnly {
+				field = "readonlyusers"
+			}
+			expired := bson.M{"user": e.User, "readonly": e.ReadOnly, "expiresat": bson.M{"$lte": now}}
+			// the grant may have been renewed since it was loaded.
+			err = conn.Repository().Update(
+				bson.M{"_id": r.Name, "expirations": bson.M{"$elemMatch": expired}},
+				bson.M{"$pull": bson.M{field: e.User, "expirations": expired}},
+			)
+			if err == mgo.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			removed[r.Name] = append(removed[r.Name], e)
+		}
+	}
+	return removed, nil
+}
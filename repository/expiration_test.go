@@ -0,0 +1,186 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestGrantExpirationExpired(c *check.C) {
+	e := GrantExpiration{User: "bilbo", ExpiresAt: time.Now().Add(-time.Minute)}
+	c.Assert(e.Expired(), check.Equals, true)
+	e.ExpiresAt = time.Now().Add(time.Hour)
+	c.Assert(e.Expired(), check.Equals, false)
+}
+
+func (s *S) TestPermissionIgnoresExpiredGrants(c *check.C) {
+	r := Repository{
+		Name:          "myapp",
+		Users:         []string{"bilbo", "frodo"},
+		ReadOnlyUsers: []string{"bilbo", "sam"},
+		Expirations: []GrantExpiration{
+			{User: "bilbo", ExpiresAt: time.Now().Add(-time.Minute)},
+			{User: "frodo", ExpiresAt: time.Now().Add(time.Hour)},
+			{User: "sam", ReadOnly: true, ExpiresAt: time.Now().Add(-time.Minute)},
+		},
+	}
+	c.Assert(r.Permission("bilbo"), check.DeepEquals, Permission{Repository: "myapp", User: "bilbo", Access: AccessRead, Source: SourceReadOnly})
+	c.Assert(r.HasWritePermission("frodo"), check.Equals, true)
+	c.Assert(r.HasReadPermission("sam"), check.Equals, false)
+}
+
+func (s *S) TestMarshalJSONWithExpirations(c *check.C) {
+	expiresAt := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	repo := Repository{Name: "somerepo", Expirations: []GrantExpiration{{User: "bilbo", ExpiresAt: expiresAt}}}
+	data, err := json.Marshal(&repo)
+	c.Assert(err, check.IsNil)
+	var result struct {
+		Expirations []GrantExpiration
+	}
+	err = json.Unmarshal(data, &result)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Expirations, check.DeepEquals, repo.Expirations)
+}
+
+func (s *S) TestGrantExpiringAccess(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "myapp", Users: []string{"gandalf"}})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	err = GrantExpiringAccess([]string{"myapp"}, []string{"bilbo"}, true, expiresAt)
+	c.Assert(err, check.IsNil)
+	r, err := Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.ReadOnlyUsers, check.DeepEquals, []string{"bilbo"})
+	c.Assert(r.Expirations, check.HasLen, 1)
+	c.Assert(r.Expirations[0].User, check.Equals, "bilbo")
+	c.Assert(r.Expirations[0].ReadOnly, check.Equals, true)
+	c.Assert(r.Expirations[0].ExpiresAt.Equal(expiresAt), check.Equals, true)
+	err = GrantExpiringAccess([]string{"myapp"}, []string{"bilbo"}, true, expiresAt.Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	r, err = Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Expirations, check.HasLen, 1)
+	c.Assert(r.Expirations[0].ExpiresAt.Equal(expiresAt.Add(time.Hour)), check.Equals, true)
+}
+
+func (s *S) TestGrantExpiringAccessSameExpiration(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "myapp", Users: []string{"gandalf"}})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	expiresAt := time.Now().Add(time.Hour)
+	err = GrantExpiringAccess([]string{"myapp"}, []string{"bilbo"}, false, expiresAt)
+	c.Assert(err, check.IsNil)
+	err = GrantExpiringAccess([]string{"myapp"}, []string{"bilbo"}, false, expiresAt)
+	c.Assert(err, check.IsNil)
+	r, err := Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Users, check.DeepEquals, []string{"gandalf", "bilbo"})
+	c.Assert(r.Expirations, check.HasLen, 1)
+}
+
+func (s *S) TestGrantExpiringAccessOfPermanentUser(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "myapp", Users: []string{"bilbo"}})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	err = GrantExpiringAccess([]string{"myapp"}, []string{"bilbo"}, false, time.Now().Add(-time.Minute))
+	c.Assert(err, check.IsNil)
+	r, err := Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.HasWritePermission("bilbo"), check.Equals, false)
+}
+
+func (s *S) TestPermissionWhileRenewingGrant(c *check.C) {
+	r := Repository{
+		Name:  "myapp",
+		Users: []string{"bilbo"},
+		Expirations: []GrantExpiration{
+			{User: "bilbo", ExpiresAt: time.Now().Add(time.Hour)},
+			{User: "bilbo", ExpiresAt: time.Now().Add(-time.Minute)},
+		},
+	}
+	c.Assert(r.HasWritePermission("bilbo"), check.Equals, false)
+}
+
+func (s *S) TestGrantAccessRemovesExpiration(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "myapp"})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	err = GrantExpiringAccess([]string{"myapp"}, []string{"bilbo"}, false, time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	err = GrantAccess([]string{"myapp"}, []string{"bilbo"}, false)
+	c.Assert(err, check.IsNil)
+	r, err := Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Users, check.DeepEquals, []string{"bilbo"})
+	c.Assert(r.Expirations, check.HasLen, 0)
+}
+
+func (s *S) TestRevokeAccessRemovesExpiration(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "myapp", Users: []string{"gandalf"}})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	err = GrantExpiringAccess([]string{"myapp"}, []string{"bilbo"}, false, time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	err = RevokeAccess([]string{"myapp"}, []string{"bilbo"}, false)
+	c.Assert(err, check.IsNil)
+	r, err := Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Users, check.DeepEquals, []string{"gandalf"})
+	c.Assert(r.Expirations, check.HasLen, 0)
+}
+
+func (s *S) TestGrantExpiringAccessNotFound(c *check.C) {
+	err := GrantExpiringAccess([]string{"super-repo"}, []string{"bilbo"}, false, time.Now().Add(time.Hour))
+	c.Assert(err, check.Equals, ErrRepositoryNotFound)
+}
+
+func (s *S) TestRemoveExpiredGrants(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	expired := GrantExpiration{User: "bilbo", ExpiresAt: time.Now().Add(-time.Minute).Truncate(time.Millisecond)}
+	pending := GrantExpiration{User: "frodo", ReadOnly: true, ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Millisecond)}
+	r := Repository{
+		Name:          "myapp",
+		Users:         []string{"gandalf", "bilbo"},
+		ReadOnlyUsers: []string{"frodo"},
+		Expirations:   []GrantExpiration{expired, pending},
+	}
+	err = conn.Repository().Insert(r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	removed, err := RemoveExpiredGrants()
+	c.Assert(err, check.IsNil)
+	c.Assert(removed, check.HasLen, 1)
+	c.Assert(removed["myapp"], check.HasLen, 1)
+	c.Assert(removed["myapp"][0].User, check.Equals, "bilbo")
+	err = conn.Repository().Find(bson.M{"_id": "myapp"}).One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Users, check.DeepEquals, []string{"gandalf"})
+	c.Assert(r.ReadOnlyUsers, check.DeepEquals, []string{"frodo"})
+	c.Assert(r.Expirations, check.HasLen, 1)
+	c.Assert(r.Expirations[0].User, check.Equals, "frodo")
+}
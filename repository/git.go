@@ -5,9 +5,12 @@
 package repository
 
 import (
+	"errors"
 	"fmt"
 	"os/exec"
 	"path"
+	"regexp"
+	"strings"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/fs"
@@ -15,6 +18,17 @@ import (
 
 var bare string
 
+// ErrInvalidGitCommand is returned by ParseGitCommand when the command is not
+// a git command that gandalf is willing to run.
+var ErrInvalidGitCommand = errors.New("You've tried to execute some weird command, I'm deliberately denying you to do that, get over it.")
+
+// gitCommandRegexp validates git commands sent by ssh clients, which are in
+// the form "<git-command> '[<namespace>/]<name>.git'", with namespace being
+// optional. A namespace contains only alphanumerics, underlines, @´s, -´s,
+// +´s and periods, but it does not start with a period (.), and one and
+// exactly one slash (/) separates namespace and the actual name.
+var gitCommandRegexp = regexp.MustCompile(`(git-[a-z-]+) '/?([\w-+@][\w-+.@]*/)?([\w-]+)\.git'`)
+
 func bareLocation() string {
 	if bare != "" {
 		return bare
@@ -31,6 +45,23 @@ func barePath(name string) string {
 	return path.Join(bareLocation(), name+".git")
 }
 
+// BarePath returns the location of the bare git repository with the given
+// name in the filesystem.
+func BarePath(name string) string {
+	return barePath(name)
+}
+
+// ParseGitCommand parses a git command sent by a ssh client (e.g.
+// "git-receive-pack 'foo.git'"), returning the git command and the name of
+// the repository.
+func ParseGitCommand(command string) (action, name string, err error) {
+	m := gitCommandRegexp.FindStringSubmatch(command)
+	if len(m) != 4 {
+		return "", "", ErrInvalidGitCommand
+	}
+	return m[1], m[2] + m[3], nil
+}
+
 func newBare(name string) error {
 	args := []string{"init", barePath(name), "--bare"}
 	if bareTempl, err := config.GetString("git:bare:template"); err == nil {
@@ -51,3 +82,20 @@ func removeBare(name string) error {
 	}
 	return nil
 }
+
+// ListRefs returns the revision of every ref of the repository, by ref name.
+func ListRefs(name string) (map[string]string, error) {
+	cmd := exec.Command("git", "for-each-ref", "--format=%(objectname) %(refname)")
+	cmd.Dir = barePath(name)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list the refs of repository %s: %s", name, err)
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
@@ -96,3 +96,52 @@ func (s *S) TestRemoveBareShouldReturnDescriptiveErrorWhenRemovalFails(c *check.
 	err := removeBare("fooo")
 	c.Assert(err, check.ErrorMatches, "^Could not remove git bare repository: .*")
 }
+
+func (s *S) TestParseGitCommand(c *check.C) {
+	action, name, err := ParseGitCommand("git-receive-pack 'foobar.git'")
+	c.Assert(err, check.IsNil)
+	c.Assert(action, check.Equals, "git-receive-pack")
+	c.Assert(name, check.Equals, "foobar")
+}
+
+func (s *S) TestParseGitCommandWithNamespace(c *check.C) {
+	action, name, err := ParseGitCommand("git-upload-pack '/team/foo-bar.git'")
+	c.Assert(err, check.IsNil)
+	c.Assert(action, check.Equals, "git-upload-pack")
+	c.Assert(name, check.Equals, "team/foo-bar")
+}
+
+func (s *S) TestParseGitCommandInvalid(c *check.C) {
+	commands := []string{"git-receive-pack foobar", "git-receive-pack ../foobar", "git-receive-pack /etc", "rm -rf /", ""}
+	for _, command := range commands {
+		_, name, err := ParseGitCommand(command)
+		c.Check(err, check.Equals, ErrInvalidGitCommand)
+		c.Check(name, check.Equals, "")
+	}
+}
+
+func (s *S) TestListRefsIntegration(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, "Just a regular readme.")
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	hash, err := GetLastHashCommit(bare, repo)
+	c.Assert(err, check.IsNil)
+	refs, err := ListRefs(repo)
+	c.Assert(err, check.IsNil)
+	c.Assert(refs, check.DeepEquals, map[string]string{"refs/heads/master": string(hash)})
+}
+
+func (s *S) TestListRefsRepositoryNotFound(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	defer func() { bare = oldBare }()
+	_, err := ListRefs("gandalf-ghost-repo")
+	c.Assert(err, check.ErrorMatches, "Could not list the refs of repository gandalf-ghost-repo: .*")
+}
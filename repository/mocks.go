@@ -27,6 +27,7 @@ type MockContentRetriever struct {
 	ClonePath      string
 	CleanUp        func()
 	History        GitHistory
+	LastCommit     GitCommit
 }
 
 func (r *MockContentRetriever) GetContents(repo, ref, path string) ([]byte, error) {
@@ -408,6 +409,7 @@ func (r *MockContentRetriever) CommitZip(repo string, z *multipart.FileHeader, c
 	if r.OutputError != nil {
 		return nil, r.OutputError
 	}
+	r.LastCommit = c
 	return &r.Ref, nil
 }
 
@@ -0,0 +1,249 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/tsuru/log"
+)
+
+var (
+	ErrNamespaceAlreadyExists = errors.New("namespace already exists")
+	ErrNamespaceNotFound      = errors.New("namespace not found")
+	ErrNamespaceNotEmpty      = errors.New("namespace still has repositories")
+
+	namespaceRegexp = regexp.MustCompile(`^[\w-+@][\w-+.@]*$`)
+)
+
+// Namespace holds the access granted to all repositories named
+// "<namespace>/<name>", including the ones created after the grant. Owners
+// have full access to the repositories of the namespace.
+type Namespace struct {
+	Name           string `bson:"_id"`
+	Owners         []string
+	Users          []string
+	ReadOnlyUsers  []string
+	Groups         []string
+	ReadOnlyGroups []string
+	AllowedSources []string
+}
+
+type InvalidNamespaceError struct {
+	message string
+}
+
+func (err *InvalidNamespaceError) Error() string {
+	return err.message
+}
+
+// namespaceOf returns the namespace of the repository, or an empty string if
+// the repository is not in a namespace.
+func namespaceOf(repoName string) string {
+	if i := strings.Index(repoName, "/"); i > 0 {
+		return repoName[:i]
+	}
+	return ""
+}
+
+// NewNamespace creates a namespace, owned by the given users.
+func NewNamespace(name string, owners []string) (*Namespace, error) {
+	log.Debugf("Creating namespace %q", name)
+	if !namespaceRegexp.MatchString(name) {
+		return nil, &InvalidNamespaceError{message: "namespace name is not valid"}
+	}
+	if len(owners) == 0 {
+		return nil, &InvalidNamespaceError{message: "namespace should have at least one owner"}
+	}
+	n := &Namespace{Name: name, Owners: owners}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.Namespace().Insert(n); err != nil {
+		if mgo.IsDup(err) {
+			return nil, ErrNamespaceAlreadyExists
+		}
+		return nil, err
+	}
+	return n, nil
+}
+
+// GetNamespace finds a namespace by name.
+func GetNamespace(name string) (Namespace, error) {
+	var n Namespace
+	conn, err := db.Conn()
+	if err != nil {
+		return n, err
+	}
+	defer conn.Close()
+	err = conn.Namespace().FindId(name).One(&n)
+	if err == mgo.ErrNotFound {
+		return n, ErrNamespaceNotFound
+	}
+	return n, err
+}
+
+// ListNamespaces lists all namespaces.
+func ListNamespaces() ([]Namespace, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	namespaces := []Namespace{}
+	err = conn.Namespace().Find(nil).Sort("_id").All(&namespaces)
+	return namespaces, err
+}
+
+// OwnedNamespaces returns the names of the namespaces owned by the user.
+func OwnedNamespaces(userName string) ([]string, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var namespaces []Namespace
+	err = conn.Namespace().Find(bson.M{"owners": userName}).Select(bson.M{"_id": 1}).Sort("_id").All(&namespaces)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(namespaces))
+	for i, n := range namespaces {
+		names[i] = n.Name
+	}
+	return names, nil
+}
+
+// RemoveNamespace removes a namespace. Namespaces with repositories can't be
+// removed.
+func RemoveNamespace(name string) error {
+	log.Debugf("Removing namespace %q", name)
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	n, err := conn.Repository().Find(bson.M{"_id": bson.M{"$regex": "^" + regexp.QuoteMeta(name) + "/"}}).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrNamespaceNotEmpty
+	}
+	err = conn.Namespace().RemoveId(name)
+	if err == mgo.ErrNotFound {
+		return ErrNamespaceNotFound
+	}
+	return err
+}
+
+// updateNamespace applies the update to the namespace with the given name.
+func updateNamespace(name string, update bson.M) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Namespace().UpdateId(name, update)
+	if err == mgo.ErrNotFound {
+		return ErrNamespaceNotFound
+	}
+	return err
+}
+
+// AddNamespaceOwners adds owners to the namespace.
+func AddNamespaceOwners(name string, owners []string) error {
+	return updateNamespace(name, bson.M{"$addToSet": bson.M{"owners": bson.M{"$each": owners}}})
+}
+
+// RemoveNamespaceOwners removes owners from the namespace. The last owner
+// can't be removed.
+func RemoveNamespaceOwners(name string, owners []string) error {
+	n, err := GetNamespace(name)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, owner := range n.Owners {
+		if !contains(owners, owner) {
+			remaining++
+		}
+	}
+	if remaining == 0 {
+		return &InvalidNamespaceError{message: "namespace should have at least one owner"}
+	}
+	return updateNamespace(name, bson.M{"$pullAll": bson.M{"owners": owners}})
+}
+
+// GrantNamespaceAccess gives full or read-only permission for users and
+// groups in all repositories of the namespace. Like GrantGroupAccess, it
+// returns group.ErrGroupNotFound, without granting anything, when any of the
+// groups doesn't exist.
+func GrantNamespaceAccess(name string, users, groups []string, readOnly bool) error {
+	if err := checkGroups(groups); err != nil {
+		return err
+	}
+	usersField, groupsField := "users", "groups"
+	if readOnly {
+		usersField, groupsField = "readonlyusers", "readonlygroups"
+	}
+	if users == nil {
+		users = []string{}
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	return updateNamespace(name, bson.M{"$addToSet": bson.M{
+		usersField:  bson.M{"$each": users},
+		groupsField: bson.M{"$each": groups},
+	}})
+}
+
+// RevokeNamespaceAccess revokes both full and read-only permission from users
+// and groups in the namespace. Access granted directly in repositories is
+// kept.
+func RevokeNamespaceAccess(name string, users, groups []string) error {
+	if users == nil {
+		users = []string{}
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	return updateNamespace(name, bson.M{"$pullAll": bson.M{
+		"users":          users,
+		"readonlyusers":  users,
+		"groups":         groups,
+		"readonlygroups": groups,
+	}})
+}
+
+// RemoveUserFromNamespaces revokes the access the user has in all namespaces.
+func RemoveUserFromNamespaces(userName string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	q := bson.M{"$or": []bson.M{{"owners": userName}, {"users": userName}, {"readonlyusers": userName}}}
+	update := bson.M{"$pull": bson.M{"owners": userName, "users": userName, "readonlyusers": userName}}
+	_, err = conn.Namespace().UpdateAll(q, update)
+	return err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
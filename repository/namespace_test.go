@@ -0,0 +1,198 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/group"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestNamespaceOf(c *check.C) {
+	c.Assert(namespaceOf("team/myapp"), check.Equals, "team")
+	c.Assert(namespaceOf("myapp"), check.Equals, "")
+}
+
+func (s *S) TestNewNamespace(c *check.C) {
+	n, err := NewNamespace("team", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace(n.Name)
+	found, err := GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Owners, check.DeepEquals, []string{"bilbo"})
+}
+
+func (s *S) TestNewNamespaceInvalidName(c *check.C) {
+	for _, name := range []string{"", "team/other", ".team", "my team"} {
+		_, err := NewNamespace(name, []string{"bilbo"})
+		c.Check(err, check.FitsTypeOf, &InvalidNamespaceError{})
+	}
+}
+
+func (s *S) TestNewNamespaceWithoutOwners(c *check.C) {
+	_, err := NewNamespace("team", nil)
+	c.Assert(err, check.ErrorMatches, "namespace should have at least one owner")
+}
+
+func (s *S) TestNewNamespaceDuplicate(c *check.C) {
+	_, err := NewNamespace("team", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	_, err = NewNamespace("team", []string{"frodo"})
+	c.Assert(err, check.Equals, ErrNamespaceAlreadyExists)
+}
+
+func (s *S) TestGetNamespaceNotFound(c *check.C) {
+	_, err := GetNamespace("mordor")
+	c.Assert(err, check.Equals, ErrNamespaceNotFound)
+}
+
+func (s *S) TestListNamespaces(c *check.C) {
+	_, err := NewNamespace("team", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	_, err = NewNamespace("other", []string{"frodo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("other")
+	namespaces, err := ListNamespaces()
+	c.Assert(err, check.IsNil)
+	c.Assert(namespaces, check.HasLen, 2)
+	c.Assert(namespaces[0].Name, check.Equals, "other")
+	c.Assert(namespaces[1].Name, check.Equals, "team")
+}
+
+func (s *S) TestOwnedNamespaces(c *check.C) {
+	_, err := NewNamespace("team", []string{"bilbo", "frodo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	_, err = NewNamespace("other", []string{"frodo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("other")
+	names, err := OwnedNamespaces("frodo")
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.DeepEquals, []string{"other", "team"})
+	names, err = OwnedNamespaces("bilbo")
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.DeepEquals, []string{"team"})
+	names, err = OwnedNamespaces("sam")
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 0)
+}
+
+func (s *S) TestRemoveNamespaceNotFound(c *check.C) {
+	err := RemoveNamespace("mordor")
+	c.Assert(err, check.Equals, ErrNamespaceNotFound)
+}
+
+func (s *S) TestRemoveNamespaceWithRepositories(c *check.C) {
+	_, err := NewNamespace("team", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "team/myapp"})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("team/myapp")
+	err = RemoveNamespace("team")
+	c.Assert(err, check.Equals, ErrNamespaceNotEmpty)
+}
+
+func (s *S) TestAddAndRemoveNamespaceOwners(c *check.C) {
+	_, err := NewNamespace("team", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	err = AddNamespaceOwners("team", []string{"frodo", "bilbo"})
+	c.Assert(err, check.IsNil)
+	n, err := GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Owners, check.DeepEquals, []string{"bilbo", "frodo"})
+	err = RemoveNamespaceOwners("team", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	err = RemoveNamespaceOwners("team", []string{"frodo"})
+	c.Assert(err, check.ErrorMatches, "namespace should have at least one owner")
+	n, err = GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Owners, check.DeepEquals, []string{"frodo"})
+}
+
+func (s *S) TestAddNamespaceOwnersNotFound(c *check.C) {
+	err := AddNamespaceOwners("mordor", []string{"bilbo"})
+	c.Assert(err, check.Equals, ErrNamespaceNotFound)
+}
+
+func (s *S) TestGrantAndRevokeNamespaceAccess(c *check.C) {
+	_, err := NewNamespace("team", []string{"gandalf"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	_, err = group.New("devs", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	err = GrantNamespaceAccess("team", []string{"bilbo"}, []string{"devs"}, false)
+	c.Assert(err, check.IsNil)
+	err = GrantNamespaceAccess("team", []string{"frodo"}, nil, true)
+	c.Assert(err, check.IsNil)
+	n, err := GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Users, check.DeepEquals, []string{"bilbo"})
+	c.Assert(n.Groups, check.DeepEquals, []string{"devs"})
+	c.Assert(n.ReadOnlyUsers, check.DeepEquals, []string{"frodo"})
+	err = RevokeNamespaceAccess("team", []string{"bilbo", "frodo"}, []string{"devs"})
+	c.Assert(err, check.IsNil)
+	n, err = GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Users, check.HasLen, 0)
+	c.Assert(n.Groups, check.HasLen, 0)
+	c.Assert(n.ReadOnlyUsers, check.HasLen, 0)
+}
+
+func (s *S) TestGrantNamespaceAccessNotFound(c *check.C) {
+	err := GrantNamespaceAccess("mordor", []string{"bilbo"}, nil, false)
+	c.Assert(err, check.Equals, ErrNamespaceNotFound)
+}
+
+func (s *S) TestGrantNamespaceAccessGroupNotFound(c *check.C) {
+	_, err := NewNamespace("team", []string{"gandalf"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	_, err = group.New("devs", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	err = GrantNamespaceAccess("team", []string{"bilbo"}, []string{"devs", "qa"}, false)
+	c.Assert(err, check.Equals, group.ErrGroupNotFound)
+	n, err := GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Users, check.HasLen, 0)
+	c.Assert(n.Groups, check.HasLen, 0)
+}
+
+func (s *S) TestRemoveUserFromNamespaces(c *check.C) {
+	_, err := NewNamespace("team", []string{"gandalf", "bilbo"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	err = GrantNamespaceAccess("team", []string{"bilbo"}, nil, true)
+	c.Assert(err, check.IsNil)
+	err = RemoveUserFromNamespaces("bilbo")
+	c.Assert(err, check.IsNil)
+	n, err := GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Owners, check.DeepEquals, []string{"gandalf"})
+	c.Assert(n.ReadOnlyUsers, check.HasLen, 0)
+}
+
+func (s *S) TestRemoveGroupRevokesNamespaceAccess(c *check.C) {
+	_, err := NewNamespace("team", []string{"gandalf"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	_, err = group.New("devs", nil)
+	c.Assert(err, check.IsNil)
+	err = GrantNamespaceAccess("team", nil, []string{"devs"}, false)
+	c.Assert(err, check.IsNil)
+	err = group.Remove("devs")
+	c.Assert(err, check.IsNil)
+	n, err := GetNamespace("team")
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Groups, check.HasLen, 0)
+}
@@ -0,0 +1,263 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/group"
+	"github.com/tsuru/tsuru/log"
+)
+
+// Access levels of users in repositories.
+const (
+	AccessNone  = "none"
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+// Sources of the access of users in repositories.
+const (
+	SourceDirect    = "direct"
+	SourceReadOnly  = "read-only"
+	SourcePublic    = "public"
+	SourceInternal  = "internal"
+	SourceGroup     = "group"
+	SourceNamespace = "namespace"
+)
+
+// Permission is the effective access of a user in a repository, and where
+// it comes from. Source is empty when the user has no access.
+type Permission struct {
+	Repository string `json:"repository"`
+	User       string `json:"user"`
+	Access     string `json:"access"`
+	Source     string `json:"source,omitempty"`
+}
+
+// Permission returns the effective access of the given user in the
+// repository. Full access takes precedence over read-only access, and
+// explicit grants over the visibility of the repository. Expired grants are
+// ignored, and suspended users have no access at all. Anonymous users are
+// represented by an empty user name.
+func (r *Repository) Permission(userName string) Permission {
+	return r.permission(loadSubject(userName), r.namespace())
+}
+
+// permission resolves the access of the subject in the repository, given
+// the namespace of the repository (nil if it's not in a namespace).
+func (r *Repository) permission(s *subject, n *Namespace) Permission {
+	p := Permission{Repository: r.Name, User: s.name, Access: AccessNone}
+	if s.suspended {
+		return p
+	}
+	grant := func(access, source string) Permission {
+		p.Access, p.Source = access, source
+		return p
+	}
+	if contains(r.Users, s.name) && !r.expired(s.name, false) {
+		return grant(AccessWrite, SourceDirect)
+	}
+	if s.memberOf(r.Groups) {
+		return grant(AccessWrite, SourceGroup)
+	}
+	if n != nil && (contains(n.Owners, s.name) || contains(n.Users, s.name) || s.memberOf(n.Groups)) {
+		return grant(AccessWrite, SourceNamespace)
+	}
+	if contains(r.ReadOnlyUsers, s.name) && !r.expired(s.name, true) {
+		return grant(AccessRead, SourceReadOnly)
+	}
+	if s.memberOf(r.ReadOnlyGroups) {
+		return grant(AccessRead, SourceGroup)
+	}
+	if n != nil && (contains(n.ReadOnlyUsers, s.name) || s.memberOf(n.ReadOnlyGroups)) {
+		return grant(AccessRead, SourceNamespace)
+	}
+	switch r.VisibilityLevel() {
+	case VisibilityPublic:
+		return grant(AccessRead, SourcePublic)
+	case VisibilityInternal:
+		if s.registered {
+			return grant(AccessRead, SourceInternal)
+		}
+	}
+	return p
+}
+
+// subject is the user whose permissions are being resolved, loaded once so
+// that checking several grants (or repositories) doesn't hit the database
+// again for each of them.
+type subject struct {
+	name       string
+	registered bool
+	suspended  bool
+	groups     []string
+}
+
+// loadSubject loads the registration, suspension and groups of the user.
+// Anonymous users are neither registered nor members of any group. Lookup
+// errors are logged and leave the user without the corresponding access.
+func loadSubject(userName string) *subject {
+	s := subject{name: userName}
+	if userName == "" {
+		return &s
+	}
+	if err := s.load(); err != nil {
+		log.Errorf("repository: could not load the permissions of %q: %s", userName, err)
+	}
+	return &s
+}
+
+func (s *subject) load() error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var u struct {
+		Suspended bool
+	}
+	err = conn.User().FindId(s.name).Select(bson.M{"suspended": 1}).One(&u)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	s.registered = err == nil && !u.Suspended
+	s.suspended = u.Suspended
+	s.groups, err = group.MemberOf(s.name)
+	return err
+}
+
+// memberOf returns whether the user belongs to any of the given groups.
+func (s *subject) memberOf(groups []string) bool {
+	for _, g := range groups {
+		if contains(s.groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasWritePermission returns whether the given user is allowed to push to
+// the repository, either directly, as a member of one of its groups, or
+// through a grant in the repository namespace.
+func (r *Repository) HasWritePermission(userName string) bool {
+	return r.Permission(userName).Access == AccessWrite
+}
+
+// HasReadPermission returns whether the given user is allowed to fetch from
+// the repository. Public repositories can be read by anyone, including
+// anonymous users (represented by an empty user name), and internal
+// repositories by any registered user.
+func (r *Repository) HasReadPermission(userName string) bool {
+	return r.Permission(userName).Access != AccessNone
+}
+
+// granted returns whether the user is one of the given users or a member of
+// one of the given groups.
+func (r *Repository) granted(users, groups []string, userName string) bool {
+	if contains(users, userName) {
+		return true
+	}
+	return r.hasMember(groups, userName)
+}
+
+// hasMember returns whether the user belongs to any of the given groups.
+// Anonymous users don't belong to any group.
+func (r *Repository) hasMember(groups []string, userName string) bool {
+	if userName == "" {
+		return false
+	}
+	member, err := group.IsMember(userName, groups)
+	if err != nil {
+		log.Errorf("repository: could not check the groups of %q in %q: %s", userName, r.Name, err)
+		return false
+	}
+	return member
+}
+
+// namespace returns the namespace of the repository, or nil if the
+// repository is not in a registered namespace. Grants are resolved when
+// checked, so repositories created later inherit them.
+func (r *Repository) namespace() *Namespace {
+	name := namespaceOf(r.Name)
+	if name == "" {
+		return nil
+	}
+	n, err := GetNamespace(name)
+	if err == ErrNamespaceNotFound {
+		return nil
+	}
+	if err != nil {
+		log.Errorf("repository: could not get the namespace of %q: %s", r.Name, err)
+		return nil
+	}
+	return &n
+}
+
+// ListPermissions returns the effective access of the user in every
+// repository the user can reach, sorted by repository name. Public and
+// internal repositories are included.
+func ListPermissions(userName string) ([]Permission, error) {
+	s := subject{name: userName}
+	if userName != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	permissions := []Permission{}
+	if s.suspended {
+		return permissions, nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var namespaces []Namespace
+	err = conn.Namespace().Find(bson.M{"$or": []bson.M{
+		{"owners": userName},
+		{"users": userName},
+		{"readonlyusers": userName},
+		{"groups": bson.M{"$in": s.groups}},
+		{"readonlygroups": bson.M{"$in": s.groups}},
+	}}).All(&namespaces)
+	if err != nil {
+		return nil, err
+	}
+	q := []bson.M{
+		{"users": userName},
+		{"readonlyusers": userName},
+		{"groups": bson.M{"$in": s.groups}},
+		{"readonlygroups": bson.M{"$in": s.groups}},
+		{"ispublic": true},
+		{"visibility": bson.M{"$in": []Visibility{VisibilityInternal, VisibilityPublic}}},
+	}
+	// Only the namespaces found above can grant access to the user, so
+	// they're the only ones needed to resolve the permissions below.
+	granting := make(map[string]*Namespace, len(namespaces))
+	if len(namespaces) > 0 {
+		names := make([]string, len(namespaces))
+		for i := range namespaces {
+			granting[namespaces[i].Name] = &namespaces[i]
+			names[i] = regexp.QuoteMeta(namespaces[i].Name)
+		}
+		q = append(q, bson.M{"_id": bson.M{"$regex": "^(" + strings.Join(names, "|") + ")/"}})
+	}
+	var repositories []Repository
+	if err = conn.Repository().Find(bson.M{"$or": q}).Sort("_id").All(&repositories); err != nil {
+		return nil, err
+	}
+	for i := range repositories {
+		n := granting[namespaceOf(repositories[i].Name)]
+		if p := repositories[i].permission(&s, n); p.Access != AccessNone {
+			permissions = append(permissions, p)
+		}
+	}
+	return permissions, nil
+}
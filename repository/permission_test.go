@@ -0,0 +1,188 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/group"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestHasWritePermission(c *check.C) {
+	r := Repository{Name: "myapp", Users: []string{"bilbo"}, ReadOnlyUsers: []string{"frodo"}}
+	c.Assert(r.HasWritePermission("bilbo"), check.Equals, true)
+	c.Assert(r.HasWritePermission("frodo"), check.Equals, false)
+	c.Assert(r.HasWritePermission("sam"), check.Equals, false)
+	c.Assert(r.HasWritePermission(""), check.Equals, false)
+}
+
+func (s *S) TestHasWritePermissionPublicRepository(c *check.C) {
+	r := Repository{Name: "myapp", Users: []string{"bilbo"}, IsPublic: true}
+	c.Assert(r.HasWritePermission("sam"), check.Equals, false)
+}
+
+func (s *S) TestHasReadPermission(c *check.C) {
+	r := Repository{Name: "myapp", Users: []string{"bilbo"}, ReadOnlyUsers: []string{"frodo"}}
+	c.Assert(r.HasReadPermission("bilbo"), check.Equals, true)
+	c.Assert(r.HasReadPermission("frodo"), check.Equals, true)
+	c.Assert(r.HasReadPermission("sam"), check.Equals, false)
+	c.Assert(r.HasReadPermission(""), check.Equals, false)
+}
+
+func (s *S) TestHasReadPermissionPublicRepository(c *check.C) {
+	r := Repository{Name: "myapp", Users: []string{"bilbo"}, IsPublic: true}
+	c.Assert(r.HasReadPermission("sam"), check.Equals, true)
+	c.Assert(r.HasReadPermission(""), check.Equals, true)
+}
+
+func (s *S) TestPermissionThroughGroups(c *check.C) {
+	_, err := group.New("devs", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	_, err = group.New("qa", []string{"frodo"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("qa")
+	r := Repository{Name: "myapp", Users: []string{"gandalf"}, Groups: []string{"devs"}, ReadOnlyGroups: []string{"qa"}}
+	c.Assert(r.HasWritePermission("bilbo"), check.Equals, true)
+	c.Assert(r.HasReadPermission("bilbo"), check.Equals, true)
+	c.Assert(r.HasWritePermission("frodo"), check.Equals, false)
+	c.Assert(r.HasReadPermission("frodo"), check.Equals, true)
+	c.Assert(r.HasReadPermission("sam"), check.Equals, false)
+	err = group.RemoveMembers("devs", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	c.Assert(r.HasWritePermission("bilbo"), check.Equals, false)
+	c.Assert(r.HasReadPermission("bilbo"), check.Equals, false)
+}
+
+func (s *S) TestPermissionThroughNamespace(c *check.C) {
+	_, err := NewNamespace("team", []string{"gandalf"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	_, err = group.New("qa", []string{"frodo"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("qa")
+	err = GrantNamespaceAccess("team", []string{"bilbo"}, nil, false)
+	c.Assert(err, check.IsNil)
+	err = GrantNamespaceAccess("team", nil, []string{"qa"}, true)
+	c.Assert(err, check.IsNil)
+	r := Repository{Name: "team/myapp"}
+	c.Assert(r.HasWritePermission("gandalf"), check.Equals, true)
+	c.Assert(r.HasWritePermission("bilbo"), check.Equals, true)
+	c.Assert(r.HasWritePermission("frodo"), check.Equals, false)
+	c.Assert(r.HasReadPermission("frodo"), check.Equals, true)
+	c.Assert(r.HasReadPermission("sam"), check.Equals, false)
+	c.Assert(r.HasReadPermission(""), check.Equals, false)
+	other := Repository{Name: "myapp", Users: []string{"sam"}}
+	c.Assert(other.HasReadPermission("bilbo"), check.Equals, false)
+	err = RevokeNamespaceAccess("team", []string{"bilbo"}, []string{"qa"})
+	c.Assert(err, check.IsNil)
+	c.Assert(r.HasReadPermission("bilbo"), check.Equals, false)
+	c.Assert(r.HasReadPermission("frodo"), check.Equals, false)
+}
+
+func (s *S) TestPermission(c *check.C) {
+	r := Repository{Name: "myapp", Users: []string{"bilbo"}, ReadOnlyUsers: []string{"frodo"}}
+	c.Assert(r.Permission("bilbo"), check.Equals, Permission{Repository: "myapp", User: "bilbo", Access: AccessWrite, Source: SourceDirect})
+	c.Assert(r.Permission("frodo"), check.Equals, Permission{Repository: "myapp", User: "frodo", Access: AccessRead, Source: SourceReadOnly})
+	c.Assert(r.Permission("sam"), check.Equals, Permission{Repository: "myapp", User: "sam", Access: AccessNone})
+	r.IsPublic = true
+	c.Assert(r.Permission("sam"), check.Equals, Permission{Repository: "myapp", User: "sam", Access: AccessRead, Source: SourcePublic})
+	c.Assert(r.Permission("frodo").Source, check.Equals, SourceReadOnly)
+	c.Assert(r.Permission("").Access, check.Equals, AccessRead)
+}
+
+func (s *S) TestPermissionSourceGroupAndNamespace(c *check.C) {
+	_, err := group.New("devs", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	_, err = NewNamespace("team", []string{"gandalf"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	err = GrantNamespaceAccess("team", []string{"frodo"}, nil, true)
+	c.Assert(err, check.IsNil)
+	r := Repository{Name: "team/myapp", ReadOnlyGroups: []string{"devs"}}
+	c.Assert(r.Permission("bilbo").Access, check.Equals, AccessRead)
+	c.Assert(r.Permission("bilbo").Source, check.Equals, SourceGroup)
+	c.Assert(r.Permission("gandalf").Access, check.Equals, AccessWrite)
+	c.Assert(r.Permission("gandalf").Source, check.Equals, SourceNamespace)
+	c.Assert(r.Permission("frodo").Access, check.Equals, AccessRead)
+	c.Assert(r.Permission("frodo").Source, check.Equals, SourceNamespace)
+}
+
+func (s *S) TestPermissionSuspendedUser(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.User().Insert(bson.M{"_id": "gollum", "suspended": true})
+	c.Assert(err, check.IsNil)
+	defer conn.User().RemoveId("gollum")
+	_, err = group.New("devs", []string{"gollum"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	_, err = NewNamespace("team", []string{"gollum"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	repositories := []Repository{
+		{Name: "direct", Users: []string{"gollum"}},
+		{Name: "readonly", ReadOnlyUsers: []string{"gollum"}},
+		{Name: "groups", Groups: []string{"devs"}},
+		{Name: "team/myapp"},
+		{Name: "public", IsPublic: true},
+	}
+	for _, r := range repositories {
+		c.Check(r.Permission("gollum"), check.Equals, Permission{Repository: r.Name, User: "gollum", Access: AccessNone})
+	}
+}
+
+func (s *S) TestListPermissions(c *check.C) {
+	_, err := group.New("devs", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	_, err = NewNamespace("team", []string{"gandalf"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	err = GrantNamespaceAccess("team", nil, []string{"devs"}, false)
+	c.Assert(err, check.IsNil)
+	repositories := []Repository{
+		{Name: "direct", Users: []string{"bilbo"}},
+		{Name: "public", IsPublic: true},
+		{Name: "private", Users: []string{"frodo"}},
+		{Name: "team/myapp"},
+		{Name: "other/myapp"},
+	}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, r := range repositories {
+		err = conn.Repository().Insert(r)
+		c.Assert(err, check.IsNil)
+		defer conn.Repository().RemoveId(r.Name)
+	}
+	permissions, err := ListPermissions("bilbo")
+	c.Assert(err, check.IsNil)
+	c.Assert(permissions, check.DeepEquals, []Permission{
+		{Repository: "direct", User: "bilbo", Access: AccessWrite, Source: SourceDirect},
+		{Repository: "public", User: "bilbo", Access: AccessRead, Source: SourcePublic},
+		{Repository: "team/myapp", User: "bilbo", Access: AccessWrite, Source: SourceNamespace},
+	})
+}
+
+func (s *S) TestListPermissionsSuspendedUser(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.User().Insert(bson.M{"_id": "gollum", "suspended": true})
+	c.Assert(err, check.IsNil)
+	defer conn.User().RemoveId("gollum")
+	for _, r := range []Repository{{Name: "direct", Users: []string{"gollum"}}, {Name: "public", IsPublic: true}} {
+		err = conn.Repository().Insert(r)
+		c.Assert(err, check.IsNil)
+		defer conn.Repository().RemoveId(r.Name)
+	}
+	permissions, err := ListPermissions("gollum")
+	c.Assert(err, check.IsNil)
+	c.Assert(permissions, check.HasLen, 0)
+}
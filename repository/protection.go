@@ -0,0 +1,125 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+)
+
+// ProtectedBranch protects the branches named Name, where "*" matches any
+// sequence of characters, against force-pushes (DenyNonFastForward),
+// deletion (DenyDelete) and merge commits (RequireLinearHistory). Unlike
+// rules, protections apply to all users.
+type ProtectedBranch struct {
+	Name                 string `json:"name"`
+	DenyNonFastForward   bool   `json:"denyNonFastForward"`
+	DenyDelete           bool   `json:"denyDelete"`
+	RequireLinearHistory bool   `json:"requireLinearHistory"`
+}
+
+type InvalidProtectedBranchError struct {
+	message string
+}
+
+func (err *InvalidProtectedBranchError) Error() string {
+	return err.message
+}
+
+func (p *ProtectedBranch) validate() error {
+	if p.Name == "" || strings.HasPrefix(p.Name, "refs/") || strings.ContainsAny(p.Name, " \t\n") {
+		return &InvalidProtectedBranchError{message: fmt.Sprintf("invalid branch name %q", p.Name)}
+	}
+	return nil
+}
+
+// SetProtectedBranches replaces the protected branches of the repository.
+func SetProtectedBranches(name string, branches []ProtectedBranch) error {
+	for i := range branches {
+		if err := branches[i].validate(); err != nil {
+			return err
+		}
+	}
+	if branches == nil {
+		branches = []ProtectedBranch{}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Repository().UpdateId(name, bson.M{"$set": bson.M{"protectedbranches": branches}})
+	if err == mgo.ErrNotFound {
+		return ErrRepositoryNotFound
+	}
+	return err
+}
+
+// revList runs git rev-list in the repository, returning its output.
+func (r *Repository) revList(args ...string) (string, error) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return "", fmt.Errorf("Error when trying to check the history of repository %s (%s).", r.Name, err)
+	}
+	cmd := exec.Command(gitPath, append([]string{"rev-list"}, args...)...)
+	cmd.Dir = barePath(r.Name)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error when trying to check the history of repository %s (%s).", r.Name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// CheckBranchProtection checks the protected branches of the repository for
+// the change of the ref from oldRev to newRev. It must run before the ref is
+// updated, with the new objects available in the repository, as in the
+// update hook.
+func (r *Repository) CheckBranchProtection(ref, oldRev, newRev string) error {
+	if !strings.HasPrefix(ref, "refs/heads/") {
+		return nil
+	}
+	branch := strings.TrimPrefix(ref, "refs/heads/")
+	action := refAction(oldRev, newRev)
+	for _, p := range r.ProtectedBranches {
+		if !refMatches(p.Name, branch) {
+			continue
+		}
+		if action == RefDelete {
+			if p.DenyDelete {
+				return &RefUpdateDeniedError{message: fmt.Sprintf("The branch %s is protected, it can't be deleted.", branch)}
+			}
+			continue
+		}
+		if action == RefUpdate && p.DenyNonFastForward {
+			// oldRev is reachable from newRev in fast-forwards.
+			out, err := r.revList("-n", "1", oldRev, "^"+newRev)
+			if err != nil {
+				return err
+			}
+			if out != "" {
+				return &RefUpdateDeniedError{message: fmt.Sprintf("The branch %s is protected, it can't be force-pushed.", branch)}
+			}
+		}
+		if p.RequireLinearHistory {
+			args := []string{"-n", "1", "--merges", newRev, "^" + oldRev}
+			if action == RefCreate {
+				args = []string{"-n", "1", "--merges", newRev, "--not", "--all"}
+			}
+			out, err := r.revList(args...)
+			if err != nil {
+				return err
+			}
+			if out != "" {
+				return &RefUpdateDeniedError{message: fmt.Sprintf("The branch %s requires a linear history, merge commits are not allowed.", branch)}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"os/exec"
+	"path"
+
+	"github.com/tsuru/gandalf/db"
+	"gopkg.in/check.v1"
+)
+
+func runGit(c *check.C, testPath string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = testPath
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, check.IsNil, check.Commentf("%s", out))
+}
+
+func lastHashCommit(c *check.C, tmpPath, repo string) string {
+	hash, err := GetLastHashCommit(tmpPath, repo)
+	c.Assert(err, check.IsNil)
+	return string(hash)
+}
+
+func (s *S) TestProtectedBranchValidate(c *check.C) {
+	for _, name := range []string{"", "refs/heads/master", "my branch"} {
+		p := ProtectedBranch{Name: name}
+		c.Check(p.validate(), check.FitsTypeOf, &InvalidProtectedBranchError{})
+	}
+	p := ProtectedBranch{Name: "release/*"}
+	c.Assert(p.validate(), check.IsNil)
+}
+
+func (s *S) TestCheckBranchProtectionDenyDelete(c *check.C) {
+	r := Repository{Name: "myapp", ProtectedBranches: []ProtectedBranch{{Name: "master", DenyDelete: true}}}
+	err := r.CheckBranchProtection("refs/heads/master", rev1, zero)
+	c.Assert(err, check.FitsTypeOf, &RefUpdateDeniedError{})
+	c.Assert(err, check.ErrorMatches, "The branch master is protected, it can't be deleted.")
+	c.Assert(r.CheckBranchProtection("refs/heads/feature", rev1, zero), check.IsNil)
+	c.Assert(r.CheckBranchProtection("refs/tags/master", rev1, zero), check.IsNil)
+}
+
+func (s *S) TestCheckBranchProtectionDenyNonFastForwardIntegration(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, "Just a regular readme.")
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	first := lastHashCommit(c, bare, repo)
+	err := CreateCommit(bare, repo, file, "You should read this README")
+	c.Assert(err, check.IsNil)
+	second := lastHashCommit(c, bare, repo)
+	r := Repository{Name: repo, ProtectedBranches: []ProtectedBranch{{Name: "*", DenyNonFastForward: true}}}
+	c.Assert(r.CheckBranchProtection("refs/heads/master", first, second), check.IsNil)
+	err = r.CheckBranchProtection("refs/heads/master", second, first)
+	c.Assert(err, check.FitsTypeOf, &RefUpdateDeniedError{})
+	c.Assert(err, check.ErrorMatches, "The branch master is protected, it can't be force-pushed.")
+}
+
+func (s *S) TestCheckBranchProtectionRequireLinearHistoryIntegration(c *check.C) {
+	oldBare := bare
+	bare = "/tmp"
+	repo := "gandalf-test-repo"
+	file := "README"
+	cleanUp, errCreate := CreateTestRepository(bare, repo, file, "Just a regular readme.")
+	defer func() {
+		cleanUp()
+		bare = oldBare
+	}()
+	c.Assert(errCreate, check.IsNil)
+	testPath := path.Join(bare, repo+".git")
+	first := lastHashCommit(c, bare, repo)
+	err := CheckoutInNewBranch(testPath, "feature")
+	c.Assert(err, check.IsNil)
+	err = CreateCommit(bare, repo, "FEATURE", "A new feature")
+	c.Assert(err, check.IsNil)
+	runGit(c, testPath, "checkout", "-")
+	err = CreateCommit(bare, repo, file, "You should read this README")
+	c.Assert(err, check.IsNil)
+	second := lastHashCommit(c, bare, repo)
+	runGit(c, testPath, "merge", "--no-ff", "-m", "Merge feature", "feature")
+	merge := lastHashCommit(c, bare, repo)
+	r := Repository{Name: repo, ProtectedBranches: []ProtectedBranch{{Name: "master", RequireLinearHistory: true}}}
+	c.Assert(r.CheckBranchProtection("refs/heads/master", first, second), check.IsNil)
+	c.Assert(r.CheckBranchProtection("refs/heads/feature", second, merge), check.IsNil)
+	err = r.CheckBranchProtection("refs/heads/master", second, merge)
+	c.Assert(err, check.FitsTypeOf, &RefUpdateDeniedError{})
+	c.Assert(err, check.ErrorMatches, "The branch master requires a linear history, merge commits are not allowed.")
+}
+
+func (s *S) TestSetProtectedBranches(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "myapp"})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	branches := []ProtectedBranch{{Name: "master", DenyNonFastForward: true, DenyDelete: true}}
+	err = SetProtectedBranches("myapp", branches)
+	c.Assert(err, check.IsNil)
+	r, err := Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.ProtectedBranches, check.DeepEquals, branches)
+}
+
+func (s *S) TestSetProtectedBranchesRepositoryNotFound(c *check.C) {
+	err := SetProtectedBranches("ghost", nil)
+	c.Assert(err, check.Equals, ErrRepositoryNotFound)
+}
+
+func (s *S) TestSetProtectedBranchesInvalid(c *check.C) {
+	err := SetProtectedBranches("myapp", []ProtectedBranch{{Name: ""}})
+	c.Assert(err, check.ErrorMatches, `invalid branch name ""`)
+}
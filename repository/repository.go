@@ -15,12 +15,14 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
 	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/gandalf/group"
 	"github.com/tsuru/gandalf/multipartzip"
 	"github.com/tsuru/tsuru/log"
 )
@@ -42,10 +44,17 @@ func tempDirLocation() string {
 // Repository represents a Git repository. A Git repository is a record in the
 // database and a directory in the filesystem (the bare repository).
 type Repository struct {
-	Name          string `bson:"_id"`
-	Users         []string
-	ReadOnlyUsers []string
-	IsPublic      bool
+	Name              string `bson:"_id"`
+	Users             []string
+	ReadOnlyUsers     []string
+	Groups            []string
+	ReadOnlyGroups    []string
+	IsPublic          bool
+	Visibility        Visibility
+	Rules             []RefRule         `json:"-"`
+	ProtectedBranches []ProtectedBranch `json:"-"`
+	Expirations       []GrantExpiration `json:"-"`
+	AllowedSources    []string          `json:"-"`
 }
 
 type Links struct {
@@ -110,20 +119,38 @@ func exists(path string) (bool, error) {
 // MarshalJSON marshals the Repository in json format.
 func (r *Repository) MarshalJSON() ([]byte, error) {
 	data := map[string]interface{}{
-		"name":    r.Name,
-		"public":  r.IsPublic,
-		"ssh_url": r.ReadWriteURL(),
-		"git_url": r.ReadOnlyURL(),
+		"name":       r.Name,
+		"public":     r.IsPublic,
+		"visibility": r.VisibilityLevel(),
+		"ssh_url":    r.ReadWriteURL(),
+		"git_url":    r.ReadOnlyURL(),
+	}
+	if len(r.Expirations) > 0 {
+		data["expirations"] = r.Expirations
 	}
 	return json.Marshal(&data)
 }
 
 // New creates a representation of a git repository. It creates a Git
 // repository using the "bare-dir" setting and saves repository's meta data in
-// the database.
+// the database. Public repositories are created with the public visibility,
+// and the others with the private visibility.
 func New(name string, users, readOnlyUsers []string, isPublic bool) (*Repository, error) {
+	visibility := VisibilityPrivate
+	if isPublic {
+		visibility = VisibilityPublic
+	}
+	return NewWithVisibility(name, users, readOnlyUsers, visibility)
+}
+
+// NewWithVisibility creates a git repository like New, with the given
+// visibility.
+func NewWithVisibility(name string, users, readOnlyUsers []string, visibility Visibility) (*Repository, error) {
 	log.Debugf("Creating repository %q", name)
-	r := &Repository{Name: name, Users: users, ReadOnlyUsers: readOnlyUsers, IsPublic: isPublic}
+	r := &Repository{Name: name, Users: users, ReadOnlyUsers: readOnlyUsers, Visibility: visibility}
+	if err := r.normalizeVisibility(); err != nil {
+		return r, err
+	}
 	if v, err := r.isValid(); !v {
 		log.Errorf("repository.New: Invalid repository %q: %s", name, err)
 		return r, err
@@ -145,13 +172,10 @@ func New(name string, users, readOnlyUsers []string, isPublic bool) (*Repository
 		conn.Repository().Remove(bson.M{"_id": r.Name})
 		return r, err
 	}
-	barePath := barePath(name)
-	if barePath != "" && isPublic {
-		if f, createErr := fs.Filesystem().Create(barePath + "/git-daemon-export-ok"); createErr == nil {
-			f.Close()
-		}
+	if err = syncExportMarker(r); err != nil {
+		log.Errorf("repository.New: %s", err)
 	}
-	return r, err
+	return r, nil
 }
 
 // Get find a repository by name.
@@ -190,7 +214,9 @@ func Remove(name string) error {
 	return nil
 }
 
-// Update update a repository data.
+// Update update a repository data. It returns group.ErrGroupNotFound,
+// without updating anything, when any of the groups added to the repository
+// doesn't exist.
 func Update(name string, newData Repository) error {
 	log.Debugf("Updating repository %q data", name)
 	repo, err := Get(name)
@@ -198,11 +224,20 @@ func Update(name string, newData Repository) error {
 		log.Errorf("repository.Update(%q): %s", name, err)
 		return err
 	}
+	if err = checkGroups(added(repo.Groups, newData.Groups)); err != nil {
+		return err
+	}
+	if err = checkGroups(added(repo.ReadOnlyGroups, newData.ReadOnlyGroups)); err != nil {
+		return err
+	}
 	conn, err := db.Conn()
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	if err = newData.normalizeVisibility(); err != nil {
+		return err
+	}
 	if len(newData.Name) > 0 && newData.Name != repo.Name {
 		oldName := repo.Name
 		log.Debugf("Renaming repository %q to %q", oldName, newData.Name)
@@ -228,7 +263,10 @@ func Update(name string, newData Repository) error {
 			return err
 		}
 	}
-	return nil
+	if newData.Name == "" {
+		newData.Name = repo.Name
+	}
+	return syncExportMarker(&newData)
 }
 
 // ReadWriteURL formats the git ssh url and return it. If no remote is configured in
@@ -313,18 +351,28 @@ func (r *Repository) isValid() (bool, error) {
 
 // GrantAccess gives full or read-only permission for users in all specified repositories.
 // If any of the repositories/users does not exist, GrantAccess just skips it.
+// The access never expires, even if it was previously granted with an
+// expiration.
 func GrantAccess(rNames, uNames []string, readOnly bool) error {
+	return GrantExpiringAccess(rNames, uNames, readOnly, time.Time{})
+}
+
+// RevokeAccess revokes write permission from users in all specified
+// repositories.
+func RevokeAccess(rNames, uNames []string, readOnly bool) error {
 	conn, err := db.Conn()
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	var info *mgo.ChangeInfo
+	field := "users"
 	if readOnly {
-		info, err = conn.Repository().UpdateAll(bson.M{"_id": bson.M{"$in": rNames}}, bson.M{"$addToSet": bson.M{"readonlyusers": bson.M{"$each": uNames}}})
-	} else {
-		info, err = conn.Repository().UpdateAll(bson.M{"_id": bson.M{"$in": rNames}}, bson.M{"$addToSet": bson.M{"users": bson.M{"$each": uNames}}})
+		field = "readonlyusers"
 	}
+	info, err := conn.Repository().UpdateAll(bson.M{"_id": bson.M{"$in": rNames}}, bson.M{
+		"$pullAll": bson.M{field: uNames},
+		"$pull":    bson.M{"expirations": bson.M{"user": bson.M{"$in": uNames}, "readonly": readOnly}},
+	})
 	if err != nil {
 		return err
 	}
@@ -334,20 +382,68 @@ func GrantAccess(rNames, uNames []string, readOnly bool) error {
 	return nil
 }
 
-// RevokeAccess revokes write permission from users in all specified
-// repositories.
-func RevokeAccess(rNames, uNames []string, readOnly bool) error {
+// GrantGroupAccess gives full or read-only permission for groups in all
+// specified repositories. Unlike GrantAccess, it returns
+// group.ErrGroupNotFound, without granting anything, when any of the groups
+// doesn't exist.
+func GrantGroupAccess(rNames, gNames []string, readOnly bool) error {
+	if err := checkGroups(gNames); err != nil {
+		return err
+	}
 	conn, err := db.Conn()
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	var info *mgo.ChangeInfo
+	field := "groups"
 	if readOnly {
-		info, err = conn.Repository().UpdateAll(bson.M{"_id": bson.M{"$in": rNames}}, bson.M{"$pullAll": bson.M{"readonlyusers": uNames}})
-	} else {
-		info, err = conn.Repository().UpdateAll(bson.M{"_id": bson.M{"$in": rNames}}, bson.M{"$pullAll": bson.M{"users": uNames}})
+		field = "readonlygroups"
+	}
+	info, err := conn.Repository().UpdateAll(bson.M{"_id": bson.M{"$in": rNames}}, bson.M{"$addToSet": bson.M{field: bson.M{"$each": gNames}}})
+	if err != nil {
+		return err
+	}
+	if info.Matched == 0 {
+		return ErrRepositoryNotFound
+	}
+	return nil
+}
+
+// checkGroups returns group.ErrGroupNotFound when any of the given groups
+// doesn't exist.
+func checkGroups(gNames []string) error {
+	for _, gName := range gNames {
+		if _, err := group.Get(gName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// added returns the values in current that are not in previous.
+func added(previous, current []string) []string {
+	var values []string
+	for _, v := range current {
+		if !contains(previous, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// RevokeGroupAccess revokes full or read-only permission from groups in all
+// specified repositories.
+func RevokeGroupAccess(rNames, gNames []string, readOnly bool) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	field := "groups"
+	if readOnly {
+		field = "readonlygroups"
 	}
+	info, err := conn.Repository().UpdateAll(bson.M{"_id": bson.M{"$in": rNames}}, bson.M{"$pullAll": bson.M{field: gNames}})
 	if err != nil {
 		return err
 	}
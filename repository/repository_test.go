@@ -25,6 +25,7 @@ import (
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
 	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/gandalf/group"
 	"github.com/tsuru/gandalf/multipartzip"
 	"github.com/tsuru/tsuru/fs/fstest"
 	"gopkg.in/check.v1"
@@ -429,6 +430,7 @@ func (s *S) TestUpdate(c *check.C) {
 		Users:         []string{"a", "b"},
 		ReadOnlyUsers: []string{"c", "d"},
 		IsPublic:      true,
+		Visibility:    VisibilityPublic,
 	}
 	err = Update(r.Name, expected)
 	c.Assert(err, check.IsNil)
@@ -454,6 +456,7 @@ func (s *S) TestUpdateWithRenaming(c *check.C) {
 		Users:         []string{"a", "b"},
 		ReadOnlyUsers: []string{"c", "d"},
 		IsPublic:      true,
+		Visibility:    VisibilityPublic,
 	}
 	err = Update(r.Name, expected)
 	c.Assert(err, check.IsNil)
@@ -487,6 +490,32 @@ func (s *S) TestUpdateErrsWithAlreadyExists(c *check.C) {
 	c.Assert(mgo.IsDup(err), check.Equals, true)
 }
 
+func (s *S) TestUpdateGroupNotFound(c *check.C) {
+	tmpdir, err := commandmocker.Add("git", "$*")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	r, err := New("freedom", []string{"c"}, nil, false)
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	_, err = group.New("devs", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	err = Update(r.Name, Repository{Name: "freedom", Users: []string{"a"}, Groups: []string{"devs"}, ReadOnlyGroups: []string{"qa"}})
+	c.Assert(err, check.Equals, group.ErrGroupNotFound)
+	repo, err := Get("freedom")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.Users, check.DeepEquals, []string{"c"})
+	c.Assert(repo.Groups, check.HasLen, 0)
+	err = Update(r.Name, Repository{Name: "freedom", Users: []string{"c"}, Groups: []string{"devs"}})
+	c.Assert(err, check.IsNil)
+	repo, err = Get("freedom")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.Groups, check.DeepEquals, []string{"devs"})
+}
+
 func (s *S) TestUpdateErrsWhenNotFound(c *check.C) {
 	update := Repository{}
 	err := Update("nonexistent", update)
@@ -749,6 +778,61 @@ func (s *S) TestRevokeAccessNotFound(c *check.C) {
 	c.Assert(err, check.Equals, ErrRepositoryNotFound)
 }
 
+func (s *S) TestGrantAndRevokeGroupAccess(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	r := Repository{Name: "proj1", Users: []string{"someuser"}}
+	err = conn.Repository().Insert(r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	for _, name := range []string{"devs", "qa"} {
+		_, err = group.New(name, nil)
+		c.Assert(err, check.IsNil)
+		defer group.Remove(name)
+	}
+	err = GrantGroupAccess([]string{r.Name}, []string{"devs"}, false)
+	c.Assert(err, check.IsNil)
+	err = GrantGroupAccess([]string{r.Name}, []string{"qa", "devs"}, true)
+	c.Assert(err, check.IsNil)
+	err = conn.Repository().FindId(r.Name).One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Groups, check.DeepEquals, []string{"devs"})
+	c.Assert(r.ReadOnlyGroups, check.DeepEquals, []string{"qa", "devs"})
+	err = RevokeGroupAccess([]string{r.Name}, []string{"devs"}, true)
+	c.Assert(err, check.IsNil)
+	err = conn.Repository().FindId(r.Name).One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Groups, check.DeepEquals, []string{"devs"})
+	c.Assert(r.ReadOnlyGroups, check.DeepEquals, []string{"qa"})
+}
+
+func (s *S) TestGrantGroupAccessNotFound(c *check.C) {
+	_, err := group.New("devs", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	err = GrantGroupAccess([]string{"super-repo"}, []string{"devs"}, false)
+	c.Assert(err, check.Equals, ErrRepositoryNotFound)
+}
+
+func (s *S) TestGrantGroupAccessGroupNotFound(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	r := Repository{Name: "proj1", Users: []string{"someuser"}}
+	err = conn.Repository().Insert(r)
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId(r.Name)
+	_, err = group.New("devs", nil)
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	err = GrantGroupAccess([]string{r.Name}, []string{"devs", "qa"}, false)
+	c.Assert(err, check.Equals, group.ErrGroupNotFound)
+	err = conn.Repository().FindId(r.Name).One(&r)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Groups, check.HasLen, 0)
+}
+
 func (s *S) TestGet(c *check.C) {
 	repo := Repository{Name: "somerepo", Users: []string{}, ReadOnlyUsers: []string{}}
 	conn, err := db.Conn()
@@ -769,10 +853,11 @@ func (s *S) TestGetNotFound(c *check.C) {
 func (s *S) TestMarshalJSON(c *check.C) {
 	repo := Repository{Name: "somerepo", Users: []string{}}
 	expected := map[string]interface{}{
-		"name":    repo.Name,
-		"public":  repo.IsPublic,
-		"ssh_url": repo.ReadWriteURL(),
-		"git_url": repo.ReadOnlyURL(),
+		"name":       repo.Name,
+		"public":     repo.IsPublic,
+		"visibility": "private",
+		"ssh_url":    repo.ReadWriteURL(),
+		"git_url":    repo.ReadOnlyURL(),
 	}
 	data, err := json.Marshal(&repo)
 	c.Assert(err, check.IsNil)
@@ -0,0 +1,192 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+)
+
+// Actions on refs, as received by the update hook.
+const (
+	RefCreate = "create"
+	RefUpdate = "update"
+	RefDelete = "delete"
+)
+
+var refActions = map[string]bool{RefCreate: true, RefUpdate: true, RefDelete: true}
+
+// RefRule restricts the changes that users with write access to a repository
+// may push to its refs, like "only release-managers may update
+// refs/heads/release/*" or "nobody may delete refs/tags/*".
+//
+// Ref is the full name of the refs the rule applies to, where "*" matches
+// any sequence of characters, including slashes. Actions limits the rule to
+// some actions (create, update or delete), and an empty list applies it to
+// all of them. Users and Groups list who the rule is about, and empty lists
+// mean everyone.
+//
+// Rules are checked in order, and the first one that matches the ref and the
+// action, and whose users apply, decides: it allows the change, or denies it
+// when Deny is set. An allow rule matching the ref and the action also denies
+// the change to everyone else, and changes that match no rule are allowed.
+type RefRule struct {
+	Ref     string   `json:"ref"`
+	Actions []string `json:"actions,omitempty"`
+	Users   []string `json:"users,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Deny    bool     `json:"deny,omitempty"`
+}
+
+type InvalidRefRuleError struct {
+	message string
+}
+
+func (err *InvalidRefRuleError) Error() string {
+	return err.message
+}
+
+// RefUpdateDeniedError is returned when a rule of the repository denies a
+// change in a ref.
+type RefUpdateDeniedError struct {
+	message string
+}
+
+func (err *RefUpdateDeniedError) Error() string {
+	return err.message
+}
+
+func (rule *RefRule) validate() error {
+	if !strings.HasPrefix(rule.Ref, "refs/") {
+		return &InvalidRefRuleError{message: fmt.Sprintf("invalid ref %q, it should start with refs/", rule.Ref)}
+	}
+	for _, action := range rule.Actions {
+		if !refActions[action] {
+			return &InvalidRefRuleError{message: fmt.Sprintf("invalid action %q, valid options are: create, update or delete", action)}
+		}
+	}
+	return nil
+}
+
+// matches returns whether the rule applies to the given action in the ref.
+func (rule *RefRule) matches(ref, action string) bool {
+	if len(rule.Actions) > 0 && !contains(rule.Actions, action) {
+		return false
+	}
+	return refMatches(rule.Ref, ref)
+}
+
+// refMatches returns whether the name matches the pattern, where "*" matches
+// any sequence of characters, including slashes.
+func refMatches(pattern, name string) bool {
+	expr := strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+	matched, _ := regexp.MatchString("^"+expr+"$", name)
+	return matched
+}
+
+// everyone returns whether the rule applies to all users.
+func (rule *RefRule) everyone() bool {
+	return len(rule.Users) == 0 && len(rule.Groups) == 0
+}
+
+// zeroRev returns whether the revision is the null object name, used by git
+// for refs that don't exist.
+func zeroRev(rev string) bool {
+	return strings.Trim(rev, "0") == ""
+}
+
+// refAction returns the action of a change in a ref, given the old and the
+// new revisions of the ref.
+func refAction(oldRev, newRev string) string {
+	if zeroRev(oldRev) {
+		return RefCreate
+	}
+	if zeroRev(newRev) {
+		return RefDelete
+	}
+	return RefUpdate
+}
+
+// SetRules replaces the ref rules of the repository.
+func SetRules(name string, rules []RefRule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	if rules == nil {
+		rules = []RefRule{}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Repository().UpdateId(name, bson.M{"$set": bson.M{"rules": rules}})
+	if err == mgo.ErrNotFound {
+		return ErrRepositoryNotFound
+	}
+	return err
+}
+
+// CheckRefUpdate checks the rules of the repository for the change of the ref
+// from oldRev to newRev, pushed by the given user. It doesn't check whether
+// the user has write access to the repository.
+func (r *Repository) CheckRefUpdate(userName, ref, oldRev, newRev string) error {
+	return r.checkRefAction(userName, ref, refAction(oldRev, newRev))
+}
+
+// CheckPush checks the rules and the protected branches of the repository
+// for the change of the ref from oldRev to newRev, pushed by the given user.
+// It's what the update hook checks on every push.
+func (r *Repository) CheckPush(userName, ref, oldRev, newRev string) error {
+	if err := r.CheckRefUpdate(userName, ref, oldRev, newRev); err != nil {
+		return err
+	}
+	return r.CheckBranchProtection(ref, oldRev, newRev)
+}
+
+// CheckCommit checks the rules and the protected branches of the repository
+// for a commit to the branch made through the API by the given user. These
+// commits either create the branch or add a single commit on top of it,
+// which is neither a force-push nor a merge commit, so protected branches
+// never deny them and only the rules are checked. It doesn't check whether
+// the user has write access to the repository.
+func (r *Repository) CheckCommit(userName, branch string) error {
+	branches, err := GetBranches(r.Name)
+	if err != nil {
+		return err
+	}
+	action := RefCreate
+	for _, b := range branches {
+		if b.Name == branch {
+			action = RefUpdate
+			break
+		}
+	}
+	return r.checkRefAction(userName, "refs/heads/"+branch, action)
+}
+
+func (r *Repository) checkRefAction(userName, ref, action string) error {
+	for _, rule := range r.Rules {
+		if !rule.matches(ref, action) {
+			continue
+		}
+		applies := rule.everyone() || r.granted(rule.Users, rule.Groups, userName)
+		if rule.Deny && !applies {
+			continue
+		}
+		if rule.Deny || !applies {
+			return &RefUpdateDeniedError{message: fmt.Sprintf("You are not allowed to %s %s.", action, ref)}
+		}
+		return nil
+	}
+	return nil
+}
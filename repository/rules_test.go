@@ -0,0 +1,124 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"errors"
+
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/group"
+	"gopkg.in/check.v1"
+)
+
+const (
+	zero = "0000000000000000000000000000000000000000"
+	rev1 = "a367b5de5943632e47cb6f8bf5b2147bc0be5cf8"
+	rev2 = "1267b5de5943632e47cb6f8bf5b2147bc0be5cf1"
+)
+
+func (s *S) TestRefAction(c *check.C) {
+	c.Assert(refAction(zero, rev1), check.Equals, RefCreate)
+	c.Assert(refAction(rev1, rev2), check.Equals, RefUpdate)
+	c.Assert(refAction(rev1, zero), check.Equals, RefDelete)
+}
+
+func (s *S) TestRefRuleMatches(c *check.C) {
+	rule := RefRule{Ref: "refs/heads/release/*"}
+	c.Assert(rule.matches("refs/heads/release/1.0", RefUpdate), check.Equals, true)
+	c.Assert(rule.matches("refs/heads/release/1.0/hotfix", RefDelete), check.Equals, true)
+	c.Assert(rule.matches("refs/heads/master", RefUpdate), check.Equals, false)
+	rule = RefRule{Ref: "refs/heads/master", Actions: []string{RefDelete}}
+	c.Assert(rule.matches("refs/heads/master", RefDelete), check.Equals, true)
+	c.Assert(rule.matches("refs/heads/master", RefUpdate), check.Equals, false)
+	c.Assert(rule.matches("refs/heads/master2", RefDelete), check.Equals, false)
+}
+
+func (s *S) TestCheckRefUpdate(c *check.C) {
+	r := Repository{Name: "myapp", Users: []string{"bilbo", "frodo"}, Rules: []RefRule{
+		{Ref: "refs/tags/*", Actions: []string{RefDelete}, Deny: true},
+		{Ref: "refs/heads/release/*", Users: []string{"bilbo"}},
+	}}
+	c.Assert(r.CheckRefUpdate("bilbo", "refs/heads/release/1.0", rev1, rev2), check.IsNil)
+	c.Assert(r.CheckRefUpdate("frodo", "refs/heads/master", rev1, rev2), check.IsNil)
+	c.Assert(r.CheckRefUpdate("frodo", "refs/tags/1.0", zero, rev1), check.IsNil)
+	err := r.CheckRefUpdate("frodo", "refs/heads/release/1.0", rev1, rev2)
+	c.Assert(err, check.FitsTypeOf, &RefUpdateDeniedError{})
+	c.Assert(err, check.ErrorMatches, "You are not allowed to update refs/heads/release/1.0.")
+	err = r.CheckRefUpdate("bilbo", "refs/tags/1.0", rev1, zero)
+	c.Assert(err, check.ErrorMatches, "You are not allowed to delete refs/tags/1.0.")
+}
+
+func (s *S) TestCheckRefUpdateDenyRuleForSomeUsers(c *check.C) {
+	r := Repository{Name: "myapp", Users: []string{"bilbo", "frodo"}, Rules: []RefRule{
+		{Ref: "refs/heads/*", Users: []string{"frodo"}, Deny: true},
+	}}
+	c.Assert(r.CheckRefUpdate("bilbo", "refs/heads/master", rev1, rev2), check.IsNil)
+	c.Assert(r.CheckRefUpdate("frodo", "refs/heads/master", rev1, rev2), check.NotNil)
+}
+
+func (s *S) TestCheckRefUpdateThroughGroups(c *check.C) {
+	_, err := group.New("release-managers", []string{"bilbo"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("release-managers")
+	r := Repository{Name: "myapp", Users: []string{"bilbo", "frodo"}, Rules: []RefRule{
+		{Ref: "refs/heads/release/*", Groups: []string{"release-managers"}},
+	}}
+	c.Assert(r.CheckRefUpdate("bilbo", "refs/heads/release/1.0", zero, rev1), check.IsNil)
+	c.Assert(r.CheckRefUpdate("frodo", "refs/heads/release/1.0", zero, rev1), check.NotNil)
+}
+
+func (s *S) TestCheckCommit(c *check.C) {
+	Retriever = &MockContentRetriever{Refs: []Ref{{Name: "master"}}}
+	defer func() {
+		Retriever = nil
+	}()
+	r := Repository{Name: "myapp", Users: []string{"bilbo", "frodo"}, Rules: []RefRule{
+		{Ref: "refs/heads/master", Actions: []string{RefUpdate}, Users: []string{"bilbo"}},
+		{Ref: "refs/heads/release/*", Actions: []string{RefCreate}, Deny: true},
+	}}
+	c.Assert(r.CheckCommit("bilbo", "master"), check.IsNil)
+	c.Assert(r.CheckCommit("frodo", "feature"), check.IsNil)
+	err := r.CheckCommit("frodo", "master")
+	c.Assert(err, check.FitsTypeOf, &RefUpdateDeniedError{})
+	c.Assert(err, check.ErrorMatches, "You are not allowed to update refs/heads/master.")
+	err = r.CheckCommit("bilbo", "release/1.0")
+	c.Assert(err, check.ErrorMatches, "You are not allowed to create refs/heads/release/1.0.")
+}
+
+func (s *S) TestCheckCommitBranchesError(c *check.C) {
+	Retriever = &MockContentRetriever{OutputError: errors.New("fatal: not a git repository")}
+	defer func() {
+		Retriever = nil
+	}()
+	r := Repository{Name: "myapp"}
+	c.Assert(r.CheckCommit("bilbo", "master"), check.ErrorMatches, "fatal: not a git repository")
+}
+
+func (s *S) TestSetRules(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "myapp"})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	rules := []RefRule{{Ref: "refs/tags/*", Actions: []string{RefDelete}, Deny: true}}
+	err = SetRules("myapp", rules)
+	c.Assert(err, check.IsNil)
+	r, err := Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Rules, check.DeepEquals, rules)
+}
+
+func (s *S) TestSetRulesRepositoryNotFound(c *check.C) {
+	err := SetRules("ghost", nil)
+	c.Assert(err, check.Equals, ErrRepositoryNotFound)
+}
+
+func (s *S) TestSetRulesInvalid(c *check.C) {
+	err := SetRules("myapp", []RefRule{{Ref: "heads/master"}})
+	c.Assert(err, check.FitsTypeOf, &InvalidRefRuleError{})
+	err = SetRules("myapp", []RefRule{{Ref: "refs/heads/master", Actions: []string{"push"}}})
+	c.Assert(err, check.ErrorMatches, `invalid action "push", valid options are: create, update or delete`)
+}
@@ -0,0 +1,34 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+// Session describes who is running a git command in a repository. It's made
+// available to git and its hooks through environment variables.
+type Session struct {
+	User           string
+	KeyName        string
+	KeyFingerprint string
+	Principal      string
+	Repository     string
+	Action         string
+	ClientAddress  string
+}
+
+// Env returns the environment variables that describe the session. Key
+// related variables are empty when the user was not authenticated by a key
+// (e.g. in git requests over HTTP), and GANDALF_PRINCIPAL is only set when
+// the user was authenticated by a certificate.
+func (s *Session) Env() []string {
+	return []string{
+		"TSURU_USER=" + s.User,
+		"GANDALF_USER=" + s.User,
+		"GANDALF_KEY_NAME=" + s.KeyName,
+		"GANDALF_KEY_FINGERPRINT=" + s.KeyFingerprint,
+		"GANDALF_PRINCIPAL=" + s.Principal,
+		"GANDALF_REPOSITORY=" + s.Repository,
+		"GANDALF_ACTION=" + s.Action,
+		"GANDALF_CLIENT_ADDRESS=" + s.ClientAddress,
+	}
+}
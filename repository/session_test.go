@@ -0,0 +1,30 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import "gopkg.in/check.v1"
+
+func (s *S) TestSessionEnv(c *check.C) {
+	session := Session{
+		User:           "bilbo",
+		KeyName:        "deploy",
+		KeyFingerprint: "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM",
+		Principal:      "bilbo@shire",
+		Repository:     "team/myapp",
+		Action:         "git-receive-pack",
+		ClientAddress:  "192.168.50.1",
+	}
+	expected := []string{
+		"TSURU_USER=bilbo",
+		"GANDALF_USER=bilbo",
+		"GANDALF_KEY_NAME=deploy",
+		"GANDALF_KEY_FINGERPRINT=SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM",
+		"GANDALF_PRINCIPAL=bilbo@shire",
+		"GANDALF_REPOSITORY=team/myapp",
+		"GANDALF_ACTION=git-receive-pack",
+		"GANDALF_CLIENT_ADDRESS=192.168.50.1",
+	}
+	c.Assert(session.Env(), check.DeepEquals, expected)
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+)
+
+type InvalidSourceError struct {
+	message string
+}
+
+func (err *InvalidSourceError) Error() string {
+	return err.message
+}
+
+// SourceDeniedError is returned when the address of a client is not allowed
+// to access a repository.
+type SourceDeniedError struct {
+	message string
+}
+
+func (err *SourceDeniedError) Error() string {
+	return err.message
+}
+
+// parseSource parses an allowed source, given in CIDR notation
+// (192.168.0.0/16) or as a single address.
+func parseSource(source string) (*net.IPNet, error) {
+	if !strings.Contains(source, "/") {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, &InvalidSourceError{message: fmt.Sprintf("invalid source %q, it should be an IP address or a CIDR range", source)}
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(source)
+	if err != nil {
+		return nil, &InvalidSourceError{message: fmt.Sprintf("invalid source %q, it should be an IP address or a CIDR range", source)}
+	}
+	return network, nil
+}
+
+func validateSources(sources []string) error {
+	for _, source := range sources {
+		if _, err := parseSource(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceAllowed returns whether the address is in any of the sources. An
+// empty list allows any address.
+func sourceAllowed(sources []string, addr string) bool {
+	if len(sources) == 0 {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, source := range sources {
+		network, err := parseSource(source)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAllowedSources replaces the sources allowed to access the repository. An
+// empty list allows any source.
+func SetAllowedSources(name string, sources []string) error {
+	if err := validateSources(sources); err != nil {
+		return err
+	}
+	if sources == nil {
+		sources = []string{}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Repository().UpdateId(name, bson.M{"$set": bson.M{"allowedsources": sources}})
+	if err == mgo.ErrNotFound {
+		return ErrRepositoryNotFound
+	}
+	return err
+}
+
+// SetNamespaceAllowedSources replaces the sources allowed to access the
+// repositories of the namespace. An empty list allows any source.
+func SetNamespaceAllowedSources(name string, sources []string) error {
+	if err := validateSources(sources); err != nil {
+		return err
+	}
+	if sources == nil {
+		sources = []string{}
+	}
+	return updateNamespace(name, bson.M{"$set": bson.M{"allowedsources": sources}})
+}
+
+// CheckSource checks whether a client with the given address, with or
+// without a port, may access the repository. When both the repository and
+// its namespace have allowed sources, the address must be allowed by both.
+func (r *Repository) CheckSource(addr string) error {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	denied := func(reason string) error {
+		return &SourceDeniedError{message: fmt.Sprintf("Access to repository %s is not allowed from %s (%s).", r.Name, addr, reason)}
+	}
+	if !sourceAllowed(r.AllowedSources, addr) {
+		return denied("repository allowlist")
+	}
+	if n := r.namespace(); n != nil && !sourceAllowed(n.AllowedSources, addr) {
+		return denied("namespace allowlist")
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"github.com/tsuru/gandalf/db"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestValidateSources(c *check.C) {
+	c.Assert(validateSources([]string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "::1"}), check.IsNil)
+	for _, source := range []string{"", "10.0.0.0/33", "example.com", "10.0.0"} {
+		err := validateSources([]string{source})
+		c.Check(err, check.FitsTypeOf, &InvalidSourceError{})
+	}
+}
+
+func (s *S) TestSourceAllowed(c *check.C) {
+	sources := []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"}
+	c.Assert(sourceAllowed(sources, "10.1.2.3"), check.Equals, true)
+	c.Assert(sourceAllowed(sources, "10.1.2.3:5312"), check.Equals, true)
+	c.Assert(sourceAllowed(sources, "192.168.1.10"), check.Equals, true)
+	c.Assert(sourceAllowed(sources, "[2001:db8::1]:22"), check.Equals, true)
+	c.Assert(sourceAllowed(sources, "192.168.1.11"), check.Equals, false)
+	c.Assert(sourceAllowed(sources, ""), check.Equals, false)
+	c.Assert(sourceAllowed(nil, "192.168.1.11"), check.Equals, true)
+}
+
+func (s *S) TestCheckSource(c *check.C) {
+	r := Repository{Name: "myapp", AllowedSources: []string{"10.0.0.0/8"}}
+	c.Assert(r.CheckSource("10.0.0.1:5312"), check.IsNil)
+	err := r.CheckSource("192.168.1.11")
+	c.Assert(err, check.FitsTypeOf, &SourceDeniedError{})
+	c.Assert(err, check.ErrorMatches, `Access to repository myapp is not allowed from 192.168.1.11 \(repository allowlist\).`)
+	r = Repository{Name: "myapp"}
+	c.Assert(r.CheckSource("192.168.1.11"), check.IsNil)
+}
+
+func (s *S) TestCheckSourceNamespace(c *check.C) {
+	_, err := NewNamespace("team", []string{"gandalf"})
+	c.Assert(err, check.IsNil)
+	defer RemoveNamespace("team")
+	err = SetNamespaceAllowedSources("team", []string{"10.0.0.0/8"})
+	c.Assert(err, check.IsNil)
+	r := Repository{Name: "team/myapp", AllowedSources: []string{"10.1.0.0/16"}}
+	c.Assert(r.CheckSource("10.1.0.1"), check.IsNil)
+	err = r.CheckSource("10.2.0.1")
+	c.Assert(err, check.ErrorMatches, `.*\(repository allowlist\).`)
+	r.AllowedSources = nil
+	c.Assert(r.CheckSource("10.2.0.1"), check.IsNil)
+	err = r.CheckSource("192.168.1.11")
+	c.Assert(err, check.ErrorMatches, `.*\(namespace allowlist\).`)
+}
+
+func (s *S) TestSetAllowedSources(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "myapp"})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("myapp")
+	err = SetAllowedSources("myapp", []string{"10.0.0.0/8"})
+	c.Assert(err, check.IsNil)
+	r, err := Get("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(r.AllowedSources, check.DeepEquals, []string{"10.0.0.0/8"})
+}
+
+func (s *S) TestSetAllowedSourcesInvalid(c *check.C) {
+	err := SetAllowedSources("myapp", []string{"10.0.0.0/33"})
+	c.Assert(err, check.FitsTypeOf, &InvalidSourceError{})
+}
+
+func (s *S) TestSetAllowedSourcesRepositoryNotFound(c *check.C) {
+	err := SetAllowedSources("ghost", []string{"10.0.0.0/8"})
+	c.Assert(err, check.Equals, ErrRepositoryNotFound)
+}
+
+func (s *S) TestSetNamespaceAllowedSourcesNotFound(c *check.C) {
+	err := SetNamespaceAllowedSources("ghost", []string{"10.0.0.0/8"})
+	c.Assert(err, check.Equals, ErrNamespaceNotFound)
+}
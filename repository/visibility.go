@@ -0,0 +1,79 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/tsuru/gandalf/fs"
+)
+
+// Visibility is the level of access to a repository granted to users that
+// have no explicit grant in it.
+type Visibility string
+
+const (
+	// VisibilityPrivate repositories may only be read by the users with a
+	// grant in them.
+	VisibilityPrivate = Visibility("private")
+	// VisibilityInternal repositories may be read by any registered user
+	// that is not suspended.
+	VisibilityInternal = Visibility("internal")
+	// VisibilityPublic repositories may be read by anyone, including
+	// anonymous users, and are exported by git-daemon.
+	VisibilityPublic = Visibility("public")
+)
+
+// exportMarker is the file that tells git-daemon to export a repository.
+const exportMarker = "git-daemon-export-ok"
+
+// VisibilityLevel returns the visibility of the repository. Repositories
+// stored before visibility levels existed have none, and their visibility
+// comes from IsPublic.
+func (r *Repository) VisibilityLevel() Visibility {
+	if r.Visibility != "" {
+		return r.Visibility
+	}
+	if r.IsPublic {
+		return VisibilityPublic
+	}
+	return VisibilityPrivate
+}
+
+// normalizeVisibility validates the visibility of the repository, filling it
+// from IsPublic when it's empty, and keeps IsPublic in sync with it.
+func (r *Repository) normalizeVisibility() error {
+	switch r.VisibilityLevel() {
+	case VisibilityPrivate, VisibilityInternal, VisibilityPublic:
+	default:
+		return &InvalidRepositoryError{message: fmt.Sprintf("invalid visibility %q, valid options are: private, internal or public", r.Visibility)}
+	}
+	r.Visibility = r.VisibilityLevel()
+	r.IsPublic = r.Visibility == VisibilityPublic
+	return nil
+}
+
+// syncExportMarker creates the git-daemon export marker in the bare
+// repository when it's public, and removes it otherwise. Repositories
+// without a bare repository are left alone.
+func syncExportMarker(r *Repository) error {
+	marker := path.Join(barePath(r.Name), exportMarker)
+	if r.VisibilityLevel() == VisibilityPublic {
+		f, err := fs.Filesystem().Create(marker)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("Could not export repository %s: %s", r.Name, err)
+		}
+		return f.Close()
+	}
+	if err := fs.Filesystem().Remove(marker); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not stop exporting repository %s: %s", r.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repository
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/commandmocker"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/tsuru/fs/fstest"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestVisibilityLevel(c *check.C) {
+	r := Repository{Name: "myapp"}
+	c.Assert(r.VisibilityLevel(), check.Equals, VisibilityPrivate)
+	r.IsPublic = true
+	c.Assert(r.VisibilityLevel(), check.Equals, VisibilityPublic)
+	r.Visibility = VisibilityInternal
+	c.Assert(r.VisibilityLevel(), check.Equals, VisibilityInternal)
+}
+
+func (s *S) TestNormalizeVisibility(c *check.C) {
+	r := Repository{Name: "myapp", IsPublic: true}
+	c.Assert(r.normalizeVisibility(), check.IsNil)
+	c.Assert(r.Visibility, check.Equals, VisibilityPublic)
+	r.Visibility = VisibilityInternal
+	c.Assert(r.normalizeVisibility(), check.IsNil)
+	c.Assert(r.IsPublic, check.Equals, false)
+	r.Visibility = "secret"
+	err := r.normalizeVisibility()
+	c.Assert(err, check.FitsTypeOf, &InvalidRepositoryError{})
+	c.Assert(err, check.ErrorMatches, `invalid visibility "secret", valid options are: private, internal or public`)
+}
+
+func (s *S) TestSyncExportMarker(c *check.C) {
+	rfs := &fstest.RecordingFs{}
+	fs.Fsystem = rfs
+	defer func() { fs.Fsystem = nil }()
+	path := barePath("myapp") + "/git-daemon-export-ok"
+	err := syncExportMarker(&Repository{Name: "myapp", Visibility: VisibilityPublic})
+	c.Assert(err, check.IsNil)
+	c.Assert(rfs.HasAction("create "+path), check.Equals, true)
+	err = syncExportMarker(&Repository{Name: "myapp", Visibility: VisibilityInternal})
+	c.Assert(err, check.IsNil)
+	c.Assert(rfs.HasAction("remove "+path), check.Equals, true)
+}
+
+func (s *S) TestSyncExportMarkerWithoutBareRepository(c *check.C) {
+	err := syncExportMarker(&Repository{Name: "ghost", Visibility: VisibilityPublic})
+	c.Assert(err, check.IsNil)
+	err = syncExportMarker(&Repository{Name: "ghost", Visibility: VisibilityPrivate})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestPermissionInternalRepository(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, u := range []bson.M{{"_id": "sam"}, {"_id": "gollum", "suspended": true}} {
+		err = conn.User().Insert(u)
+		c.Assert(err, check.IsNil)
+		defer conn.User().RemoveId(u["_id"])
+	}
+	r := Repository{Name: "myapp", Users: []string{"bilbo"}, Visibility: VisibilityInternal}
+	c.Assert(r.Permission("sam"), check.Equals, Permission{Repository: "myapp", User: "sam", Access: AccessRead, Source: SourceInternal})
+	c.Assert(r.Permission("bilbo").Source, check.Equals, SourceDirect)
+	c.Assert(r.HasReadPermission("gollum"), check.Equals, false)
+	c.Assert(r.HasReadPermission("nobody"), check.Equals, false)
+	c.Assert(r.HasReadPermission(""), check.Equals, false)
+	c.Assert(r.HasWritePermission("sam"), check.Equals, false)
+}
+
+func (s *S) TestUpdateSyncsExportMarker(c *check.C) {
+	tmpdir, err := commandmocker.Add("git", "$*")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(tmpdir)
+	r, err := NewWithVisibility("freedom", []string{"bilbo"}, nil, VisibilityInternal)
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Repository().RemoveId(r.Name)
+	c.Assert(r.IsPublic, check.Equals, false)
+	rfs := &fstest.RecordingFs{}
+	fs.Fsystem = rfs
+	defer func() { fs.Fsystem = nil }()
+	path := barePath("freedom") + "/git-daemon-export-ok"
+	r.Visibility = VisibilityPublic
+	err = Update(r.Name, *r)
+	c.Assert(err, check.IsNil)
+	c.Assert(rfs.HasAction("create "+path), check.Equals, true)
+	repo, err := Get("freedom")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.Visibility, check.Equals, VisibilityPublic)
+	c.Assert(repo.IsPublic, check.Equals, true)
+	repo.Visibility = VisibilityPrivate
+	err = Update(repo.Name, repo)
+	c.Assert(err, check.IsNil)
+	c.Assert(rfs.HasAction("remove "+path), check.Equals, true)
+	repo, err = Get("freedom")
+	c.Assert(err, check.IsNil)
+	c.Assert(repo.IsPublic, check.Equals, false)
+}
+
+func (s *S) TestUpdateInvalidVisibility(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(Repository{Name: "freedom", Users: []string{"bilbo"}})
+	c.Assert(err, check.IsNil)
+	defer conn.Repository().RemoveId("freedom")
+	err = Update("freedom", Repository{Name: "freedom", Users: []string{"bilbo"}, Visibility: "secret"})
+	c.Assert(err, check.FitsTypeOf, &InvalidRepositoryError{})
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/hook"
+	"github.com/tsuru/gandalf/repository"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/check.v1"
+)
+
+// TestHelperProcess is not a real test. The push tests run the test binary
+// as the ssh command of git, which connects to the server, and as the
+// gandalf update hook, which checks the rules and the protected branches of
+// the repository like gandalf-ssh --update-hook does.
+func TestHelperProcess(t *testing.T) {
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	switch os.Getenv("GANDALF_TEST_HELPER") {
+	case "ssh":
+		os.Exit(sshHelper(args))
+	case "update-hook":
+		os.Exit(updateHookHelper(args))
+	}
+}
+
+func sshHelper(args []string) int {
+	key, err := ioutil.ReadFile(os.Getenv("GANDALF_TEST_SSH_KEY"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	clientConfig := ssh.ClientConfig{User: "git", Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)}}
+	client, err := ssh.Dial("tcp", os.Getenv("GANDALF_TEST_SSH_ADDR"), &clientConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer session.Close()
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	if err = session.Run(args[len(args)-1]); err != nil {
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			return exitErr.ExitStatus()
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func updateHookHelper(args []string) int {
+	if err := config.ReadConfigFile(os.Getenv("GANDALF_CONFIG")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	repo, err := repository.Get(os.Getenv("GANDALF_REPOSITORY"))
+	if err == nil {
+		err = repo.CheckPush(os.Getenv("GANDALF_USER"), args[0], args[1], args[2])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// git runs git in the directory, returning its combined output.
+func git(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func (s *S) TestReceivePackChecksRulesAndProtectedBranches(c *check.C) {
+	testBinary, err := filepath.Abs(os.Args[0])
+	c.Assert(err, check.IsNil)
+	hookPath := path.Join(s.tmpdir, "update-hook")
+	configPath := path.Join(s.tmpdir, "gandalf.conf")
+	script := fmt.Sprintf("#!/bin/sh\nGANDALF_TEST_HELPER=update-hook exec '%s' -test.run='^TestHelperProcess$' -- \"$@\"\n", testBinary)
+	err = ioutil.WriteFile(hookPath, []byte(script), 0755)
+	c.Assert(err, check.IsNil)
+	oldBinPath, err := config.GetString("bin-path")
+	c.Assert(err, check.IsNil)
+	config.Set("bin-path", hookPath)
+	defer config.Set("bin-path", oldBinPath)
+	err = config.WriteConfigFile(configPath, 0600)
+	c.Assert(err, check.IsNil)
+	oldConfigFile := hook.ConfigFile
+	hook.ConfigFile = configPath
+	defer func() { hook.ConfigFile = oldConfigFile }()
+	cleanup := s.createUserAndRepository(c, &repository.Repository{
+		Name:              "myapp",
+		Users:             []string{"bilbo"},
+		Rules:             []repository.RefRule{{Ref: "refs/heads/release/*", Deny: true}},
+		ProtectedBranches: []repository.ProtectedBranch{{Name: "*", DenyNonFastForward: true, DenyDelete: true}},
+	})
+	defer cleanup()
+	bare := repository.BarePath("myapp")
+	_, err = git(s.tmpdir, nil, "init", "--bare", bare)
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(bare)
+	work := path.Join(s.tmpdir, "work")
+	err = os.Mkdir(work, 0755)
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(work)
+	env := []string{
+		"GIT_AUTHOR_NAME=Bilbo", "GIT_AUTHOR_EMAIL=bilbo@shire",
+		"GIT_COMMITTER_NAME=Bilbo", "GIT_COMMITTER_EMAIL=bilbo@shire",
+		"GIT_SSH_COMMAND='" + testBinary + "' -test.run='^TestHelperProcess$' --",
+		"GIT_SSH_VARIANT=simple",
+		"GANDALF_TEST_HELPER=ssh",
+		"GANDALF_TEST_SSH_ADDR=" + s.server.Addr().String(),
+		"GANDALF_TEST_SSH_KEY=" + s.clientKey,
+	}
+	for _, args := range [][]string{
+		{"init"},
+		{"commit", "--allow-empty", "-m", "first"},
+		{"commit", "--allow-empty", "-m", "second"},
+	} {
+		out, err := git(work, env, args...)
+		c.Assert(err, check.IsNil, check.Commentf(out))
+	}
+	remote := "git@127.0.0.1:myapp.git"
+	out, err := git(work, env, "push", remote, "HEAD:refs/heads/master", "HEAD:refs/heads/stable")
+	c.Assert(err, check.IsNil, check.Commentf(out))
+	out, err = git(work, env, "push", remote, "HEAD:refs/heads/release/1.0")
+	c.Assert(err, check.NotNil)
+	c.Assert(out, check.Matches, `(?s).*You are not allowed to create refs/heads/release/1\.0\..*`)
+	out, err = git(work, env, "push", "--force", remote, "HEAD~1:refs/heads/master")
+	c.Assert(err, check.NotNil)
+	c.Assert(out, check.Matches, `(?s).*The branch master is protected, it can't be force-pushed\..*`)
+	out, err = git(work, env, "push", remote, ":refs/heads/stable")
+	c.Assert(err, check.NotNil)
+	c.Assert(out, check.Matches, `(?s).*The branch stable is protected, it can't be deleted\..*`)
+	refs, err := repository.ListRefs("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(refs, check.HasLen, 2)
+	c.Assert(refs["refs/heads/master"], check.Equals, refs["refs/heads/stable"])
+}
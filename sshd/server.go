@@ -0,0 +1,329 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sshd provides an SSH server that authenticates users against the
+// keys stored in gandalf's database and serves git repositories, so gandalf
+// can work without sshd, the authorized_keys file and gandalf-ssh.
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/tsuru/gandalf/audit"
+	"github.com/tsuru/gandalf/hook"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
+	"github.com/tsuru/tsuru/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	userExtension           = "gandalf-user"
+	keyNameExtension        = "gandalf-key-name"
+	keyFingerprintExtension = "gandalf-key-fingerprint"
+	principalExtension      = "gandalf-principal"
+)
+
+// Server is an SSH server that serves git-upload-pack and git-receive-pack
+// for the repositories managed by gandalf.
+type Server struct {
+	config   *ssh.ServerConfig
+	listener net.Listener
+}
+
+// NewServer creates a new server listening on the given address, using the
+// private key stored in hostKeyPath as the host key. The server does not
+// handle connections until Serve is called.
+func NewServer(bind, hostKeyPath string) (*Server, error) {
+	b, err := ioutil.ReadFile(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse SSH host key: %s", err)
+	}
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+	s := Server{listener: listener}
+	s.config = &ssh.ServerConfig{PublicKeyCallback: s.authenticate}
+	s.config.AddHostKey(hostKey)
+	return &s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until the server is stopped.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Stop closes the listener, making Serve return. Established connections are
+// not interrupted.
+func (s *Server) Stop() error {
+	return s.listener.Close()
+}
+
+func (s *Server) authenticate(meta ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	if cert, ok := pubKey.(*ssh.Certificate); ok {
+		return s.authenticateCertificate(meta, cert)
+	}
+	k, err := user.LookupKey(pubKey)
+	if err != nil {
+		if err != user.ErrKeyNotFound {
+			log.Errorf("sshd: failed to look up key from %s: %s", meta.RemoteAddr(), err)
+		}
+		return nil, errors.New("unknown public key")
+	}
+	if k.Expired() {
+		log.Errorf("sshd: key %q of user %q has expired", k.Name, k.UserName)
+		return nil, errors.New("expired public key")
+	}
+	suspended, err := user.IsSuspended(k.UserName)
+	if err != nil {
+		log.Errorf("sshd: failed to check the suspension of user %q: %s", k.UserName, err)
+		return nil, errors.New("unknown public key")
+	}
+	if suspended {
+		log.Errorf("sshd: user %q is suspended", k.UserName)
+		return nil, errors.New("suspended user")
+	}
+	extensions := map[string]string{
+		userExtension:           k.UserName,
+		keyNameExtension:        k.Name,
+		keyFingerprintExtension: k.Fingerprint,
+	}
+	return &ssh.Permissions{Extensions: extensions}, nil
+}
+
+// authenticateCertificate authenticates the user owning the first principal
+// of the certificate that is known to gandalf, as long as the certificate was
+// signed by a registered authority.
+func (s *Server) authenticateCertificate(meta ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+	checker := ssh.CertChecker{
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			ok, err := user.IsAuthority(auth)
+			if err != nil {
+				log.Errorf("sshd: failed to look up authority: %s", err)
+			}
+			return ok
+		},
+	}
+	for _, principal := range cert.ValidPrincipals {
+		u, err := user.GetUserByPrincipal(principal)
+		if err != nil {
+			if err != user.ErrPrincipalNotFound {
+				log.Errorf("sshd: failed to look up principal %q: %s", principal, err)
+			}
+			continue
+		}
+		if u.Suspended {
+			log.Errorf("sshd: user %q of principal %q is suspended", u.Name, principal)
+			return nil, errors.New("suspended user")
+		}
+		if err = checker.CheckCert(principal, cert); err != nil {
+			log.Errorf("sshd: rejected certificate of principal %q from %s: %s", principal, meta.RemoteAddr(), err)
+			return nil, err
+		}
+		extensions := map[string]string{
+			userExtension:      u.Name,
+			principalExtension: principal,
+		}
+		// the source-address critical option is enforced by the ssh package.
+		return &ssh.Permissions{CriticalOptions: cert.CriticalOptions, Extensions: extensions}, nil
+	}
+	return nil, errors.New("unknown principal")
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.Debugf("sshd: handshake with %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	extensions := sconn.Permissions.Extensions
+	from, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	session := repository.Session{
+		User:           extensions[userExtension],
+		KeyName:        extensions[keyNameExtension],
+		KeyFingerprint: extensions[keyFingerprintExtension],
+		Principal:      extensions[principalExtension],
+		ClientAddress:  from,
+	}
+	if session.KeyName != "" {
+		key := user.Key{Name: session.KeyName, UserName: session.User}
+		if err = user.MarkKeyUsed(&key, from); err != nil {
+			log.Errorf("sshd: could not record usage of key %q: %s", session.KeyName, err)
+		}
+	}
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			log.Errorf("sshd: could not accept channel from %s: %s", conn.RemoteAddr(), err)
+			continue
+		}
+		go s.handleSession(session, ch, requests)
+	}
+}
+
+func (s *Server) handleSession(session repository.Session, ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	var env []string
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var variable struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &variable); err == nil && variable.Name == "GIT_PROTOCOL" {
+				env = append(env, variable.Name+"="+variable.Value)
+			}
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			status := s.execute(session, payload.Command, env, ch)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// execute runs the git command requested by the user, returning its exit
+// status.
+func (s *Server) execute(session repository.Session, command string, env []string, ch ssh.Channel) uint32 {
+	stderr := ch.Stderr()
+	action, repoName, err := repository.ParseGitCommand(command)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	repo, err := repository.Get(repoName)
+	if err != nil {
+		log.Errorf("sshd: could not get repository %q: %s", repoName, err)
+		fmt.Fprintln(stderr, "Repository not found")
+		return 1
+	}
+	userName := session.User
+	session.Repository = repoName
+	session.Action = action
+	var allowed bool
+	errMsg := "You don't have access to read this repository."
+	switch action {
+	case "git-upload-pack":
+		allowed = repo.HasReadPermission(userName)
+	case "git-receive-pack":
+		allowed = repo.HasWritePermission(userName)
+		errMsg = "You don't have access to write in this repository."
+	default:
+		fmt.Fprintln(stderr, repository.ErrInvalidGitCommand.Error())
+		return 1
+	}
+	op := audit.Start(session)
+	if !allowed {
+		log.Errorf("sshd: permission denied for %q running %s on %q", userName, action, repoName)
+		auditError(op.Deny(errMsg))
+		fmt.Fprintln(stderr, "Permission denied.")
+		fmt.Fprintln(stderr, errMsg)
+		return 1
+	}
+	if err = repo.CheckSource(session.ClientAddress); err != nil {
+		log.Errorf("sshd: access of %q denied: %s", userName, err)
+		auditError(op.Deny(err.Error()))
+		fmt.Fprintln(stderr, "Permission denied.")
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	log.Debugf("sshd: executing %s %s for %q", action, repoName, userName)
+	cmd := exec.Command(action, repository.BarePath(repoName))
+	cmd.Env = append(os.Environ(), session.Env()...)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = ch
+	cmd.Stderr = stderr
+	// The channel is not passed as cmd.Stdin: Wait would block until the
+	// client closes its side of the channel, which it only does after
+	// receiving the exit status.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	if action == "git-receive-pack" {
+		// The gandalf hooks check the rules and the protected branches of
+		// the repository, like they do for gandalf-ssh and HTTP pushes.
+		hookEnv, err := hook.ReceivePackEnv()
+		if err != nil {
+			log.Errorf("sshd: could not install gandalf hooks: %s", err)
+			auditError(op.Finish(1))
+			fmt.Fprintln(stderr, "Could not install gandalf hooks: "+err.Error())
+			return 1
+		}
+		cmd.Env = append(cmd.Env, hookEnv...)
+		refsEnv, err := op.WatchRefs()
+		auditError(err)
+		cmd.Env = append(cmd.Env, refsEnv...)
+	}
+	if err = cmd.Start(); err != nil {
+		log.Errorf("sshd: could not start %s: %s", action, err)
+		auditError(op.Finish(1))
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	status := 0
+	if err = cmd.Wait(); err != nil {
+		log.Errorf("sshd: %s failed for %q: %s", action, repoName, err)
+		status = 1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if waitStatus, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				status = waitStatus.ExitStatus()
+			}
+		}
+	}
+	auditError(op.Finish(status))
+	return uint32(status)
+}
+
+// auditError logs errors recording operations in the audit log, which don't
+// stop the operations.
+func auditError(err error) {
+	if err != nil {
+		log.Errorf("sshd: could not record the operation in the audit log: %s", err)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/commandmocker"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/user"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	tmpdir    string
+	hostKey   string
+	clientKey string
+	server    *Server
+	signer    ssh.Signer
+}
+
+var _ = check.Suite(&S{})
+
+func generateKey(c *check.C) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func (s *S) SetUpSuite(c *check.C) {
+	err := config.ReadConfigFile("../etc/gandalf.conf")
+	c.Assert(err, check.IsNil)
+	config.Set("database:name", "gandalf_sshd_tests")
+	config.Set("authorized-keys-disabled", true)
+	s.tmpdir, err = ioutil.TempDir("", "gandalf-sshd")
+	c.Assert(err, check.IsNil)
+	config.Set("git:bare:location", path.Join(s.tmpdir, "repositories"))
+	config.Set("git:hooks-path", path.Join(s.tmpdir, "hooks"))
+	s.hostKey = path.Join(s.tmpdir, "host_key")
+	err = ioutil.WriteFile(s.hostKey, generateKey(c), 0600)
+	c.Assert(err, check.IsNil)
+	s.server, err = NewServer("127.0.0.1:0", s.hostKey)
+	c.Assert(err, check.IsNil)
+	go s.server.Serve()
+	clientKey := generateKey(c)
+	s.clientKey = path.Join(s.tmpdir, "client_key")
+	err = ioutil.WriteFile(s.clientKey, clientKey, 0600)
+	c.Assert(err, check.IsNil)
+	s.signer, err = ssh.ParsePrivateKey(clientKey)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	s.server.Stop()
+	os.RemoveAll(s.tmpdir)
+	config.Unset("authorized-keys-disabled")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.User().Database.DropDatabase()
+}
+
+func (s *S) dial(signer ssh.Signer) (*ssh.Client, error) {
+	clientConfig := ssh.ClientConfig{
+		User: "git",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	}
+	return ssh.Dial("tcp", s.server.Addr().String(), &clientConfig)
+}
+
+func (s *S) createUserAndRepository(c *check.C, repo *repository.Repository) func() {
+	authorizedKey := string(ssh.MarshalAuthorizedKey(s.signer.PublicKey()))
+	_, err := user.New("bilbo", map[string]string{"mykey": authorizedKey})
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Repository().Insert(repo)
+	c.Assert(err, check.IsNil)
+	return func() {
+		user.Remove("bilbo")
+		conn, err := db.Conn()
+		c.Assert(err, check.IsNil)
+		defer conn.Close()
+		conn.Repository().Remove(bson.M{"_id": repo.Name})
+	}
+}
+
+func (s *S) TestNewServerHostKeyNotFound(c *check.C) {
+	server, err := NewServer("127.0.0.1:0", path.Join(s.tmpdir, "unknown"))
+	c.Assert(err, check.NotNil)
+	c.Assert(server, check.IsNil)
+}
+
+func (s *S) TestNewServerInvalidHostKey(c *check.C) {
+	keyPath := path.Join(s.tmpdir, "invalid_key")
+	err := ioutil.WriteFile(keyPath, []byte("not a key"), 0600)
+	c.Assert(err, check.IsNil)
+	server, err := NewServer("127.0.0.1:0", keyPath)
+	c.Assert(err, check.ErrorMatches, "^Could not parse SSH host key: .*")
+	c.Assert(server, check.IsNil)
+}
+
+func (s *S) TestUnknownKey(c *check.C) {
+	signer, err := ssh.ParsePrivateKey(generateKey(c))
+	c.Assert(err, check.IsNil)
+	client, err := s.dial(signer)
+	c.Assert(err, check.NotNil)
+	c.Assert(client, check.IsNil)
+}
+
+func (s *S) TestSuspendedUser(c *check.C) {
+	cleanUp := s.createUserAndRepository(c, &repository.Repository{Name: "myrepo", Users: []string{"bilbo"}})
+	defer cleanUp()
+	err := user.Suspend("bilbo")
+	c.Assert(err, check.IsNil)
+	client, err := s.dial(s.signer)
+	c.Assert(err, check.NotNil)
+	c.Assert(client, check.IsNil)
+}
+
+func (s *S) TestUploadPack(c *check.C) {
+	dir, err := commandmocker.Add("git-upload-pack", "$*")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	cleanup := s.createUserAndRepository(c, &repository.Repository{Name: "myapp", ReadOnlyUsers: []string{"bilbo"}})
+	defer cleanup()
+	client, err := s.dial(s.signer)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	session, err := client.NewSession()
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+	out, err := session.Output("git-upload-pack 'myapp.git'")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(out), check.Equals, repository.BarePath("myapp"))
+	envs := commandmocker.Envs(dir)
+	c.Assert(envs, check.Matches, `(?s).*TSURU_USER=bilbo.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_KEY_NAME=mykey.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_REPOSITORY=myapp.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_ACTION=git-upload-pack.*`)
+}
+
+func (s *S) TestKeyUsageIsRecorded(c *check.C) {
+	cleanup := s.createUserAndRepository(c, &repository.Repository{Name: "myapp", Users: []string{"bilbo"}})
+	defer cleanup()
+	client, err := s.dial(s.signer)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	session, err := client.NewSession()
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+	// the key usage is recorded before any command is handled.
+	session.Run("rm -rf /")
+	k, err := user.LookupKey(s.signer.PublicKey())
+	c.Assert(err, check.IsNil)
+	c.Assert(k.LastUsedFrom, check.Equals, "127.0.0.1")
+	c.Assert(k.LastUsedAt.IsZero(), check.Equals, false)
+}
+
+// certificate returns a signer that authenticates with a certificate issued
+// to the given principal, signed by the authority.
+func (s *S) certificate(c *check.C, authority ssh.Signer, principal string) ssh.Signer {
+	cert := &ssh.Certificate{
+		Key:             s.signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	err := cert.SignCert(rand.Reader, authority)
+	c.Assert(err, check.IsNil)
+	signer, err := ssh.NewCertSigner(cert, s.signer)
+	c.Assert(err, check.IsNil)
+	return signer
+}
+
+func (s *S) TestUploadPackWithCertificate(c *check.C) {
+	dir, err := commandmocker.Add("git-upload-pack", "$*")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	cleanup := s.createUserAndRepository(c, &repository.Repository{Name: "myapp", ReadOnlyUsers: []string{"bilbo"}})
+	defer cleanup()
+	authority, err := ssh.ParsePrivateKey(generateKey(c))
+	c.Assert(err, check.IsNil)
+	err = user.AddAuthority("shire", string(ssh.MarshalAuthorizedKey(authority.PublicKey())))
+	c.Assert(err, check.IsNil)
+	defer user.RemoveAuthority("shire")
+	err = user.AddPrincipal("bilbo", "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	client, err := s.dial(s.certificate(c, authority, "bilbo@shire"))
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	session, err := client.NewSession()
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+	out, err := session.Output("git-upload-pack 'myapp.git'")
+	c.Assert(err, check.IsNil)
+	c.Assert(string(out), check.Equals, repository.BarePath("myapp"))
+	envs := commandmocker.Envs(dir)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_USER=bilbo.*`)
+	c.Assert(envs, check.Matches, `(?s).*GANDALF_PRINCIPAL=bilbo@shire.*`)
+}
+
+func (s *S) TestCertificateSignedByUnknownAuthority(c *check.C) {
+	cleanup := s.createUserAndRepository(c, &repository.Repository{Name: "myapp", Users: []string{"bilbo"}})
+	defer cleanup()
+	authority, err := ssh.ParsePrivateKey(generateKey(c))
+	c.Assert(err, check.IsNil)
+	err = user.AddPrincipal("bilbo", "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	client, err := s.dial(s.certificate(c, authority, "bilbo@shire"))
+	c.Assert(err, check.NotNil)
+	c.Assert(client, check.IsNil)
+}
+
+func (s *S) TestReceivePackWithoutPermission(c *check.C) {
+	dir, err := commandmocker.Add("git-receive-pack", "$*")
+	c.Assert(err, check.IsNil)
+	defer commandmocker.Remove(dir)
+	cleanup := s.createUserAndRepository(c, &repository.Repository{Name: "myapp", ReadOnlyUsers: []string{"bilbo"}})
+	defer cleanup()
+	client, err := s.dial(s.signer)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	session, err := client.NewSession()
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+	out, err := session.CombinedOutput("git-receive-pack 'myapp.git'")
+	c.Assert(err, check.FitsTypeOf, &ssh.ExitError{})
+	c.Assert(string(out), check.Equals, "Permission denied.\nYou don't have access to write in this repository.\n")
+	c.Assert(commandmocker.Ran(dir), check.Equals, false)
+}
+
+func (s *S) TestInvalidCommand(c *check.C) {
+	cleanup := s.createUserAndRepository(c, &repository.Repository{Name: "myapp", Users: []string{"bilbo"}})
+	defer cleanup()
+	client, err := s.dial(s.signer)
+	c.Assert(err, check.IsNil)
+	defer client.Close()
+	session, err := client.NewSession()
+	c.Assert(err, check.IsNil)
+	defer session.Close()
+	out, err := session.CombinedOutput("rm -rf /")
+	c.Assert(err, check.FitsTypeOf, &ssh.ExitError{})
+	c.Assert(string(out), check.Equals, repository.ErrInvalidGitCommand.Error()+"\n")
+}
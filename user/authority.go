@@ -0,0 +1,315 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrAuthorityNotFound  = errors.New("Authority not found")
+	ErrDuplicateAuthority = errors.New("Duplicate authority")
+	ErrInvalidPrincipal   = errors.New("Invalid principal")
+	ErrDuplicatePrincipal = errors.New("Principal already in use")
+	ErrPrincipalNotFound  = errors.New("Principal not found")
+	principalRegexp       = regexp.MustCompile(`^[a-zA-Z0-9-+.@_]+$`)
+)
+
+// Authority is a trusted certificate authority. Users may authenticate with
+// SSH certificates signed by an authority, instead of registering their keys.
+// The principals in the certificate are mapped to gandalf users, see
+// AddPrincipal.
+type Authority struct {
+	Name        string `bson:"_id"`
+	Body        string
+	Type        string
+	Fingerprint string
+	CreatedAt   time.Time
+}
+
+// format returns the authorized_keys line that trusts the authority to sign
+// certificates for the given principal.
+func (a *Authority) format(principal string) string {
+	binPath, err := config.GetString("bin-path")
+	if err != nil {
+		panic(err)
+	}
+	authorityFmt := `cert-authority,principals="%s",no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s --principal %s" %s` + "\n"
+	return fmt.Sprintf(authorityFmt, principal, binPath, principal, strings.TrimSpace(a.Body))
+}
+
+func (a *Authority) dump(w io.Writer, principals []string) error {
+	for _, principal := range principals {
+		formatted := a.format(principal)
+		n, err := fmt.Fprint(w, formatted)
+		if err != nil {
+			return err
+		}
+		if n != len(formatted) {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// writeAuthorities writes the lines that trust the given authorities to sign
+// certificates for the given principals to the authorized_keys file.
+func writeAuthorities(authorities []Authority, principals []string) error {
+	return appendAuthorizedKeys(func(w io.Writer) error {
+		var buf bytes.Buffer
+		for _, a := range authorities {
+			a.dump(&buf, principals)
+		}
+		_, err := buf.WriteTo(w)
+		return err
+	})
+}
+
+// removeAuthorities removes the lines that trust the given authorities to
+// sign certificates for the given principals from the authorized_keys file.
+func removeAuthorities(authorities []Authority, principals []string) error {
+	formatted := make(map[string]bool)
+	for _, a := range authorities {
+		for _, principal := range principals {
+			formatted[a.format(principal)] = true
+		}
+	}
+	return removeAuthorizedKeys(formatted)
+}
+
+// allPrincipals returns the principals of all users that are not suspended.
+func allPrincipals(conn *db.Storage) ([]string, error) {
+	var users []User
+	err := conn.User().Find(bson.M{"principals": bson.M{"$exists": true}, "suspended": bson.M{"$ne": true}}).All(&users)
+	if err != nil {
+		return nil, err
+	}
+	var principals []string
+	for _, u := range users {
+		principals = append(principals, u.Principals...)
+	}
+	return principals, nil
+}
+
+// AddAuthority registers a certificate authority, given its public key in
+// the authorized_keys format.
+func AddAuthority(name, body string) error {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(body))
+	if err != nil {
+		return ErrInvalidKey
+	}
+	a := Authority{
+		Name:        name,
+		Body:        string(ssh.MarshalAuthorizedKey(pubKey)),
+		Type:        pubKey.Type(),
+		Fingerprint: fingerprint(pubKey),
+		CreatedAt:   time.Now(),
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.Authority().Insert(&a); err != nil {
+		if mgo.IsDup(err) {
+			return ErrDuplicateAuthority
+		}
+		return err
+	}
+	principals, err := allPrincipals(conn)
+	if err != nil {
+		return err
+	}
+	return writeAuthorities([]Authority{a}, principals)
+}
+
+// RemoveAuthority removes a certificate authority. Certificates signed by it
+// are no longer accepted.
+func RemoveAuthority(name string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var a Authority
+	if err = conn.Authority().FindId(name).One(&a); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrAuthorityNotFound
+		}
+		return err
+	}
+	if err = conn.Authority().RemoveId(name); err != nil {
+		return err
+	}
+	principals, err := allPrincipals(conn)
+	if err != nil {
+		return err
+	}
+	return removeAuthorities([]Authority{a}, principals)
+}
+
+// authorityLines returns the authorized_keys lines that trust the registered
+// authorities to sign certificates for the principals of all users.
+func authorityLines() ([]string, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var authorities []Authority
+	if err = conn.Authority().Find(nil).Sort("_id").All(&authorities); err != nil {
+		return nil, err
+	}
+	principals, err := allPrincipals(conn)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, a := range authorities {
+		for _, principal := range principals {
+			lines = append(lines, a.format(principal))
+		}
+	}
+	return lines, nil
+}
+
+// AuthorizedAuthorities returns the authorized_keys lines that trust the
+// registered authorities to sign certificates for the principals of all
+// users.
+func AuthorizedAuthorities() (string, error) {
+	lines, err := authorityLines()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(lines, ""), nil
+}
+
+// ListAuthorities lists the registered certificate authorities.
+func ListAuthorities() ([]Authority, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	authorities := []Authority{}
+	err = conn.Authority().Find(nil).Sort("_id").All(&authorities)
+	return authorities, err
+}
+
+// IsAuthority returns whether the given public key belongs to a registered
+// certificate authority.
+func IsAuthority(pubKey ssh.PublicKey) (bool, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	n, err := conn.Authority().Find(bson.M{"fingerprint": fingerprint(pubKey)}).Count()
+	return n > 0, err
+}
+
+// AddPrincipal maps a certificate principal to the user, so certificates
+// issued to the principal by any registered authority authenticate the user.
+// A principal may belong to only one user.
+func AddPrincipal(username, principal string) error {
+	if !principalRegexp.MatchString(principal) {
+		return ErrInvalidPrincipal
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	n, err := conn.User().Find(bson.M{"principals": principal}).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrDuplicatePrincipal
+	}
+	err = conn.User().UpdateId(username, bson.M{"$addToSet": bson.M{"principals": principal}})
+	if err == mgo.ErrNotFound {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if n, err = conn.User().Find(bson.M{"_id": username, "suspended": true}).Count(); err != nil || n > 0 {
+		return err
+	}
+	var authorities []Authority
+	if err = conn.Authority().Find(nil).All(&authorities); err != nil {
+		return err
+	}
+	return writeAuthorities(authorities, []string{principal})
+}
+
+// RemovePrincipal removes the mapping between the principal and the user.
+func RemovePrincipal(username, principal string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.User().Update(bson.M{"_id": username, "principals": principal}, bson.M{"$pull": bson.M{"principals": principal}})
+	if err == mgo.ErrNotFound {
+		if n, _ := conn.User().FindId(username).Count(); n == 0 {
+			return ErrUserNotFound
+		}
+		return ErrPrincipalNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return removePrincipals([]string{principal})
+}
+
+// removePrincipals removes the authority lines of the given principals from
+// the authorized_keys file.
+func removePrincipals(principals []string) error {
+	if len(principals) == 0 {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var authorities []Authority
+	if err = conn.Authority().Find(nil).All(&authorities); err != nil {
+		return err
+	}
+	return removeAuthorities(authorities, principals)
+}
+
+// GetUserByPrincipal returns the user that owns the given principal.
+func GetUserByPrincipal(principal string) (*User, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var u User
+	err = conn.User().Find(bson.M{"principals": principal}).One(&u)
+	if err == mgo.ErrNotFound {
+		return nil, ErrPrincipalNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
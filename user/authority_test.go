@@ -0,0 +1,169 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) authorizedKeys(c *check.C) string {
+	f, err := s.rfs.Open(authKey())
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	return string(b)
+}
+
+func (s *S) TestFormatAuthority(c *check.C) {
+	a := Authority{Name: "shire", Body: "ssh-rsa somekey\n"}
+	p, err := config.GetString("bin-path")
+	c.Assert(err, check.IsNil)
+	expected := fmt.Sprintf(`cert-authority,principals="bilbo@shire",no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s --principal bilbo@shire" ssh-rsa somekey`+"\n", p)
+	c.Assert(a.format("bilbo@shire"), check.Equals, expected)
+}
+
+func (s *S) TestWriteAndRemoveAuthorities(c *check.C) {
+	a := Authority{Name: "shire", Body: "ssh-rsa somekey\n"}
+	err := writeAuthorities([]Authority{a}, []string{"bilbo@shire", "frodo@shire"})
+	c.Assert(err, check.IsNil)
+	c.Assert(s.authorizedKeys(c), check.Equals, a.format("bilbo@shire")+a.format("frodo@shire"))
+	err = removeAuthorities([]Authority{a}, []string{"bilbo@shire"})
+	c.Assert(err, check.IsNil)
+	c.Assert(s.authorizedKeys(c), check.Equals, a.format("frodo@shire"))
+}
+
+func (s *S) TestAddAuthority(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = AddPrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	err = AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	defer RemoveAuthority("shire")
+	authorities, err := ListAuthorities()
+	c.Assert(err, check.IsNil)
+	c.Assert(authorities, check.HasLen, 1)
+	c.Assert(authorities[0].Name, check.Equals, "shire")
+	c.Assert(authorities[0].Fingerprint, check.Equals, keyFingerprint)
+	c.Assert(s.authorizedKeys(c), check.Equals, authorities[0].format("bilbo@shire"))
+}
+
+func (s *S) TestAddAuthorityInvalidKey(c *check.C) {
+	err := AddAuthority("shire", "not a key")
+	c.Assert(err, check.Equals, ErrInvalidKey)
+}
+
+func (s *S) TestAddAuthorityDuplicate(c *check.C) {
+	err := AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	defer RemoveAuthority("shire")
+	err = AddAuthority("shire", rawKey)
+	c.Assert(err, check.Equals, ErrDuplicateAuthority)
+}
+
+func (s *S) TestRemoveAuthority(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = AddPrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	err = AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	err = RemoveAuthority("shire")
+	c.Assert(err, check.IsNil)
+	authorities, err := ListAuthorities()
+	c.Assert(err, check.IsNil)
+	c.Assert(authorities, check.HasLen, 0)
+	c.Assert(s.authorizedKeys(c), check.Equals, "")
+}
+
+func (s *S) TestRemoveAuthorityNotFound(c *check.C) {
+	err := RemoveAuthority("mordor")
+	c.Assert(err, check.Equals, ErrAuthorityNotFound)
+}
+
+func (s *S) TestAddPrincipal(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	defer RemoveAuthority("shire")
+	err = AddPrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	found, err := GetUserByPrincipal("bilbo@shire")
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Name, check.Equals, "bilbo")
+	c.Assert(found.Principals, check.DeepEquals, []string{"bilbo@shire"})
+	authorities, err := ListAuthorities()
+	c.Assert(err, check.IsNil)
+	c.Assert(s.authorizedKeys(c), check.Equals, authorities[0].format("bilbo@shire"))
+}
+
+func (s *S) TestAddPrincipalInvalid(c *check.C) {
+	err := AddPrincipal("bilbo", `bilbo",command="sh`)
+	c.Assert(err, check.Equals, ErrInvalidPrincipal)
+}
+
+func (s *S) TestAddPrincipalUserNotFound(c *check.C) {
+	err := AddPrincipal("nobody", "nobody@shire")
+	c.Assert(err, check.Equals, ErrUserNotFound)
+}
+
+func (s *S) TestAddPrincipalInUse(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	other, err := New("frodo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(other.Name)
+	err = AddPrincipal(u.Name, "baggins@shire")
+	c.Assert(err, check.IsNil)
+	err = AddPrincipal(other.Name, "baggins@shire")
+	c.Assert(err, check.Equals, ErrDuplicatePrincipal)
+}
+
+func (s *S) TestRemovePrincipal(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	defer RemoveAuthority("shire")
+	err = AddPrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	err = RemovePrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	_, err = GetUserByPrincipal("bilbo@shire")
+	c.Assert(err, check.Equals, ErrPrincipalNotFound)
+	c.Assert(s.authorizedKeys(c), check.Equals, "")
+}
+
+func (s *S) TestRemovePrincipalNotFound(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = RemovePrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.Equals, ErrPrincipalNotFound)
+}
+
+func (s *S) TestRemoveUserRemovesPrincipals(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	err = AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	defer RemoveAuthority("shire")
+	err = AddPrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	err = Remove(u.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.authorizedKeys(c), check.Equals, "")
+}
@@ -6,10 +6,14 @@ package user
 
 import (
 	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"os"
 	"os/user"
 	"path"
@@ -32,18 +36,110 @@ var (
 )
 
 type Key struct {
-	Name      string
-	Body      string
-	Comment   string
-	UserName  string
-	CreatedAt time.Time
+	Name           string    `json:"name,omitempty"`
+	Body           string    `json:"body,omitempty"`
+	Comment        string    `json:"comment,omitempty"`
+	UserName       string    `json:"userName,omitempty"`
+	Type           string    `json:"type,omitempty"`
+	Bits           int       `json:"bits,omitempty"`
+	Fingerprint    string    `json:"fingerprint,omitempty"`
+	MD5Fingerprint string    `json:"md5Fingerprint,omitempty"`
+	CreatedAt      time.Time `json:"createdAt,omitempty"`
+	ExpiresAt      time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt     time.Time `json:"lastUsedAt,omitempty"`
+	LastUsedFrom   string    `json:"lastUsedFrom,omitempty"`
+}
+
+// MarshalJSON leaves out the times that are not set (e.g. keys that never
+// expire or were never used), instead of showing them as 0001-01-01.
+func (k Key) MarshalJSON() ([]byte, error) {
+	type key Key
+	return json.Marshal(struct {
+		key
+		CreatedAt  *time.Time `json:"createdAt,omitempty"`
+		ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+		LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	}{key(k), optionalTime(k.CreatedAt), optionalTime(k.ExpiresAt), optionalTime(k.LastUsedAt)})
+}
+
+// optionalTime returns nil for the zero time.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Expired returns whether the key has expired. Keys without an expiration
+// time never expire.
+func (k *Key) Expired() bool {
+	return !k.ExpiresAt.IsZero() && !time.Now().Before(k.ExpiresAt)
+}
+
+// fingerprint returns the SHA256 fingerprint of the key, in the same format
+// used by OpenSSH (e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8").
+func fingerprint(pubKey ssh.PublicKey) string {
+	sum := sha256.Sum256(pubKey.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// md5Fingerprint returns the MD5 fingerprint of the key, in the same format
+// used by OpenSSH (e.g. "MD5:07:b9:a1:65:1b:10:a5:56:e1:e1:d6:b2:ae:f1:a4:2d").
+func md5Fingerprint(pubKey ssh.PublicKey) string {
+	sum := md5.Sum(pubKey.Marshal())
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return "MD5:" + strings.Join(parts, ":")
+}
+
+// keyBits returns the size of the key, in bits.
+func keyBits(pubKey ssh.PublicKey) int {
+	switch pubKey.Type() {
+	case ssh.KeyAlgoRSA:
+		var w struct {
+			Name string
+			E, N *big.Int
+		}
+		if err := ssh.Unmarshal(pubKey.Marshal(), &w); err == nil {
+			return w.N.BitLen()
+		}
+	case ssh.KeyAlgoDSA:
+		var w struct {
+			Name       string
+			P, Q, G, Y *big.Int
+		}
+		if err := ssh.Unmarshal(pubKey.Marshal(), &w); err == nil {
+			return w.P.BitLen()
+		}
+	case ssh.KeyAlgoECDSA256:
+		return 256
+	case ssh.KeyAlgoECDSA384:
+		return 384
+	case ssh.KeyAlgoECDSA521:
+		return 521
+	}
+	return 0
+}
+
+// setAttributes fills the attributes of the key that are derived from the
+// public key.
+func (k *Key) setAttributes(pubKey ssh.PublicKey) {
+	k.Type = pubKey.Type()
+	k.Bits = keyBits(pubKey)
+	k.Fingerprint = fingerprint(pubKey)
+	k.MD5Fingerprint = md5Fingerprint(pubKey)
 }
 
 func newKey(name, user, raw string) (*Key, error) {
-	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(raw))
+	key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(raw))
 	if err != nil {
 		return nil, ErrInvalidKey
 	}
+	if err = checkKeyPolicy(key, options); err != nil {
+		return nil, err
+	}
 	body := ssh.MarshalAuthorizedKey(key.(ssh.PublicKey))
 	k := Key{
 		Name:      name,
@@ -52,6 +148,7 @@ func newKey(name, user, raw string) (*Key, error) {
 		UserName:  user,
 		CreatedAt: time.Now(),
 	}
+	k.setAttributes(key)
 	return &k, nil
 }
 
@@ -69,8 +166,18 @@ func (k *Key) format() string {
 	if err != nil {
 		panic(err)
 	}
-	keyFmt := `no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s %s" %s` + "\n"
-	return fmt.Sprintf(keyFmt, binPath, k.UserName, k)
+	command := binPath + " " + k.UserName
+	if k.Fingerprint != "" {
+		command += " " + k.Fingerprint
+	}
+	keyFmt := `no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s" %s` + "\n"
+	return fmt.Sprintf(keyFmt, command, k)
+}
+
+// AuthorizedKey returns the line that represents the key in the
+// authorized_keys file.
+func (k *Key) AuthorizedKey() string {
+	return k.format()
 }
 
 func (k *Key) dump(w io.Writer) error {
@@ -98,6 +205,15 @@ func authKey() string {
 	return path.Join(home, ".ssh", "authorized_keys")
 }
 
+// manageAuthorizedKeys returns whether gandalf should keep the
+// authorized_keys file in sync with the keys in the database. It may be
+// disabled with the authorized-keys-disabled setting when keys are checked
+// against the database by other means, like the embedded SSH server.
+func manageAuthorizedKeys() bool {
+	disabled, _ := config.GetBool("authorized-keys-disabled")
+	return !disabled
+}
+
 // creates a copy of the authorized_keys and returns it, with the file cursor
 // pointing at the first byte of the file.
 func copyFile() (tsurufs.File, error) {
@@ -137,13 +253,35 @@ func moveFile(fromPath string) error {
 }
 
 func writeKey(k *Key) error {
+	return appendAuthorizedKeys(k.dump)
+}
+
+// writeActiveKey writes the key to the authorized_keys file, unless its user
+// is suspended.
+func writeActiveKey(k *Key) error {
+	if !manageAuthorizedKeys() {
+		return nil
+	}
+	suspended, err := IsSuspended(k.UserName)
+	if err != nil || suspended {
+		return err
+	}
+	return writeKey(k)
+}
+
+// appendAuthorizedKeys appends the lines written by dump to the
+// authorized_keys file.
+func appendAuthorizedKeys(dump func(io.Writer) error) error {
+	if !manageAuthorizedKeys() {
+		return nil
+	}
 	file, err := copyFile()
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 	file.Seek(0, 2)
-	err = k.dump(file)
+	err = dump(file)
 	if err != nil {
 		return err
 	}
@@ -155,6 +293,10 @@ func addKey(name, body, username string) error {
 	if err != nil {
 		return err
 	}
+	return insertKey(key)
+}
+
+func insertKey(key *Key) error {
 	conn, err := db.Conn()
 	if err != nil {
 		return err
@@ -167,7 +309,7 @@ func addKey(name, body, username string) error {
 		}
 		return err
 	}
-	return writeKey(key)
+	return writeActiveKey(key)
 }
 
 func updateKey(name, body, username string) error {
@@ -175,6 +317,14 @@ func updateKey(name, body, username string) error {
 	if err != nil {
 		return err
 	}
+	return replaceKey(newK)
+}
+
+// replaceKey replaces the stored key with the same name and user. The new
+// key keeps the expiration time of the old one, unless it has its own, and
+// the record of its last use.
+func replaceKey(newK *Key) error {
+	name, username := newK.Name, newK.UserName
 	var oldK Key
 	conn, err := db.Conn()
 	if err != nil {
@@ -185,30 +335,49 @@ func updateKey(name, body, username string) error {
 	if err != nil {
 		return ErrKeyNotFound
 	}
+	if newK.ExpiresAt.IsZero() {
+		newK.ExpiresAt = oldK.ExpiresAt
+	}
+	newK.LastUsedAt, newK.LastUsedFrom = oldK.LastUsedAt, oldK.LastUsedFrom
 	err = remove(&oldK)
 	if err != nil {
 		return err
 	}
-	err = writeKey(newK)
+	err = writeActiveKey(newK)
 	if err != nil {
-		writeKey(&oldK)
+		writeActiveKey(&oldK)
 		return err
 	}
 	return conn.Key().Update(bson.M{"name": name, "username": username}, newK)
 }
 
-func addKeys(keys map[string]string, username string) error {
-	for name, k := range keys {
-		err := addKey(name, k, username)
+func addKeys(keys map[string]string, username string, expiresAt time.Time) error {
+	for name, body := range keys {
+		k, err := newKey(name, username, body)
 		if err != nil {
 			return err
 		}
+		k.ExpiresAt = expiresAt
+		if err = insertKey(k); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func remove(k *Key) error {
-	formatted := k.format()
+	// lines written by older versions of gandalf don't include the
+	// fingerprint of the key in the command.
+	legacy := *k
+	legacy.Fingerprint = ""
+	return removeAuthorizedKeys(map[string]bool{k.format(): true, legacy.format(): true})
+}
+
+// removeAuthorizedKeys removes the given lines from the authorized_keys file.
+func removeAuthorizedKeys(formatted map[string]bool) error {
+	if !manageAuthorizedKeys() {
+		return nil
+	}
 	file, err := copyFile()
 	if err != nil {
 		return err
@@ -218,7 +387,7 @@ func remove(k *Key) error {
 	reader := bufio.NewReader(file)
 	line, _ := reader.ReadString('\n')
 	for line != "" {
-		if line != formatted {
+		if !formatted[line] {
 			lines = append(lines, line)
 		}
 		line, _ = reader.ReadString('\n')
@@ -267,10 +436,162 @@ func removeKey(name, username string) error {
 	if err != nil {
 		return ErrKeyNotFound
 	}
-	conn.Key().Remove(k)
+	err = conn.Key().Remove(bson.M{"name": name, "username": username})
+	if err != nil {
+		return err
+	}
 	return remove(&k)
 }
 
+// LookupKey returns the stored key matching the given public key.
+//
+// If no user has registered the key, returns ErrKeyNotFound.
+func LookupKey(pubKey ssh.PublicKey) (*Key, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var k Key
+	body := string(ssh.MarshalAuthorizedKey(pubKey))
+	err = conn.Key().Find(bson.M{"body": body}).One(&k)
+	if err == mgo.ErrNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.MD5Fingerprint == "" {
+		k.setAttributes(pubKey)
+	}
+	return &k, nil
+}
+
+// GetKeyByFingerprint returns the key with the given fingerprint, either
+// SHA256 ("SHA256:<base64>") or MD5 ("MD5:<hex>", the prefix is optional).
+//
+// If no user has registered the key, returns ErrKeyNotFound.
+func GetKeyByFingerprint(fp string) (*Key, error) {
+	if !strings.HasPrefix(fp, "SHA256:") && !strings.HasPrefix(fp, "MD5:") {
+		fp = "MD5:" + fp
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var k Key
+	q := bson.M{"$or": []bson.M{{"fingerprint": fp}, {"md5fingerprint": fp}}}
+	err = conn.Key().Find(q).One(&k)
+	if err == mgo.ErrNotFound {
+		// keys added by older versions of gandalf don't have fingerprints.
+		if err = fillKeyAttributes(); err != nil {
+			return nil, err
+		}
+		err = conn.Key().Find(q).One(&k)
+	}
+	if err == mgo.ErrNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// fillKeyAttributes computes and stores the fingerprints, type and size of
+// keys that don't have them.
+func fillKeyAttributes() error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var keys []Key
+	err = conn.Key().Find(bson.M{"md5fingerprint": bson.M{"$in": []interface{}{nil, ""}}}).All(&keys)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Body))
+		if err != nil {
+			continue
+		}
+		k.setAttributes(pubKey)
+		attributes := bson.M{
+			"type":           k.Type,
+			"bits":           k.Bits,
+			"fingerprint":    k.Fingerprint,
+			"md5fingerprint": k.MD5Fingerprint,
+		}
+		err = conn.Key().Update(bson.M{"name": k.Name, "username": k.UserName}, bson.M{"$set": attributes})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveExpiredKeys removes the expired keys from the database and from the
+// authorized_keys file, returning the removed keys.
+func RemoveExpiredKeys() ([]Key, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var keys []Key
+	q := bson.M{"expiresat": bson.M{"$gt": time.Time{}, "$lte": time.Now()}}
+	err = conn.Key().Find(q).All(&keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if err = conn.Key().Remove(bson.M{"name": k.Name, "username": k.UserName}); err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		if err = remove(&k); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// MarkKeyUsed records that the key was used to access gandalf from the given
+// address.
+func MarkKeyUsed(k *Key, from string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	update := bson.M{"$set": bson.M{"lastusedat": time.Now(), "lastusedfrom": from}}
+	err = conn.Key().Update(bson.M{"name": k.Name, "username": k.UserName}, update)
+	if err == mgo.ErrNotFound {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// ListUnusedKeys lists the keys that have not been used in the given
+// duration. Keys that were never used are listed when they were created
+// before that.
+func ListUnusedKeys(d time.Duration) (KeyList, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	limit := time.Now().Add(-d)
+	q := bson.M{"$or": []bson.M{
+		{"lastusedat": bson.M{"$lt": limit, "$gt": time.Time{}}},
+		{"lastusedat": bson.M{"$in": []interface{}{nil, time.Time{}}}, "createdat": bson.M{"$lt": limit}},
+	}}
+	var keys []Key
+	err = conn.Key().Find(q).Sort("username", "name").All(&keys)
+	return KeyList(keys), err
+}
+
 type KeyList []Key
 
 func (keys KeyList) MarshalJSON() ([]byte, error) {
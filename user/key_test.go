@@ -18,6 +18,7 @@ import (
 	"github.com/globalsign/mgo/bson"
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/check.v1"
 )
 
@@ -36,6 +37,9 @@ func (failWriter) Write(p []byte) (int, error) {
 const rawKey = "ssh-dss AAAAB3NzaC1kc3MAAACBAIHfSDLpSCfIIVEJ/Is3RFMQhsCi7WZtFQeeyfi+DzVP0NGX4j/rMoQEHgXgNlOKVCJvPk5e00tukSv6iVzJPFcozArvVaoCc5jCoDi5Ef8k3Jil4Q7qNjcoRDDyqjqLcaviJEz5GrtmqAyXEIzJ447BxeEdw3Z7UrIWYcw2YyArAAAAFQD7wiOGZIoxu4XIOoeEe5aToTxN1QAAAIAZNAbJyOnNceGcgRRgBUPfY5ChX+9A29n2MGnyJ/Cxrhuh8d7B0J8UkvEBlfgQICq1UDZbC9q5NQprwD47cGwTjUZ0Z6hGpRmEEZdzsoj9T6vkLiteKH3qLo7IPVx4mV6TTF6PWQbQMUsuxjuDErwS9nhtTM4nkxYSmUbnWb6wfwAAAIB2qm/1J6Jl8bByBaMQ/ptbm4wQCvJ9Ll9u6qtKy18D4ldoXM0E9a1q49swml5CPFGyU+cgPRhEjN5oUr5psdtaY8CHa2WKuyIVH3B8UhNzqkjpdTFSpHs6tGluNVC+SQg1MVwfG2wsZUdkUGyn+6j8ZZarUfpAmbb5qJJpgMFEKQ== f@xikinbook.local"
 const body = "ssh-dss AAAAB3NzaC1kc3MAAACBAIHfSDLpSCfIIVEJ/Is3RFMQhsCi7WZtFQeeyfi+DzVP0NGX4j/rMoQEHgXgNlOKVCJvPk5e00tukSv6iVzJPFcozArvVaoCc5jCoDi5Ef8k3Jil4Q7qNjcoRDDyqjqLcaviJEz5GrtmqAyXEIzJ447BxeEdw3Z7UrIWYcw2YyArAAAAFQD7wiOGZIoxu4XIOoeEe5aToTxN1QAAAIAZNAbJyOnNceGcgRRgBUPfY5ChX+9A29n2MGnyJ/Cxrhuh8d7B0J8UkvEBlfgQICq1UDZbC9q5NQprwD47cGwTjUZ0Z6hGpRmEEZdzsoj9T6vkLiteKH3qLo7IPVx4mV6TTF6PWQbQMUsuxjuDErwS9nhtTM4nkxYSmUbnWb6wfwAAAIB2qm/1J6Jl8bByBaMQ/ptbm4wQCvJ9Ll9u6qtKy18D4ldoXM0E9a1q49swml5CPFGyU+cgPRhEjN5oUr5psdtaY8CHa2WKuyIVH3B8UhNzqkjpdTFSpHs6tGluNVC+SQg1MVwfG2wsZUdkUGyn+6j8ZZarUfpAmbb5qJJpgMFEKQ==\n"
 const comment = "f@xikinbook.local"
+const keyFingerprint = "SHA256:qjW7csIRoKBgZZJutyAFaO0T775pyGAkv7UnUH6MwdM"
+const keyMD5Fingerprint = "MD5:07:b9:a1:65:1b:10:a5:56:e1:e1:d6:b2:ae:f1:a4:2d"
+const ecdsaKey = "ecdsa-sha2-nistp384 AAAAE2VjZHNhLXNoYTItbmlzdHAzODQAAAAIbmlzdHAzODQAAABhBI3+z8eeDHhCuoOSmnd+ezok0mT0bvC3phhuQj1Gi8XT+asnbDWfTAqoEkl3XlhKSiYYlWlWhHsYLnYRe+rLoabIdKfKAElieVdz0/GFeF4bnmRaGoH7AFmxA/IA23sCEw=="
 const otherKey = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCaNZSIEyP6FSdCX0WHDcUFTvebNbvqKiiLEiC7NTGvKrT15r2MtCDi4EPi4Ul+UyxWqb2D7FBnK1UmIcEFHd/ZCnBod2/FSplGOIbIb2UVVbqPX5Alv7IBCMyZJD14ex5cFh16zoqOsPOkOD803LMIlNvXPDDwKjY4TVOQV1JtA2tbZXvYUchqhTcKPxt5BDBZbeQkMMgUgHIEz6IueglFB3+dIZfrzlmM8CVSElKZOpucnJ5JOpGh3paSO/px2ZEcvY8WvjFdipvAWsis75GG/04F641I6XmYlo9fib/YytBXS23szqmvOqEqAopFnnGkDEo+LWI0+FXgPE8lc5BD"
 
 func (s *S) TestNewKey(c *check.C) {
@@ -45,6 +49,26 @@ func (s *S) TestNewKey(c *check.C) {
 	c.Assert(k.Body, check.Equals, body)
 	c.Assert(k.Comment, check.Equals, comment)
 	c.Assert(k.UserName, check.Equals, "me@tsuru.io")
+	c.Assert(k.Fingerprint, check.Equals, keyFingerprint)
+	c.Assert(k.MD5Fingerprint, check.Equals, keyMD5Fingerprint)
+	c.Assert(k.Type, check.Equals, "ssh-dss")
+	c.Assert(k.Bits, check.Equals, 1024)
+}
+
+func (s *S) TestNewKeyRSA(c *check.C) {
+	k, err := newKey("key1", "me@tsuru.io", otherKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Type, check.Equals, "ssh-rsa")
+	c.Assert(k.Bits, check.Equals, 2048)
+	c.Assert(k.Fingerprint, check.Equals, "SHA256:I2umWKJ9VicDB9y07tGdYX7M67/xsACLS8eUILZ7Ovw")
+}
+
+func (s *S) TestNewKeyECDSA(c *check.C) {
+	k, err := newKey("key1", "me@tsuru.io", ecdsaKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Type, check.Equals, "ecdsa-sha2-nistp384")
+	c.Assert(k.Bits, check.Equals, 384)
+	c.Assert(k.Fingerprint, check.Equals, "SHA256:V6e+C+kwgU05f3wBpPMbjD6NXXgJtEGOTHa8P14ZKJc")
 }
 
 func (s *S) TestNewKeyInvalidKey(c *check.C) {
@@ -137,6 +161,31 @@ func (s *S) TestFormatKeyShouldAppendUserNameAsCommandParameter(c *check.C) {
 	c.Assert(got, check.Equals, expected)
 }
 
+func (s *S) TestFormatKeyShouldAppendFingerprintAsCommandParameter(c *check.C) {
+	p, err := config.GetString("bin-path")
+	c.Assert(err, check.IsNil)
+	key := Key{
+		Name:        "my-key",
+		Body:        "somekey\n",
+		Comment:     "me@host",
+		UserName:    "someuser",
+		Fingerprint: keyFingerprint,
+	}
+	got := key.format()
+	expected := fmt.Sprintf(`no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty,command="%s someuser %s" %s`+"\n", p, keyFingerprint, &key)
+	c.Assert(got, check.Equals, expected)
+}
+
+func (s *S) TestAuthorizedKey(c *check.C) {
+	key := Key{
+		Name:     "my-key",
+		Body:     "somekey\n",
+		Comment:  "me@host",
+		UserName: "someuser",
+	}
+	c.Assert(key.AuthorizedKey(), check.Equals, key.format())
+}
+
 func (s *S) TestDump(c *check.C) {
 	var buf bytes.Buffer
 	key := Key{
@@ -225,6 +274,51 @@ func (s *S) TestWriteTwoKeys(c *check.C) {
 	c.Assert(got, check.Equals, expected)
 }
 
+func (s *S) TestWriteKeyAuthorizedKeysDisabled(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	key, err := newKey("my-key", "me@tsuru.io", rawKey)
+	c.Assert(err, check.IsNil)
+	err = writeKey(key)
+	c.Assert(err, check.IsNil)
+	_, err = s.rfs.Open(authKey())
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestRemoveLegacyFormat(c *check.C) {
+	key, err := newKey("my-key", "me@tsuru.io", rawKey)
+	c.Assert(err, check.IsNil)
+	legacy := *key
+	legacy.Fingerprint = ""
+	err = writeKey(&legacy)
+	c.Assert(err, check.IsNil)
+	err = remove(key)
+	c.Assert(err, check.IsNil)
+	f, err := s.rfs.Open(authKey())
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(b), check.Equals, "")
+}
+
+func (s *S) TestRemoveAuthorizedKeysDisabled(c *check.C) {
+	key, err := newKey("my-key", "me@tsuru.io", rawKey)
+	c.Assert(err, check.IsNil)
+	err = writeKey(key)
+	c.Assert(err, check.IsNil)
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	err = remove(key)
+	c.Assert(err, check.IsNil)
+	f, err := s.rfs.Open(authKey())
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(b), check.Equals, key.format())
+}
+
 func (s *S) TestAddKeyStoresKeyInTheDatabase(c *check.C) {
 	err := addKey("key1", rawKey, "gopher")
 	c.Assert(err, check.IsNil)
@@ -296,6 +390,39 @@ func (s *S) TestUpdateKey(c *check.C) {
 	c.Assert(string(b), check.Equals, k.format())
 }
 
+func (s *S) TestUpdateKeyKeepsExpirationAndLastUse(c *check.C) {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	lastUsed := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	k, err := newKey("key1", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	k.ExpiresAt = expiresAt
+	err = insertKey(k)
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().Remove(bson.M{"name": "key1"})
+	err = conn.Key().Update(bson.M{"name": "key1"}, bson.M{"$set": bson.M{"lastusedat": lastUsed, "lastusedfrom": "10.0.0.1"}})
+	c.Assert(err, check.IsNil)
+	err = updateKey("key1", otherKey, "gopher")
+	c.Assert(err, check.IsNil)
+	err = conn.Key().Find(bson.M{"name": "key1"}).One(k)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Body, check.Equals, otherKey+"\n")
+	c.Assert(k.ExpiresAt.Equal(expiresAt), check.Equals, true)
+	c.Assert(k.LastUsedAt.Equal(lastUsed), check.Equals, true)
+	c.Assert(k.LastUsedFrom, check.Equals, "10.0.0.1")
+	newExpiresAt := expiresAt.Add(time.Hour)
+	newK, err := newKey("key1", "gopher", rawKey)
+	c.Assert(err, check.IsNil)
+	newK.ExpiresAt = newExpiresAt
+	err = replaceKey(newK)
+	c.Assert(err, check.IsNil)
+	err = conn.Key().Find(bson.M{"name": "key1"}).One(k)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.ExpiresAt.Equal(newExpiresAt), check.Equals, true)
+}
+
 func (s *S) TestUpdateKeyNotFound(c *check.C) {
 	err := updateKey("key1", otherKey, "gopher")
 	c.Assert(err, check.Equals, ErrKeyNotFound)
@@ -318,6 +445,39 @@ func (s *S) TestRemoveKeyDeletesFromDB(c *check.C) {
 	c.Assert(count, check.Equals, 0)
 }
 
+func (s *S) TestRemoveKeyStoredWithoutNewFields(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Key().Insert(bson.M{"name": "key1", "body": rawKey, "comment": "", "username": "gopher", "createdat": time.Now()})
+	c.Assert(err, check.IsNil)
+	defer conn.Key().Remove(bson.M{"name": "key1"})
+	err = removeKey("key1", "gopher")
+	c.Assert(err, check.IsNil)
+	count, err := conn.Key().Find(bson.M{"name": "key1"}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 0)
+}
+
+func (s *S) TestRemoveKeyAfterUse(c *check.C) {
+	err := addKey("key1", rawKey, "gopher")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().Remove(bson.M{"name": "key1"})
+	var k Key
+	err = conn.Key().Find(bson.M{"name": "key1"}).One(&k)
+	c.Assert(err, check.IsNil)
+	err = MarkKeyUsed(&k, "10.0.0.1")
+	c.Assert(err, check.IsNil)
+	err = removeKey("key1", "gopher")
+	c.Assert(err, check.IsNil)
+	count, err := conn.Key().Find(bson.M{"name": "key1"}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 0)
+}
+
 func (s *S) TestRemoveKeyDeletesOnlyTheRightKey(c *check.C) {
 	err := addKey("key1", rawKey, "gopher")
 	c.Assert(err, check.IsNil)
@@ -435,6 +595,43 @@ func (s *S) TestKeyListJSON(c *check.C) {
 	c.Assert(got, check.DeepEquals, expected)
 }
 
+func (s *S) TestKeyJSON(c *check.C) {
+	createdAt := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	k := Key{
+		Name:           "key1",
+		Body:           "ssh-rsa not-secret",
+		Comment:        "me@host1",
+		UserName:       "gandalf",
+		Type:           "ssh-rsa",
+		Bits:           2048,
+		Fingerprint:    "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8",
+		MD5Fingerprint: "MD5:07:b9:a1:65:1b:10:a5:56:e1:e1:d6:b2:ae:f1:a4:2d",
+		CreatedAt:      createdAt,
+	}
+	b, err := json.Marshal(k)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(b), check.Equals, `{"name":"key1","body":"ssh-rsa not-secret","comment":"me@host1",`+
+		`"userName":"gandalf","type":"ssh-rsa","bits":2048,`+
+		`"fingerprint":"SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8",`+
+		`"md5Fingerprint":"MD5:07:b9:a1:65:1b:10:a5:56:e1:e1:d6:b2:ae:f1:a4:2d",`+
+		`"createdAt":"2016-01-02T15:04:05Z"}`)
+	k.ExpiresAt = createdAt.Add(time.Hour)
+	k.LastUsedAt = createdAt.Add(time.Minute)
+	k.LastUsedFrom = "192.168.50.1"
+	b, err = json.Marshal(&k)
+	c.Assert(err, check.IsNil)
+	var got map[string]interface{}
+	err = json.Unmarshal(b, &got)
+	c.Assert(err, check.IsNil)
+	c.Assert(got["expiresAt"], check.Equals, "2016-01-02T16:04:05Z")
+	c.Assert(got["lastUsedAt"], check.Equals, "2016-01-02T15:05:05Z")
+	c.Assert(got["lastUsedFrom"], check.Equals, "192.168.50.1")
+	var decoded Key
+	err = json.Unmarshal(b, &decoded)
+	c.Assert(err, check.IsNil)
+	c.Assert(decoded, check.DeepEquals, k)
+}
+
 func (s *S) TestListKeys(c *check.C) {
 	user := map[string]string{"_id": "glenda"}
 	conn, err := db.Conn()
@@ -497,3 +694,159 @@ func (s *S) TestListKeysFromTheUserOnly(c *check.C) {
 	c.Assert(err, check.IsNil)
 	c.Assert(got, check.DeepEquals, KeyList(expected))
 }
+
+func (s *S) TestLookupKey(c *check.C) {
+	err := addKey("key1", rawKey, "gopher")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().Remove(bson.M{"name": "key1"})
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rawKey))
+	c.Assert(err, check.IsNil)
+	k, err := LookupKey(pubKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Name, check.Equals, "key1")
+	c.Assert(k.UserName, check.Equals, "gopher")
+	c.Assert(k.Fingerprint, check.Equals, keyFingerprint)
+}
+
+func (s *S) TestLookupKeyNotFound(c *check.C) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(otherKey))
+	c.Assert(err, check.IsNil)
+	k, err := LookupKey(pubKey)
+	c.Assert(err, check.Equals, ErrKeyNotFound)
+	c.Assert(k, check.IsNil)
+}
+
+func (s *S) TestGetKeyByFingerprint(c *check.C) {
+	err := addKey("key1", rawKey, "gopher")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().Remove(bson.M{"name": "key1"})
+	k, err := GetKeyByFingerprint(keyFingerprint)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Name, check.Equals, "key1")
+	c.Assert(k.UserName, check.Equals, "gopher")
+}
+
+func (s *S) TestGetKeyByFingerprintKeyWithoutFingerprint(c *check.C) {
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	err = conn.Key().Insert(Key{Name: "key1", Body: body, UserName: "gopher"})
+	c.Assert(err, check.IsNil)
+	defer conn.Key().Remove(bson.M{"name": "key1"})
+	k, err := GetKeyByFingerprint(keyFingerprint)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Name, check.Equals, "key1")
+	c.Assert(k.Fingerprint, check.Equals, keyFingerprint)
+	c.Assert(k.MD5Fingerprint, check.Equals, keyMD5Fingerprint)
+	c.Assert(k.Type, check.Equals, "ssh-dss")
+	c.Assert(k.Bits, check.Equals, 1024)
+}
+
+func (s *S) TestGetKeyByMD5Fingerprint(c *check.C) {
+	err := addKey("key1", rawKey, "gopher")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().Remove(bson.M{"name": "key1"})
+	k, err := GetKeyByFingerprint(keyMD5Fingerprint)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Name, check.Equals, "key1")
+	k, err = GetKeyByFingerprint("07:b9:a1:65:1b:10:a5:56:e1:e1:d6:b2:ae:f1:a4:2d")
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Name, check.Equals, "key1")
+}
+
+func (s *S) TestGetKeyByFingerprintNotFound(c *check.C) {
+	k, err := GetKeyByFingerprint(keyFingerprint)
+	c.Assert(err, check.Equals, ErrKeyNotFound)
+	c.Assert(k, check.IsNil)
+}
+
+func (s *S) TestMarkKeyUsed(c *check.C) {
+	err := addKey("key1", rawKey, "gopher")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().Remove(bson.M{"name": "key1"})
+	err = MarkKeyUsed(&Key{Name: "key1", UserName: "gopher"}, "10.0.0.1")
+	c.Assert(err, check.IsNil)
+	var k Key
+	err = conn.Key().Find(bson.M{"name": "key1"}).One(&k)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.LastUsedFrom, check.Equals, "10.0.0.1")
+	c.Assert(time.Since(k.LastUsedAt) < time.Minute, check.Equals, true)
+}
+
+func (s *S) TestMarkKeyUsedNotFound(c *check.C) {
+	err := MarkKeyUsed(&Key{Name: "key1", UserName: "gopher"}, "10.0.0.1")
+	c.Assert(err, check.Equals, ErrKeyNotFound)
+}
+
+func (s *S) TestListUnusedKeys(c *check.C) {
+	old := time.Now().Add(-48 * time.Hour)
+	keys := []Key{
+		{Name: "unused", Body: "ssh-rsa unused", UserName: "gopher", CreatedAt: old, LastUsedAt: old},
+		{Name: "used", Body: "ssh-rsa used", UserName: "gopher", CreatedAt: old, LastUsedAt: time.Now()},
+		{Name: "never-used", Body: "ssh-rsa never-used", UserName: "gopher", CreatedAt: old},
+		{Name: "new", Body: "ssh-rsa new", UserName: "gopher", CreatedAt: time.Now()},
+	}
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, k := range keys {
+		err = conn.Key().Insert(k)
+		c.Assert(err, check.IsNil)
+	}
+	defer conn.Key().RemoveAll(bson.M{"username": "gopher"})
+	unused, err := ListUnusedKeys(24 * time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(unused, check.HasLen, 2)
+	c.Assert(unused[0].Name, check.Equals, "never-used")
+	c.Assert(unused[1].Name, check.Equals, "unused")
+}
+
+func (s *S) TestKeyExpired(c *check.C) {
+	k := Key{Name: "key1"}
+	c.Assert(k.Expired(), check.Equals, false)
+	k.ExpiresAt = time.Now().Add(time.Hour)
+	c.Assert(k.Expired(), check.Equals, false)
+	k.ExpiresAt = time.Now().Add(-time.Hour)
+	c.Assert(k.Expired(), check.Equals, true)
+}
+
+func (s *S) TestRemoveExpiredKeys(c *check.C) {
+	err := addKeys(map[string]string{"expired": rawKey}, "gopher", time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	err = addKeys(map[string]string{"valid": otherKey}, "gopher", time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().RemoveAll(bson.M{"username": "gopher"})
+	var valid Key
+	err = conn.Key().Find(bson.M{"name": "valid"}).One(&valid)
+	c.Assert(err, check.IsNil)
+	err = conn.Key().Update(bson.M{"name": "expired"}, bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Minute)}})
+	c.Assert(err, check.IsNil)
+	removed, err := RemoveExpiredKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(removed, check.HasLen, 1)
+	c.Assert(removed[0].Name, check.Equals, "expired")
+	n, err := conn.Key().Find(bson.M{"username": "gopher"}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 1)
+	f, err := s.rfs.Open(authKey())
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(b), check.Equals, valid.format())
+}
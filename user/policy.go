@@ -0,0 +1,86 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"fmt"
+
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"golang.org/x/crypto/ssh"
+)
+
+// InvalidKeyError is returned when a key does not comply with the key policy,
+// defined in the keys:policy settings.
+type InvalidKeyError struct {
+	message string
+}
+
+func (err *InvalidKeyError) Error() string {
+	return err.message
+}
+
+// checkKeyPolicy checks the public key and the options embedded in it
+// against the key policy.
+func checkKeyPolicy(pubKey ssh.PublicKey, options []string) error {
+	if algorithms, _ := config.GetList("keys:policy:algorithms"); len(algorithms) > 0 {
+		var allowed bool
+		for _, algorithm := range algorithms {
+			if algorithm == pubKey.Type() {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &InvalidKeyError{message: fmt.Sprintf("Keys of type %s are not allowed.", pubKey.Type())}
+		}
+	}
+	if pubKey.Type() == ssh.KeyAlgoRSA {
+		if minBits, _ := config.GetInt("keys:policy:min-rsa-bits"); keyBits(pubKey) < minBits {
+			return &InvalidKeyError{message: fmt.Sprintf("RSA keys must have at least %d bits.", minBits)}
+		}
+	}
+	if len(options) > 0 {
+		if reject, _ := config.GetBool("keys:policy:reject-options"); reject {
+			return &InvalidKeyError{message: "Keys with options are not allowed."}
+		}
+	}
+	return nil
+}
+
+// KeyPolicyViolation describes a stored key that does not comply with the
+// key policy.
+type KeyPolicyViolation struct {
+	Key    Key
+	Reason string
+}
+
+// ListKeyPolicyViolations lists the stored keys that do not comply with the
+// current key policy. Keys are stored without their options, so only the
+// algorithm and size of the keys are checked.
+func ListKeyPolicyViolations() ([]KeyPolicyViolation, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var keys []Key
+	err = conn.Key().Find(nil).Sort("username", "name").All(&keys)
+	if err != nil {
+		return nil, err
+	}
+	violations := []KeyPolicyViolation{}
+	for _, k := range keys {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Body))
+		if err != nil {
+			violations = append(violations, KeyPolicyViolation{Key: k, Reason: ErrInvalidKey.Error()})
+			continue
+		}
+		if err = checkKeyPolicy(pubKey, nil); err != nil {
+			violations = append(violations, KeyPolicyViolation{Key: k, Reason: err.Error()})
+		}
+	}
+	return violations, nil
+}
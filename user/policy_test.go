@@ -0,0 +1,88 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestNewKeyWithoutPolicy(c *check.C) {
+	_, err := newKey("key1", "me@tsuru.io", "no-pty "+rawKey)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestNewKeyAlgorithmNotAllowed(c *check.C) {
+	config.Set("keys:policy:algorithms", []interface{}{"ssh-rsa", "ecdsa-sha2-nistp384"})
+	defer config.Unset("keys:policy:algorithms")
+	k, err := newKey("key1", "me@tsuru.io", rawKey)
+	c.Assert(k, check.IsNil)
+	c.Assert(err, check.FitsTypeOf, &InvalidKeyError{})
+	c.Assert(err, check.ErrorMatches, "^Keys of type ssh-dss are not allowed.$")
+	_, err = newKey("key1", "me@tsuru.io", ecdsaKey)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestNewKeyRSATooSmall(c *check.C) {
+	config.Set("keys:policy:min-rsa-bits", 4096)
+	defer config.Unset("keys:policy:min-rsa-bits")
+	k, err := newKey("key1", "me@tsuru.io", otherKey)
+	c.Assert(k, check.IsNil)
+	c.Assert(err, check.FitsTypeOf, &InvalidKeyError{})
+	c.Assert(err, check.ErrorMatches, "^RSA keys must have at least 4096 bits.$")
+	config.Set("keys:policy:min-rsa-bits", 2048)
+	_, err = newKey("key1", "me@tsuru.io", otherKey)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestNewKeyMinRSABitsIgnoresOtherAlgorithms(c *check.C) {
+	config.Set("keys:policy:min-rsa-bits", 4096)
+	defer config.Unset("keys:policy:min-rsa-bits")
+	_, err := newKey("key1", "me@tsuru.io", ecdsaKey)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestNewKeyRejectOptions(c *check.C) {
+	config.Set("keys:policy:reject-options", true)
+	defer config.Unset("keys:policy:reject-options")
+	k, err := newKey("key1", "me@tsuru.io", `command="/bin/ls",no-pty `+rawKey)
+	c.Assert(k, check.IsNil)
+	c.Assert(err, check.FitsTypeOf, &InvalidKeyError{})
+	c.Assert(err, check.ErrorMatches, "^Keys with options are not allowed.$")
+	_, err = newKey("key1", "me@tsuru.io", rawKey)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestListKeyPolicyViolations(c *check.C) {
+	err := addKey("dsa", rawKey, "gopher")
+	c.Assert(err, check.IsNil)
+	err = addKey("rsa", otherKey, "gopher")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().RemoveAll(bson.M{"username": "gopher"})
+	config.Set("keys:policy:algorithms", []interface{}{"ssh-rsa"})
+	defer config.Unset("keys:policy:algorithms")
+	violations, err := ListKeyPolicyViolations()
+	c.Assert(err, check.IsNil)
+	c.Assert(violations, check.HasLen, 1)
+	c.Assert(violations[0].Key.Name, check.Equals, "dsa")
+	c.Assert(violations[0].Reason, check.Equals, "Keys of type ssh-dss are not allowed.")
+}
+
+func (s *S) TestListKeyPolicyViolationsWithoutViolations(c *check.C) {
+	err := addKey("rsa", otherKey, "gopher")
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer conn.Key().RemoveAll(bson.M{"username": "gopher"})
+	violations, err := ListKeyPolicyViolations()
+	c.Assert(err, check.IsNil)
+	c.Assert(violations, check.HasLen, 0)
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"errors"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/tsuru/log"
+)
+
+var (
+	ErrUserSuspended    = errors.New("user is suspended")
+	ErrUserNotSuspended = errors.New("user is not suspended")
+)
+
+// IsSuspended returns whether the user is suspended.
+func IsSuspended(name string) (bool, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	n, err := conn.User().Find(bson.M{"_id": name, "suspended": true}).Count()
+	return n > 0, err
+}
+
+// setSuspended flags the user as suspended or not, returning the user. It
+// fails when the user already is in the requested state.
+func setSuspended(name string, suspended bool) (*User, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	q := bson.M{"_id": name, "suspended": bson.M{"$ne": true}}
+	update := bson.M{"$set": bson.M{"suspended": true}}
+	if !suspended {
+		q = bson.M{"_id": name, "suspended": true}
+		update = bson.M{"$unset": bson.M{"suspended": ""}}
+	}
+	var u User
+	_, err = conn.User().Find(q).Apply(mgo.Change{Update: update, ReturnNew: true}, &u)
+	if err == mgo.ErrNotFound {
+		if n, _ := conn.User().FindId(name).Count(); n == 0 {
+			return nil, ErrUserNotFound
+		}
+		if suspended {
+			return nil, ErrUserSuspended
+		}
+		return nil, ErrUserNotSuspended
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Suspend blocks the access of the user, without removing anything: the
+// keys of the user are removed from the authorized_keys file, and git
+// commands are denied, but keys, principals and grants are kept, so
+// Unsuspend restores the access exactly as it was.
+func Suspend(name string) error {
+	log.Debugf("Suspending user %q", name)
+	u, err := setSuspended(name, true)
+	if err != nil {
+		return err
+	}
+	keys, err := ListKeys(u.Name)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = remove(&k); err != nil {
+			return err
+		}
+	}
+	return removePrincipals(u.Principals)
+}
+
+// Unsuspend restores the access of a suspended user.
+func Unsuspend(name string) error {
+	log.Debugf("Unsuspending user %q", name)
+	u, err := setSuspended(name, false)
+	if err != nil {
+		return err
+	}
+	keys, err := ListKeys(u.Name)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = writeKey(&k); err != nil {
+			return err
+		}
+	}
+	if len(u.Principals) == 0 {
+		return nil
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var authorities []Authority
+	if err = conn.Authority().Find(nil).All(&authorities); err != nil {
+		return err
+	}
+	return writeAuthorities(authorities, u.Principals)
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestSuspend(c *check.C) {
+	u, err := New("gandalf", map[string]string{"somekey": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	c.Assert(s.authKeysContent(c), check.Not(check.Equals), "")
+	err = Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	suspended, err := IsSuspended(u.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(suspended, check.Equals, true)
+	c.Assert(s.authKeysContent(c), check.Equals, "")
+	keys, err := ListKeys(u.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.HasLen, 1)
+}
+
+func (s *S) TestSuspendRemovesPrincipals(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	defer RemoveAuthority("shire")
+	err = AddPrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	err = Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.authorizedKeys(c), check.Equals, "")
+	authorities, err := AuthorizedAuthorities()
+	c.Assert(err, check.IsNil)
+	c.Assert(authorities, check.Equals, "")
+	found, err := GetUserByPrincipal("bilbo@shire")
+	c.Assert(err, check.IsNil)
+	c.Assert(found.Suspended, check.Equals, true)
+}
+
+func (s *S) TestSuspendUserNotFound(c *check.C) {
+	err := Suspend("nobody")
+	c.Assert(err, check.Equals, ErrUserNotFound)
+}
+
+func (s *S) TestSuspendAlreadySuspended(c *check.C) {
+	u, err := New("gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	err = Suspend(u.Name)
+	c.Assert(err, check.Equals, ErrUserSuspended)
+}
+
+func (s *S) TestAddKeyToSuspendedUser(c *check.C) {
+	u, err := New("gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	err = AddKey(u.Name, map[string]string{"somekey": rawKey})
+	c.Assert(err, check.IsNil)
+	c.Assert(s.authKeysContent(c), check.Equals, "")
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	n, err := conn.Key().Find(bson.M{"username": u.Name}).Count()
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 1)
+}
+
+func (s *S) TestUnsuspend(c *check.C) {
+	u, err := New("gandalf", map[string]string{"somekey": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	before := s.authKeysContent(c)
+	err = Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	err = Unsuspend(u.Name)
+	c.Assert(err, check.IsNil)
+	suspended, err := IsSuspended(u.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(suspended, check.Equals, false)
+	c.Assert(s.authKeysContent(c), check.Equals, before)
+}
+
+func (s *S) TestUnsuspendRestoresPrincipals(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = AddAuthority("shire", rawKey)
+	c.Assert(err, check.IsNil)
+	defer RemoveAuthority("shire")
+	err = AddPrincipal(u.Name, "bilbo@shire")
+	c.Assert(err, check.IsNil)
+	err = Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	err = Unsuspend(u.Name)
+	c.Assert(err, check.IsNil)
+	authorities, err := ListAuthorities()
+	c.Assert(err, check.IsNil)
+	c.Assert(s.authorizedKeys(c), check.Equals, authorities[0].format("bilbo@shire"))
+}
+
+func (s *S) TestUnsuspendNotSuspended(c *check.C) {
+	u, err := New("gandalf", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	err = Unsuspend(u.Name)
+	c.Assert(err, check.Equals, ErrUserNotSuspended)
+}
+
+func (s *S) TestUnsuspendUserNotFound(c *check.C) {
+	err := Unsuspend("nobody")
+	c.Assert(err, check.Equals, ErrUserNotFound)
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/config"
+	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/fs"
+)
+
+var ErrAuthorizedKeysDisabled = errors.New("The authorized_keys file is not managed by gandalf")
+
+// SyncReport describes the differences between the authorized_keys file and
+// the keys and authorities stored in the database. Missing lists the lines
+// that should be in the file but aren't, and Orphaned lists the lines written
+// by gandalf that don't match any stored key or authority.
+type SyncReport struct {
+	Missing  []string
+	Orphaned []string
+}
+
+// InSync returns whether the authorized_keys file matches the database.
+func (r *SyncReport) InSync() bool {
+	return len(r.Missing) == 0 && len(r.Orphaned) == 0
+}
+
+// managedLine returns whether the authorized_keys line was written by
+// gandalf, which always forces the command to bin-path.
+func managedLine(line string) bool {
+	binPath, err := config.GetString("bin-path")
+	if err != nil {
+		panic(err)
+	}
+	return strings.Contains(line, `command="`+binPath+" ")
+}
+
+// expectedAuthorizedKeys returns the lines gandalf should keep in the
+// authorized_keys file.
+func expectedAuthorizedKeys() ([]string, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var suspended []User
+	if err = conn.User().Find(bson.M{"suspended": true}).Select(bson.M{"_id": 1}).All(&suspended); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(suspended))
+	for i, u := range suspended {
+		names[i] = u.Name
+	}
+	var keys []Key
+	if err = conn.Key().Find(bson.M{"username": bson.M{"$nin": names}}).Sort("username", "name").All(&keys); err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		lines = append(lines, k.format())
+	}
+	authorities, err := authorityLines()
+	if err != nil {
+		return nil, err
+	}
+	return append(lines, authorities...), nil
+}
+
+// readAuthorizedKeys returns the lines of the authorized_keys file, all of
+// them ending in a new line.
+func readAuthorizedKeys() ([]string, error) {
+	file, err := fs.Filesystem().Open(authKey())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var lines []string
+	reader := bufio.NewReader(file)
+	line, _ := reader.ReadString('\n')
+	for line != "" {
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		lines = append(lines, line)
+		line, _ = reader.ReadString('\n')
+	}
+	return lines, nil
+}
+
+// SyncAuthorizedKeys compares the authorized_keys file with the keys and
+// authorities stored in the database, and rebuilds the lines written by
+// gandalf when they differ. Lines not written by gandalf are kept untouched.
+// When dryRun is true, the differences are reported but the file is not
+// changed.
+func SyncAuthorizedKeys(dryRun bool) (*SyncReport, error) {
+	if !manageAuthorizedKeys() {
+		return nil, ErrAuthorizedKeysDisabled
+	}
+	expected, err := expectedAuthorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+	current, err := readAuthorizedKeys()
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(expected))
+	for _, line := range expected {
+		wanted[line] = true
+	}
+	var report SyncReport
+	var foreign []string
+	present := make(map[string]bool, len(current))
+	for _, line := range current {
+		if !managedLine(line) {
+			foreign = append(foreign, line)
+		} else if wanted[line] && !present[line] {
+			present[line] = true
+		} else {
+			report.Orphaned = append(report.Orphaned, line)
+		}
+	}
+	for _, line := range expected {
+		if !present[line] {
+			report.Missing = append(report.Missing, line)
+		}
+	}
+	if dryRun || report.InSync() {
+		return &report, nil
+	}
+	file, err := fs.Filesystem().OpenFile(authKey()+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	content := strings.Join(append(foreign, expected...), "")
+	n, err := file.WriteString(content)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(content) {
+		return nil, io.ErrShortWrite
+	}
+	return &report, moveFile(file.Name())
+}
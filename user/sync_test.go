@@ -0,0 +1,76 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"os"
+
+	"github.com/tsuru/config"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) writeAuthorizedKeys(c *check.C, content string) {
+	f, err := s.rfs.OpenFile(authKey(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestManagedLine(c *check.C) {
+	key := Key{Name: "my-key", Body: "ssh-rsa somekey\n", UserName: "bilbo"}
+	authority := Authority{Name: "shire", Body: "ssh-rsa somekey\n"}
+	c.Assert(managedLine(key.format()), check.Equals, true)
+	c.Assert(managedLine(authority.format("bilbo@shire")), check.Equals, true)
+	c.Assert(managedLine("ssh-rsa somekey me@host\n"), check.Equals, false)
+	c.Assert(managedLine(`command="/bin/backup" ssh-rsa somekey me@host`+"\n"), check.Equals, false)
+}
+
+func (s *S) TestSyncAuthorizedKeys(c *check.C) {
+	u, err := New("bilbo", map[string]string{"mykey": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	keys, err := ListKeys(u.Name)
+	c.Assert(err, check.IsNil)
+	orphan := Key{Name: "old", Body: "ssh-rsa oldkey\n", UserName: "frodo"}
+	foreign := "ssh-rsa somekey admin@host\n"
+	s.writeAuthorizedKeys(c, foreign+orphan.format())
+	report, err := SyncAuthorizedKeys(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.Missing, check.DeepEquals, []string{keys[0].format()})
+	c.Assert(report.Orphaned, check.DeepEquals, []string{orphan.format()})
+	c.Assert(s.authorizedKeys(c), check.Equals, foreign+keys[0].format())
+}
+
+func (s *S) TestSyncAuthorizedKeysDryRun(c *check.C) {
+	u, err := New("bilbo", map[string]string{"mykey": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	keys, err := ListKeys(u.Name)
+	c.Assert(err, check.IsNil)
+	s.writeAuthorizedKeys(c, "")
+	report, err := SyncAuthorizedKeys(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.Missing, check.DeepEquals, []string{keys[0].format()})
+	c.Assert(report.Orphaned, check.HasLen, 0)
+	c.Assert(s.authorizedKeys(c), check.Equals, "")
+}
+
+func (s *S) TestSyncAuthorizedKeysInSync(c *check.C) {
+	u, err := New("bilbo", map[string]string{"mykey": rawKey})
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	report, err := SyncAuthorizedKeys(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(report.InSync(), check.Equals, true)
+}
+
+func (s *S) TestSyncAuthorizedKeysDisabled(c *check.C) {
+	config.Set("authorized-keys-disabled", true)
+	defer config.Unset("authorized-keys-disabled")
+	report, err := SyncAuthorizedKeys(false)
+	c.Assert(err, check.Equals, ErrAuthorizedKeysDisabled)
+	c.Assert(report, check.IsNil)
+}
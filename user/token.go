@@ -0,0 +1,200 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+)
+
+// TokenPrefix is the prefix of personal access tokens, which tells them apart
+// from other credentials.
+const TokenPrefix = "gandalf_"
+
+var (
+	ErrDuplicateToken = errors.New("Duplicate token")
+	ErrTokenNotFound  = errors.New("Token not found")
+	ErrInvalidToken   = errors.New("Invalid token")
+)
+
+type InvalidTokenError struct {
+	message string
+}
+
+func (err *InvalidTokenError) Error() string {
+	return err.message
+}
+
+// TokenScope limits what a personal access token may do on behalf of its
+// user.
+type TokenScope string
+
+const (
+	// TokenScopeRead allows fetching repositories and reading their
+	// contents.
+	TokenScopeRead = TokenScope("read")
+	// TokenScopeWrite allows pushing to repositories too.
+	TokenScopeWrite = TokenScope("write")
+)
+
+// Token is a personal access token, that authenticates requests on behalf of
+// its user. Only the hash of the token is stored, the token itself is shown
+// once, when it's created.
+type Token struct {
+	ID         string     `bson:"_id" json:"id"`
+	Name       string     `json:"name"`
+	UserName   string     `json:"user"`
+	Hash       string     `json:"-"`
+	Scope      TokenScope `json:"scope"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+}
+
+// Expired returns whether the token has expired. Tokens without an expiration
+// time never expire.
+func (t *Token) Expired() bool {
+	return !t.ExpiresAt.IsZero() && !time.Now().Before(t.ExpiresAt)
+}
+
+// CanWrite returns whether the token allows pushing to repositories.
+func (t *Token) CanWrite() bool {
+	return t.Scope == TokenScopeWrite
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken issues a personal access token to the user, with the given name,
+// scope and expiration time (the zero time for tokens that don't expire). It
+// returns the stored token and the secret token, which is not stored.
+func NewToken(uName, name string, scope TokenScope, expiresAt time.Time) (*Token, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, "", &InvalidTokenError{message: "the name of the token is required"}
+	}
+	if scope == "" {
+		scope = TokenScopeRead
+	}
+	if scope != TokenScopeRead && scope != TokenScopeWrite {
+		return nil, "", &InvalidTokenError{message: fmt.Sprintf("invalid scope %q, it must be read or write", scope)}
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		return nil, "", &InvalidTokenError{message: "the expiration time of the token must be in the future"}
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	if n, err := conn.User().FindId(uName).Count(); err != nil || n != 1 {
+		return nil, "", ErrUserNotFound
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	plain := TokenPrefix + hex.EncodeToString(secret)
+	t := Token{
+		ID:        bson.NewObjectId().Hex(),
+		Name:      name,
+		UserName:  uName,
+		Hash:      hashToken(plain),
+		Scope:     scope,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	if err = conn.Token().Insert(&t); err != nil {
+		if mgo.IsDup(err) {
+			return nil, "", ErrDuplicateToken
+		}
+		return nil, "", err
+	}
+	return &t, plain, nil
+}
+
+// ListTokens lists the personal access tokens of the user.
+func ListTokens(uName string) ([]Token, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if n, err := conn.User().FindId(uName).Count(); err != nil || n != 1 {
+		return nil, ErrUserNotFound
+	}
+	tokens := []Token{}
+	err = conn.Token().Find(bson.M{"username": uName}).Sort("name").All(&tokens)
+	return tokens, err
+}
+
+// RevokeToken removes a personal access token of the user.
+func RevokeToken(uName, id string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Token().Remove(bson.M{"_id": id, "username": uName})
+	if err == mgo.ErrNotFound {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+func removeUserTokens(uName string) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Token().RemoveAll(bson.M{"username": uName})
+	return err
+}
+
+// AuthenticateToken returns the personal access token matching the secret
+// token, recording that it was used. It returns ErrInvalidToken when the
+// token doesn't exist or has expired, and ErrUserSuspended when its user is
+// suspended.
+func AuthenticateToken(plain string) (*Token, error) {
+	if !strings.HasPrefix(plain, TokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var t Token
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"lastusedat": time.Now()}}, ReturnNew: true}
+	_, err = conn.Token().Find(bson.M{"hash": hashToken(plain)}).Apply(change, &t)
+	if err == mgo.ErrNotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.Expired() {
+		return nil, ErrInvalidToken
+	}
+	suspended, err := IsSuspended(t.UserName)
+	if err != nil {
+		return nil, err
+	}
+	if suspended {
+		return nil, ErrUserSuspended
+	}
+	return &t, nil
+}
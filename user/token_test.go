@@ -0,0 +1,151 @@
+// Copyright 2015 gandalf authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package user
+
+import (
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/tsuru/gandalf/db"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestTokenExpired(c *check.C) {
+	t := Token{}
+	c.Assert(t.Expired(), check.Equals, false)
+	t.ExpiresAt = time.Now().Add(time.Hour)
+	c.Assert(t.Expired(), check.Equals, false)
+	t.ExpiresAt = time.Now().Add(-time.Hour)
+	c.Assert(t.Expired(), check.Equals, true)
+}
+
+func (s *S) TestNewToken(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	expiresAt := time.Now().Add(time.Hour)
+	t, plain, err := NewToken(u.Name, "laptop", TokenScopeWrite, expiresAt)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.HasPrefix(plain, TokenPrefix), check.Equals, true)
+	c.Assert(plain, check.HasLen, len(TokenPrefix)+64)
+	c.Assert(t.ID, check.Not(check.Equals), "")
+	c.Assert(t.Name, check.Equals, "laptop")
+	c.Assert(t.UserName, check.Equals, "bilbo")
+	c.Assert(t.Scope, check.Equals, TokenScopeWrite)
+	c.Assert(t.Hash, check.Equals, hashToken(plain))
+	c.Assert(t.Hash, check.Not(check.Equals), plain)
+	tokens, err := ListTokens(u.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(tokens, check.HasLen, 1)
+	c.Assert(tokens[0].ID, check.Equals, t.ID)
+	c.Assert(tokens[0].ExpiresAt.Unix(), check.Equals, expiresAt.Unix())
+}
+
+func (s *S) TestNewTokenDefaultScope(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	t, _, err := NewToken(u.Name, "laptop", "", time.Time{})
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Scope, check.Equals, TokenScopeRead)
+	c.Assert(t.CanWrite(), check.Equals, false)
+}
+
+func (s *S) TestNewTokenInvalid(c *check.C) {
+	_, _, err := NewToken("bilbo", "", TokenScopeRead, time.Time{})
+	c.Assert(err, check.ErrorMatches, "the name of the token is required")
+	_, _, err = NewToken("bilbo", "laptop", "admin", time.Time{})
+	c.Assert(err, check.FitsTypeOf, &InvalidTokenError{})
+	_, _, err = NewToken("bilbo", "laptop", TokenScopeRead, time.Now().Add(-time.Hour))
+	c.Assert(err, check.FitsTypeOf, &InvalidTokenError{})
+}
+
+func (s *S) TestNewTokenUserNotFound(c *check.C) {
+	_, _, err := NewToken("nobody", "laptop", TokenScopeRead, time.Time{})
+	c.Assert(err, check.Equals, ErrUserNotFound)
+}
+
+func (s *S) TestNewTokenDuplicate(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	_, _, err = NewToken(u.Name, "laptop", TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	_, _, err = NewToken(u.Name, "laptop", TokenScopeWrite, time.Time{})
+	c.Assert(err, check.Equals, ErrDuplicateToken)
+}
+
+func (s *S) TestRevokeToken(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	t, plain, err := NewToken(u.Name, "laptop", TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	err = RevokeToken("frodo", t.ID)
+	c.Assert(err, check.Equals, ErrTokenNotFound)
+	err = RevokeToken(u.Name, t.ID)
+	c.Assert(err, check.IsNil)
+	_, err = AuthenticateToken(plain)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+	err = RevokeToken(u.Name, t.ID)
+	c.Assert(err, check.Equals, ErrTokenNotFound)
+}
+
+func (s *S) TestAuthenticateToken(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	t, plain, err := NewToken(u.Name, "laptop", TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	c.Assert(t.LastUsedAt.IsZero(), check.Equals, true)
+	found, err := AuthenticateToken(plain)
+	c.Assert(err, check.IsNil)
+	c.Assert(found.ID, check.Equals, t.ID)
+	c.Assert(found.UserName, check.Equals, "bilbo")
+	c.Assert(found.LastUsedAt.IsZero(), check.Equals, false)
+	_, err = AuthenticateToken(plain + "0")
+	c.Assert(err, check.Equals, ErrInvalidToken)
+	_, err = AuthenticateToken("secret")
+	c.Assert(err, check.Equals, ErrInvalidToken)
+}
+
+func (s *S) TestAuthenticateTokenExpired(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	_, plain, err := NewToken(u.Name, "laptop", TokenScopeRead, time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	conn, err := db.Conn()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.Token().UpdateAll(nil, bson.M{"$set": bson.M{"expiresat": time.Now().Add(-time.Minute)}})
+	c.Assert(err, check.IsNil)
+	_, err = AuthenticateToken(plain)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+}
+
+func (s *S) TestAuthenticateTokenSuspendedUser(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	defer Remove(u.Name)
+	_, plain, err := NewToken(u.Name, "laptop", TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	err = Suspend(u.Name)
+	c.Assert(err, check.IsNil)
+	_, err = AuthenticateToken(plain)
+	c.Assert(err, check.Equals, ErrUserSuspended)
+}
+
+func (s *S) TestRemoveUserRemovesTokens(c *check.C) {
+	u, err := New("bilbo", nil)
+	c.Assert(err, check.IsNil)
+	_, plain, err := NewToken(u.Name, "laptop", TokenScopeRead, time.Time{})
+	c.Assert(err, check.IsNil)
+	err = Remove(u.Name)
+	c.Assert(err, check.IsNil)
+	_, err = AuthenticateToken(plain)
+	c.Assert(err, check.Equals, ErrInvalidToken)
+}
@@ -8,10 +8,12 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/tsuru/gandalf/db"
+	"github.com/tsuru/gandalf/group"
 	"github.com/tsuru/gandalf/repository"
 	"github.com/tsuru/tsuru/log"
 )
@@ -24,7 +26,9 @@ var (
 )
 
 type User struct {
-	Name string `bson:"_id"`
+	Name       string   `bson:"_id"`
+	Principals []string `bson:",omitempty"`
+	Suspended  bool     `bson:",omitempty"`
 }
 
 // Creates a new user and write his/her keys into authorized_keys file.
@@ -50,7 +54,7 @@ func New(name string, keys map[string]string) (*User, error) {
 		log.Errorf("user.New: %s", err)
 		return nil, err
 	}
-	return u, addKeys(keys, u.Name)
+	return u, addKeys(keys, u.Name, time.Time{})
 }
 
 func (u *User) isValid() (isValid bool, err error) {
@@ -86,6 +90,18 @@ func Remove(name string) error {
 	if err := conn.User().RemoveId(u.Name); err != nil {
 		return fmt.Errorf("Could not remove user: %s", err.Error())
 	}
+	if err := removePrincipals(u.Principals); err != nil {
+		return err
+	}
+	if err := group.RemoveFromAll(u.Name); err != nil {
+		return err
+	}
+	if err := repository.RemoveUserFromNamespaces(u.Name); err != nil {
+		return err
+	}
+	if err := removeUserTokens(u.Name); err != nil {
+		return err
+	}
 	return removeUserKeys(u.Name)
 }
 
@@ -122,6 +138,12 @@ func (u *User) handleAssociatedRepositories() error {
 //
 // Returns an error in case the user does not exist.
 func AddKey(username string, k map[string]string) error {
+	return AddExpiringKey(username, k, time.Time{})
+}
+
+// AddExpiringKey works like AddKey, but the keys expire at the given time. A
+// zero time means that the keys never expire.
+func AddExpiringKey(username string, k map[string]string, expiresAt time.Time) error {
 	var u User
 	conn, err := db.Conn()
 	if err != nil {
@@ -131,10 +153,11 @@ func AddKey(username string, k map[string]string) error {
 	if err := conn.User().FindId(username).One(&u); err != nil {
 		return ErrUserNotFound
 	}
-	return addKeys(k, u.Name)
+	return addKeys(k, u.Name, expiresAt)
 }
 
-// UpdateKey updates the content of the given key.
+// UpdateKey updates the content and the expiration time of the given key.
+// When k has no expiration time, the key keeps its current one.
 func UpdateKey(username string, k Key) error {
 	var u User
 	conn, err := db.Conn()
@@ -145,7 +168,12 @@ func UpdateKey(username string, k Key) error {
 	if err := conn.User().FindId(username).One(&u); err != nil {
 		return ErrUserNotFound
 	}
-	return updateKey(k.Name, k.Body, u.Name)
+	newK, err := newKey(k.Name, u.Name, k.Body)
+	if err != nil {
+		return err
+	}
+	newK.ExpiresAt = k.ExpiresAt
+	return replaceKey(newK)
 }
 
 // RemoveKey removes the key from the database and from authorized_keys file.
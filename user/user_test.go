@@ -14,6 +14,7 @@ import (
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/db"
 	"github.com/tsuru/gandalf/fs"
+	"github.com/tsuru/gandalf/group"
 	"github.com/tsuru/gandalf/repository"
 	"github.com/tsuru/tsuru/fs/fstest"
 	"gopkg.in/check.v1"
@@ -192,6 +193,19 @@ func (s *S) TestRemoveRemovesKeyFromAuthorizedKeysFile(c *check.C) {
 	c.Assert(got, check.Equals, "")
 }
 
+func (s *S) TestRemoveRemovesUserFromGroups(c *check.C) {
+	u, err := New("someuser", map[string]string{})
+	c.Assert(err, check.IsNil)
+	_, err = group.New("devs", []string{u.Name, "otheruser"})
+	c.Assert(err, check.IsNil)
+	defer group.Remove("devs")
+	err = Remove(u.Name)
+	c.Assert(err, check.IsNil)
+	g, err := group.Get("devs")
+	c.Assert(err, check.IsNil)
+	c.Assert(g.Members, check.DeepEquals, []string{"otheruser"})
+}
+
 func (s *S) TestRemoveNotFound(c *check.C) {
 	err := Remove("otheruser")
 	c.Assert(err, check.Equals, ErrUserNotFound)
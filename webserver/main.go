@@ -8,17 +8,63 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"path/filepath"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/google/gops/agent"
 
 	"github.com/tsuru/config"
 	"github.com/tsuru/gandalf/api"
+	"github.com/tsuru/gandalf/hook"
+	"github.com/tsuru/gandalf/repository"
+	"github.com/tsuru/gandalf/sshd"
+	"github.com/tsuru/gandalf/user"
 	"github.com/tsuru/tsuru/log"
 )
 
 const version = "0.7.3"
 
+// removeExpiredKeys periodically removes expired keys, every
+// keys:reaper-interval seconds (one minute by default).
+func removeExpiredKeys() {
+	interval, err := config.GetInt("keys:reaper-interval")
+	if err != nil || interval <= 0 {
+		interval = 60
+	}
+	for range time.Tick(time.Duration(interval) * time.Second) {
+		keys, err := user.RemoveExpiredKeys()
+		if err != nil {
+			log.Errorf("Could not remove expired keys: %s", err)
+			continue
+		}
+		for _, k := range keys {
+			log.Debugf("Removed expired key %q of user %q", k.Name, k.UserName)
+		}
+	}
+}
+
+// removeExpiredGrants periodically revokes expired access grants, every
+// grants:reaper-interval seconds (one minute by default).
+func removeExpiredGrants() {
+	interval, err := config.GetInt("grants:reaper-interval")
+	if err != nil || interval <= 0 {
+		interval = 60
+	}
+	for range time.Tick(time.Duration(interval) * time.Second) {
+		removed, err := repository.RemoveExpiredGrants()
+		if err != nil {
+			log.Errorf("Could not remove expired grants: %s", err)
+			continue
+		}
+		for name, expirations := range removed {
+			for _, e := range expirations {
+				log.Debugf("Removed expired access of user %q in repository %q", e.User, name)
+			}
+		}
+	}
+}
+
 func main() {
 	dry := flag.Bool("dry", false, "dry-run: does not start the server (for testing purpose)")
 	configFile := flag.String("config", "/etc/gandalf.conf", "Gandalf configuration file")
@@ -39,12 +85,20 @@ func main() {
 	}
 	log.Init()
 	log.Debugf("Successfully read config file: %s\n", *configFile)
+	if hook.ConfigFile, err = filepath.Abs(*configFile); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err = hook.CheckGitVersion(); err != nil {
+		log.Errorf("Pushes will be refused: %s", err)
+	}
 	router := api.SetupRouter()
 	n := negroni.New()
 	n.Use(api.NewLoggerMiddleware())
 	n.Use(api.NewResponseHeaderMiddleware("Server", "gandalf-webserver/"+version))
 	n.Use(api.NewResponseHeaderMiddleware("Cache-Control", "private, max-age=0"))
 	n.Use(api.NewResponseHeaderMiddleware("Expires", "-1"))
+	n.Use(api.NewAuthMiddleware())
+	n.Use(api.NewAuditMiddleware())
 	n.UseHandler(router)
 	bind, err := config.GetString("bind")
 	if err != nil {
@@ -67,8 +121,24 @@ func main() {
 			fmt.Println("Diagnostics agent started")
 		}
 
+		if sshBind, err := config.GetString("git:ssh:server:bind"); err == nil {
+			hostKey, err := config.GetString("git:ssh:server:host-key")
+			if err != nil {
+				panic("You should configure a git:ssh:server:host-key for the gandalf SSH server.")
+			}
+			server, err := sshd.NewServer(sshBind, hostKey)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			go server.Serve()
+			fmt.Printf("gandalf-webserver %s SSH server listening on %s\n", version, sshBind)
+		}
+
+		go removeExpiredKeys()
+		go removeExpiredGrants()
+
 		fmt.Printf("Repository location: %s\n", bareLocation)
 		fmt.Printf("gandalf-webserver %s listening on %s\n", version, bind)
-		http.ListenAndServe(bind, router)
+		http.ListenAndServe(bind, n)
 	}
 }